@@ -74,25 +74,34 @@ Create the name of the service account to use
 {{- end }}
 
 {{/*
-Create the name of the CSI driver
+Create the name of the CSI driver, drivers serving several types have a name of their own
 */}}
 {{- define "truenas-scale-csi.csiDriverName" -}}
-{{- if eq .Values.settings.type "nfs" -}}
+{{- if contains "," .Values.settings.type -}}
+{{ .Values.csiDriverName }}
+{{- else if eq .Values.settings.type "nfs" -}}
 {{ .Values.nfsCSIDriverName }}
+{{- else if eq .Values.settings.type "smb" -}}
+{{ .Values.smbCSIDriverName }}
+{{- else if eq .Values.settings.type "nvme" -}}
+{{ .Values.nvmeCSIDriverName }}
 {{- else -}}
 {{ .Values.iscsiCSIDriverName }}
 {{- end -}}
 {{- end -}}
 
 {{/*
-Create the name of the Storage class
+attachRequired of the CSIDriver, immutable. It covers every volume so is only set when iSCSI is served alone
 */}}
-{{- define "truenas-scale-csi.storageClassName" -}}
-{{- if eq .Values.settings.type "nfs" -}}
-{{ .Values.storageClass.namePrefix }}nfs
-{{- else -}}
-{{ .Values.storageClass.namePrefix }}iscsi
+{{- define "truenas-scale-csi.attachRequired" -}}
+{{ eq .Values.settings.type "iscsi" }}
 {{- end -}}
+
+{{/*
+Comma separated volumeLifecycleModes of the CSIDriver, immutable
+*/}}
+{{- define "truenas-scale-csi.volumeLifecycleModes" -}}
+Persistent{{ if .Values.node.ephemeral.enabled }},Ephemeral{{ end }}
 {{- end -}}
 
 {{/*
@@ -2,50 +2,147 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 
 	"k8s.io/klog/v2"
 )
 
-var iscsiPaths = []string{
-	"/sbin/iscsiadm",
-	"/usr/local/sbin/iscsiadm",
-	"/bin/iscsiadm",
-	"/usr/local/bin/iscsiadm",
+// Directories searched on the host for tools, covers the usual distros as well as NixOS. Talos extensions and Flatcar
+// sysexts land in /usr/local/sbin and /usr/sbin respectively.
+var defaultSearchPaths = []string{
+	"/sbin",
+	"/usr/sbin",
+	"/usr/local/sbin",
+	"/bin",
+	"/usr/bin",
+	"/usr/local/bin",
+	"/run/current-system/sw/sbin",
+	"/run/current-system/sw/bin",
+}
+
+// Tools which can be run on the host by invoking this binary (or a symlink to it) under the tool's name. Whatever
+// formats a volume should also check and grow it, so fsck, xfs_growfs and blkid come along with mkfs.
+var passthroughTools = []string{
+	"iscsiadm",
+	"multipath",
+	"blockdev",
+	"blkid",
+	"resize2fs",
+	"xfs_growfs",
+	"mkfs.*",
+	"fsck",
+	"fsck.*",
+	"nvme",
+}
+
+var nsenterPaths = []string{
+	"/usr/bin/nsenter",
+	"/bin/nsenter",
 }
 
 func main() {
-	chrootDir := os.Getenv("HOST_DIR")
-	if chrootDir == "" {
-		chrootDir = "/host"
+	tool := filepath.Base(os.Args[0])
+	if !isPassthroughTool(tool) {
+		// Anything else, e.g. when installed under a different name, is iscsiadm as that's what this always did
+		tool = "iscsiadm"
+	}
+
+	hostDir := os.Getenv("HOST_DIR")
+	if hostDir == "" {
+		hostDir = "/host"
+	}
+
+	mode := os.Getenv("HOST_EXEC_MODE")
+	switch mode {
+	case "", "chroot":
+		execChroot(tool, hostDir)
+	case "nsenter":
+		execNsenter(tool, hostDir)
+	default:
+		klog.ErrorS(nil, "unknown HOST_EXEC_MODE, should be chroot or nsenter", "mode", mode)
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+}
+
+// execChroot chroots into the host filesystem and runs the tool from there.
+func execChroot(tool, hostDir string) {
+	if err := syscall.Chroot(hostDir); err != nil {
+		klog.ErrorS(err, "failed to chroot", "chrootDir", hostDir)
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 
-	if err := syscall.Chroot(chrootDir); err != nil {
-		klog.ErrorS(err, "failed to chroot", "chrootDir", chrootDir)
+	toolPath := findTool(tool, "/")
+
+	// Replace first argument which is the binary path with the real tool
+	args := []string{toolPath}
+	args = append(args, os.Args[1:]...)
+	if err := syscall.Exec(toolPath, args, os.Environ()); err != nil {
+		klog.ErrorS(err, "failed to exec", "execPath", toolPath)
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
+}
 
-	iscsiadmPath := os.Getenv("ISCSIADM_PATH")
-	if iscsiadmPath == "" {
-		for _, path := range iscsiPaths {
+// execNsenter runs the tool in the mount, network, IPC and UTS namespaces of the host's PID 1. Needs hostPID, works
+// on immutable distros where a chroot is missing the rest of the host's runtime state.
+func execNsenter(tool, hostDir string) {
+	nsenterPath := os.Getenv("NSENTER_PATH")
+	if nsenterPath == "" {
+		for _, path := range nsenterPaths {
 			if _, err := os.Stat(path); err == nil {
-				iscsiadmPath = path
+				nsenterPath = path
 				break
 			}
 		}
 	}
-
-	if iscsiadmPath == "" {
-		klog.Error("iscsiadm binary not found, consider specifying ISCSIADM_PATH")
+	if nsenterPath == "" {
+		klog.Error("nsenter binary not found, consider specifying NSENTER_PATH")
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 
-	// Replace first argument which is the binary path with the real
-	// iscsiadm
-	args := []string{iscsiadmPath}
+	// Look through the host filesystem as seen from the container, the path is then used in the host's namespace
+	toolPath := findTool(tool, hostDir)
+
+	args := []string{nsenterPath, "--target", "1", "--mount", "--net", "--ipc", "--uts", "--", toolPath}
 	args = append(args, os.Args[1:]...)
-	if err := syscall.Exec(iscsiadmPath, args, os.Environ()); err != nil {
-		klog.ErrorS(err, "failed to exec", "execPath", iscsiadmPath)
+	if err := syscall.Exec(nsenterPath, args, os.Environ()); err != nil {
+		klog.ErrorS(err, "failed to exec", "execPath", nsenterPath)
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 }
+
+// findTool returns the path of the tool on the host, looking for it below root. The tool can be pinned with e.g.
+// ISCSIADM_PATH or MKFS_EXT4_PATH, and HOST_SEARCH_PATH adds colon separated directories to search first.
+func findTool(tool, root string) string {
+	envName := strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(tool)) + "_PATH"
+	if toolPath := os.Getenv(envName); toolPath != "" {
+		return toolPath
+	}
+
+	searchPaths := make([]string, 0, len(defaultSearchPaths))
+	if extra := os.Getenv("HOST_SEARCH_PATH"); extra != "" {
+		searchPaths = append(searchPaths, filepath.SplitList(extra)...)
+	}
+	searchPaths = append(searchPaths, defaultSearchPaths...)
+
+	for _, dir := range searchPaths {
+		toolPath := filepath.Join(dir, tool)
+		if _, err := os.Stat(filepath.Join(root, toolPath)); err == nil {
+			return toolPath
+		}
+	}
+
+	klog.ErrorS(nil, "binary not found, consider specifying "+envName+" or HOST_SEARCH_PATH", "tool", tool)
+	klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	return ""
+}
+
+func isPassthroughTool(tool string) bool {
+	for _, pattern := range passthroughTools {
+		if matched, _ := filepath.Match(pattern, tool); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	flag "github.com/spf13/pflag"
 	"k8s.io/component-base/featuregate"
@@ -28,14 +30,26 @@ func main() {
 
 	var (
 		endpoint         = fs.String("endpoint", "", "CSI endpoint")
-		truenasURL       = fs.String("url", "", "TrueNAS Scale URL (ends with api/v2.0)")
+		truenasURL       = fs.String("url", "", "TrueNAS Scale URL, ending with api/v2.0 for the REST API or e.g. wss://truenas/api/current for the WebSocket API")
+		apiType          = fs.String("api", driver.APIREST, "TrueNAS API to use, rest or websocket")
 		nfsStoragePath   = fs.String("nfs-storage-path", "", "NFS StoragePool/Dataset path")
+		nfsNetworks      = fs.StringSlice("nfs-allowed-networks", nil, "Networks in CIDR notation allowed to mount NFS shares, defaults to any")
+		nfsHosts         = fs.StringSlice("nfs-allowed-hosts", nil, "Hostnames or IPs allowed to mount NFS shares, defaults to any")
+		nfsServers       = fs.StringSlice("nfs-server", nil, "Hostnames or IPs nodes mount NFS shares from, tried in order, defaults to the host of --url")
+		nfsNoLock        = fs.Bool("nfs-nolock", false, "Mount NFS shares without locking")
+		nfsMountTimeout  = fs.Duration("nfs-mount-timeout", 2*time.Minute, "Time given to each NFS mount and unmount before giving up, 0 to wait as long as the request allows")
+		nfsSubdirDataset = fs.String("nfs-subdir-dataset", "", "NFS shared dataset path holding volumes created with provisioningMode subdirectory")
 		version          = fs.Bool("version", false, "Print the version and exit")
 		controller       = fs.Bool("controller", false, "Serve controller driver, else it will operate as node driver")
 		nodeID           = fs.String("node-id", "", "Node ID")
-		csiType          = fs.String("type", "", "Type of CSI driver either NFS or ISCSI")
+		csiTypes         = fs.StringSlice("type", nil, "Types of CSI driver, NFS, ISCSI, SMB and/or NVMe, the first is used by StorageClasses without a protocol parameter")
 		iscsiStoragePath = fs.String("iscsi-storage-path", "", "iSCSI StoragePool/Dataset path")
-		portalID         = fs.Int32("portal", -1, "Portal ID")
+		smbStoragePath   = fs.String("smb-storage-path", "", "SMB StoragePool/Dataset path")
+		smbServer        = fs.String("smb-server", "", "Hostname or IP nodes mount SMB shares from, defaults to the host of --url")
+		nvmeStoragePath  = fs.String("nvme-storage-path", "", "NVMe-oF StoragePool/Dataset path")
+		nvmePort         = fs.String("nvme-port", "", "NVMe-oF port ID or listen address, defaults to the first TCP port")
+		portal           = fs.String("portal", "", "Portal ID, comment or listen IP")
+		sharedTargets    = fs.Int("iscsi-shared-targets", 0, "Number of shared iSCSI targets to pack volumes into as LUNs, 0 creates a target per volume")
 		ignoreTLS        = fs.Bool("ignore-tls", false, "Ignore TLS errors")
 		driverName       = fs.String("driver-name", "", "CSI Driver name")
 	)
@@ -69,24 +83,67 @@ func main() {
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 
-	if *csiType != "nfs" && *csiType != "iscsi" {
-		klog.Error("--type must be either NFS or ISCSI")
+	if len(*csiTypes) == 0 {
+		klog.Error("--type must be specified")
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
-	isNFS := *csiType == "nfs"
 
-	if !isNFS {
-		if *portalID == -1 {
-			klog.Error("--portal must be specified")
+	seenTypes := make(map[string]bool)
+	driverTypes := make([]string, 0, len(*csiTypes))
+	for _, csiType := range *csiTypes {
+		csiType = strings.ToLower(csiType)
+		driverTypes = append(driverTypes, csiType)
+		if seenTypes[csiType] {
+			klog.ErrorS(nil, "--type lists a type more than once", "type", csiType)
 			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 		}
-		if *iscsiStoragePath == "" {
-			klog.Error("--iscsi-storage-path must be specified")
-			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
-		}
-	} else { //nolint:gocritic
-		if *nfsStoragePath == "" {
-			klog.Error("--nfs-storage-path must be specified")
+		seenTypes[csiType] = true
+
+		switch csiType {
+		case driver.TypeISCSI:
+			if *portal == "" {
+				klog.Error("--portal must be specified")
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+			if *iscsiStoragePath == "" {
+				klog.Error("--iscsi-storage-path must be specified")
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+			if *sharedTargets < 0 {
+				klog.Error("--iscsi-shared-targets must not be negative")
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+		case driver.TypeSMB:
+			if *smbStoragePath == "" {
+				klog.Error("--smb-storage-path must be specified")
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+			if *smbServer != "" {
+				if err := driver.ValidateSMBServer(*smbServer); err != nil {
+					klog.ErrorS(err, "invalid --smb-server")
+					klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+				}
+			}
+		case driver.TypeNVMe:
+			if *nvmeStoragePath == "" {
+				klog.Error("--nvme-storage-path must be specified")
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+		case driver.TypeNFS:
+			if *nfsStoragePath == "" {
+				klog.Error("--nfs-storage-path must be specified")
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+			if err := driver.ValidateNFSAccess(*nfsNetworks, *nfsHosts); err != nil {
+				klog.ErrorS(err, "invalid --nfs-allowed-networks or --nfs-allowed-hosts")
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+			if err := driver.ValidateNFSServers(*nfsServers); err != nil {
+				klog.ErrorS(err, "invalid --nfs-server")
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+		default:
+			klog.ErrorS(nil, "--type must be either NFS, ISCSI, SMB or NVMe", "type", csiType)
 			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 		}
 	}
@@ -101,25 +158,49 @@ func main() {
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 
-	var drv *driver.Driver
-	var err error
-	enableDebugLogging := loggingConfig.Verbosity > 4
-
 	if *controller {
-		accessToken := os.Getenv("TRUENAS_TOKEN")
-
 		klog.V(5).Info("initiating controller driver")
-		if drv, err = driver.NewDriver(*endpoint, *truenasURL, accessToken, *nfsStoragePath, *iscsiStoragePath, *portalID, *controller, *nodeID, isNFS, enableDebugLogging, *ignoreTLS, *driverName); err != nil {
-			klog.ErrorS(err, "failed to init CSI driver")
-			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
-		}
 	} else {
-		// Node mode doesnt require qnap access
 		klog.V(5).Info("initiating node driver")
-		if drv, err = driver.NewDriver(*endpoint, *truenasURL, "", *nfsStoragePath, *iscsiStoragePath, *portalID, *controller, *nodeID, isNFS, enableDebugLogging, *ignoreTLS, *driverName); err != nil {
-			klog.ErrorS(err, "failed to init CSI driver")
-			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
-		}
+	}
+	// Nodes only need TrueNAS access to create inline volumes, which are refused without a token
+	drv, err := driver.NewDriver(driver.DriverConfig{
+		Name:         *driverName,
+		Endpoint:     *endpoint,
+		BaseURL:      *truenasURL,
+		APIType:      *apiType,
+		AccessToken:  os.Getenv("TRUENAS_TOKEN"),
+		IgnoreTLS:    *ignoreTLS,
+		DebugLogging: loggingConfig.Verbosity > 4,
+		IsController: *controller,
+		NodeID:       *nodeID,
+		DriverTypes:  driverTypes,
+		NFS: driver.NFSConfig{
+			StoragePath:     *nfsStoragePath,
+			AllowedNetworks: *nfsNetworks,
+			AllowedHosts:    *nfsHosts,
+			Servers:         *nfsServers,
+			NoLock:          *nfsNoLock,
+			MountTimeout:    *nfsMountTimeout,
+			SubdirDataset:   *nfsSubdirDataset,
+		},
+		ISCSI: driver.ISCSIConfig{
+			StoragePath:   *iscsiStoragePath,
+			Portal:        *portal,
+			SharedTargets: *sharedTargets,
+		},
+		SMB: driver.SMBConfig{
+			StoragePath: *smbStoragePath,
+			Server:      *smbServer,
+		},
+		NVMe: driver.NVMeConfig{
+			StoragePath: *nvmeStoragePath,
+			Port:        *nvmePort,
+		},
+	})
+	if err != nil {
+		klog.ErrorS(err, "failed to init CSI driver")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 
 	if err = run(drv); err != nil {
@@ -27,6 +27,37 @@ const (
 	defaultVolumeSizeInBytes int64 = 16 * giB
 )
 
+// ParamProtocol is the StorageClass parameter choosing which of the driver's types volumes are created with.
+const ParamProtocol = "protocol"
+
+// protocolFor picks the type a StorageClass's volumes use, the driver's first type if it doesn't say.
+func (d *Driver) protocolFor(params map[string]string) (string, error) {
+	protocol, ok := params[ParamProtocol]
+	if !ok {
+		return d.driverTypes[0], nil
+	}
+	protocol = strings.ToLower(protocol)
+	if !d.serves(protocol) {
+		return "", status.Errorf(codes.InvalidArgument, "%s %q is not served by this driver, it serves %s", ParamProtocol, protocol, strings.Join(d.driverTypes, ", "))
+	}
+	return protocol, nil
+}
+
+// volumeProtocol returns the type of a volume from the prefix of its ID.
+func volumeProtocol(volumeID string) string {
+	switch {
+	case strings.HasPrefix(volumeID, NFSVolumePrefix):
+		return TypeNFS
+	case strings.HasPrefix(volumeID, ISCSIVolumePrefix):
+		return TypeISCSI
+	case strings.HasPrefix(volumeID, SMBVolumePrefix):
+		return TypeSMB
+	case strings.HasPrefix(volumeID, NVMeVolumePrefix):
+		return TypeNVMe
+	}
+	return ""
+}
+
 func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	if req.GetName() == "" {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume Name must be provided")
@@ -37,8 +68,18 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume capabilities must be provided")
 	}
 
-	if d.isNFS {
+	protocol, err := d.protocolFor(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	switch protocol {
+	case TypeNFS:
 		return d.nfsCreateVolume(ctx, req)
+	case TypeSMB:
+		return d.smbCreateVolume(ctx, req)
+	case TypeNVMe:
+		return d.nvmeCreateVolume(ctx, req)
 	}
 	return d.iscsiCreateVolume(ctx, req)
 }
@@ -58,6 +99,14 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 		if err := d.iscsiDeleteVolume(ctx, req); err != nil {
 			return nil, status.Errorf(codes.Internal, "Caught error while deleting volume: %s. %s", volumeID, err.Error())
 		}
+	case strings.HasPrefix(volumeID, SMBVolumePrefix):
+		if err := d.smbDeleteVolume(ctx, req); err != nil {
+			return nil, status.Errorf(codes.Internal, "Caught error while deleting volume: %s. %s", volumeID, err.Error())
+		}
+	case strings.HasPrefix(volumeID, NVMeVolumePrefix):
+		if err := d.nvmeDeleteVolume(ctx, req); err != nil {
+			return nil, status.Errorf(codes.Internal, "Caught error while deleting volume: %s. %s", volumeID, err.Error())
+		}
 	default:
 		return nil, status.Errorf(codes.Unknown, "Unknown volume type: %s", volumeID)
 	}
@@ -66,24 +115,38 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 }
 
 func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	if d.isNFS {
+	switch volumeProtocol(req.GetVolumeId()) {
+	case TypeNFS:
 		return d.nfsValidateVolumeCapabilities(ctx, req)
+	case TypeSMB:
+		return d.smbValidateVolumeCapabilities(ctx, req)
+	case TypeNVMe:
+		return d.nvmeValidateVolumeCapabilities(ctx, req)
 	}
 	return d.iscsiValidateVolumeCapabilities(ctx, req)
 }
 
 func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	var volumes []*csi.ListVolumesResponse_Entry
-	var err error
+	volumes := make([]*csi.ListVolumesResponse_Entry, 0)
+	for _, driverType := range d.driverTypes {
+		var typeVolumes []*csi.ListVolumesResponse_Entry
+		var err error
 
-	if d.isNFS {
-		volumes, err = d.nfsListVolumes(ctx)
-	} else {
-		volumes, err = d.iscsiListVolumes(ctx)
-	}
+		switch driverType {
+		case TypeNFS:
+			typeVolumes, err = d.nfsListVolumes(ctx)
+		case TypeSMB:
+			typeVolumes, err = d.smbListVolumes(ctx)
+		case TypeNVMe:
+			typeVolumes, err = d.nvmeListVolumes(ctx)
+		default:
+			typeVolumes, err = d.iscsiListVolumes(ctx)
+		}
 
-	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to list NFS shares")
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Failed to list volumes")
+		}
+		volumes = append(volumes, typeVolumes...)
 	}
 
 	// TODO somehow paginate over 2 sets of data
@@ -98,8 +161,19 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 }
 
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	if d.isNFS {
+	// Each protocol has its own dataset, the StorageClass parameters say which is asked about
+	protocol, err := d.protocolFor(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	switch protocol {
+	case TypeNFS:
 		return d.nfsGetCapacity(ctx, req)
+	case TypeSMB:
+		return d.smbGetCapacity(ctx, req)
+	case TypeNVMe:
+		return d.nvmeGetCapacity(ctx, req)
 	}
 	return d.iscsiGetCapacity(ctx, req)
 }
@@ -118,7 +192,6 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 	caps := make([]*csi.ControllerServiceCapability, 0)
 	for _, currentCap := range []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		// csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 		// csi.ControllerServiceCapability_RPC_GET_VOLUME,
@@ -129,6 +202,9 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 	} {
 		caps = append(caps, newCap(currentCap))
 	}
+	if d.iscsiAttaches() {
+		caps = append(caps, newCap(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME))
+	}
 
 	resp := &csi.ControllerGetCapabilitiesResponse{
 		Capabilities: caps,
@@ -163,11 +239,38 @@ func (d *Driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGet
 }
 
 func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "not implemented") // Not needed
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
+	}
+	if req.GetNodeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Node ID must be provided")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume capability must be provided")
+	}
+
+	// Only iSCSI needs to keep track of which nodes a volume is attached to
+	if !d.iscsiAttaches() {
+		return nil, status.Error(codes.Unimplemented, "not implemented")
+	}
+	if volumeProtocol(req.GetVolumeId()) != TypeISCSI {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerPublishVolume Volume ID %s is not an iSCSI volume", req.GetVolumeId())
+	}
+	return d.iscsiControllerPublishVolume(ctx, req)
 }
 
 func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "not implemented") // Not needed
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume Volume ID must be provided")
+	}
+
+	if !d.iscsiAttaches() {
+		return nil, status.Error(codes.Unimplemented, "not implemented")
+	}
+	if volumeProtocol(req.GetVolumeId()) != TypeISCSI {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerUnpublishVolume Volume ID %s is not an iSCSI volume", req.GetVolumeId())
+	}
+	return d.iscsiControllerUnpublishVolume(ctx, req)
 }
 
 func (d *Driver) ControllerModifyVolume(ctx context.Context, request *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
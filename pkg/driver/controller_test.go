@@ -0,0 +1,322 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+// newTestDriver returns a controller serving the types given, backed by a fakeStorage with a storage dataset for each.
+func newTestDriver(t *testing.T, driverTypes ...string) (*Driver, *fakeStorage) {
+	t.Helper()
+
+	storage := newFakeStorage()
+	for _, name := range []string{"tank/nfs", "tank/iscsi", "tank/smb"} {
+		storage.addDataset(name, 100*giB)
+	}
+	d := &Driver{
+		name:             "test.truenas-scale.terricain.github.com",
+		nfsStoragePath:   "tank/nfs",
+		iscsiStoragePath: "tank/iscsi",
+		smbStoragePath:   "tank/smb",
+		nodeID:           "node-1",
+		storage:          storage,
+		isController:     true,
+		apiAccess:        true,
+		driverTypes:      driverTypes,
+		portal:           "1",
+		nfsShares:        nfsSharePathSchema{},
+		nfsServers:       []string{"10.0.0.1"},
+		smbServer:        "10.0.0.1",
+	}
+	if d.serves(TypeISCSI) {
+		if err := d.iscsiLoadPortals(context.Background()); err != nil {
+			t.Fatalf("failed to load portals: %v", err)
+		}
+		portal, _ := d.iscsiFindPortal(d.portal)
+		d.portalID = portal.id
+	}
+	return d, storage
+}
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func createVolumeRequest(name string, params map[string]string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * giB},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         params,
+	}
+}
+
+// createTwice creates a volume twice, as the provisioner does when it retries, checking both get the same volume.
+func createTwice(t *testing.T, d *Driver, req *csi.CreateVolumeRequest) *csi.Volume {
+	t.Helper()
+
+	first, err := d.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	second, err := d.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("repeated CreateVolume failed: %v", err)
+	}
+	if !reflect.DeepEqual(first.GetVolume(), second.GetVolume()) {
+		t.Errorf("repeated CreateVolume returned %v, want %v", second.GetVolume(), first.GetVolume())
+	}
+	return first.GetVolume()
+}
+
+// deleteTwice deletes a volume twice, the second time finding nothing left to delete.
+func deleteTwice(t *testing.T, d *Driver, volumeID string) {
+	t.Helper()
+
+	for i := 0; i < 2; i++ {
+		if _, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Fatalf("DeleteVolume %d failed: %v", i+1, err)
+		}
+	}
+}
+
+func TestProtocolFor(t *testing.T) {
+	d, _ := newTestDriver(t, TypeNFS, TypeISCSI)
+
+	tests := []struct {
+		name     string
+		params   map[string]string
+		want     string
+		wantCode codes.Code
+	}{
+		{name: "default is the first type", params: nil, want: TypeNFS},
+		{name: "explicit", params: map[string]string{ParamProtocol: TypeISCSI}, want: TypeISCSI},
+		{name: "case insensitive", params: map[string]string{ParamProtocol: "ISCSI"}, want: TypeISCSI},
+		{name: "not served", params: map[string]string{ParamProtocol: TypeSMB}, wantCode: codes.InvalidArgument},
+		{name: "unknown", params: map[string]string{ParamProtocol: "ceph"}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := d.protocolFor(tt.params)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("protocolFor(%v) returned code %s, want %s: %v", tt.params, code, tt.wantCode, err)
+			}
+			if got != tt.want {
+				t.Errorf("protocolFor(%v) = %q, want %q", tt.params, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeDispatch(t *testing.T) {
+	d, _ := newTestDriver(t, TypeSMB, TypeNFS, TypeISCSI)
+
+	tests := []struct {
+		protocol   string
+		wantPrefix string
+	}{
+		{protocol: "", wantPrefix: SMBVolumePrefix},
+		{protocol: TypeNFS, wantPrefix: NFSVolumePrefix},
+		{protocol: TypeISCSI, wantPrefix: ISCSIVolumePrefix},
+		{protocol: TypeSMB, wantPrefix: SMBVolumePrefix},
+	}
+	for _, tt := range tests {
+		t.Run("protocol "+tt.protocol, func(t *testing.T) {
+			params := map[string]string{}
+			if tt.protocol != "" {
+				params[ParamProtocol] = tt.protocol
+			}
+			resp, err := d.CreateVolume(context.Background(), createVolumeRequest("pvc-"+tt.protocol, params))
+			if err != nil {
+				t.Fatalf("CreateVolume failed: %v", err)
+			}
+			volumeID := resp.GetVolume().GetVolumeId()
+			if !strings.HasPrefix(volumeID, tt.wantPrefix) {
+				t.Errorf("volume ID %q doesn't start with %q", volumeID, tt.wantPrefix)
+			}
+			// Deleting goes by the volume ID alone
+			if _, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+				t.Errorf("DeleteVolume failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestNFSCreateDeleteVolumeIdempotent(t *testing.T) {
+	d, storage := newTestDriver(t, TypeNFS)
+
+	volume := createTwice(t, d, createVolumeRequest("pvc-1", nil))
+	if volume.GetVolumeId() != NFSVolumePrefix+"pvc-1" {
+		t.Errorf("volume ID = %q, want %q", volume.GetVolumeId(), NFSVolumePrefix+"pvc-1")
+	}
+	if got := volume.GetVolumeContext()[NFSVolumeContextParamMountPoint]; got != "/mnt/tank/nfs/"+volume.GetVolumeId() {
+		t.Errorf("mount point = %q", got)
+	}
+	if _, ok := storage.datasets["tank/nfs/"+volume.GetVolumeId()]; !ok {
+		t.Error("dataset wasn't created")
+	}
+	if len(storage.nfsShares) != 1 || storage.calls["createNFSShare"] != 1 {
+		t.Errorf("got %d shares from %d creates, want 1 from 1", len(storage.nfsShares), storage.calls["createNFSShare"])
+	}
+
+	deleteTwice(t, d, volume.GetVolumeId())
+	if _, ok := storage.datasets["tank/nfs/"+volume.GetVolumeId()]; ok {
+		t.Error("dataset wasn't deleted")
+	}
+	if len(storage.nfsShares) != 0 {
+		t.Errorf("got %d shares left, want 0", len(storage.nfsShares))
+	}
+}
+
+func TestSMBCreateDeleteVolumeIdempotent(t *testing.T) {
+	d, storage := newTestDriver(t, TypeSMB)
+
+	volume := createTwice(t, d, createVolumeRequest("pvc-1", nil))
+	if volume.GetVolumeId() != SMBVolumePrefix+"pvc-1" {
+		t.Errorf("volume ID = %q, want %q", volume.GetVolumeId(), SMBVolumePrefix+"pvc-1")
+	}
+	if len(storage.smbShares) != 1 || storage.calls["createSMBShare"] != 1 {
+		t.Errorf("got %d shares from %d creates, want 1 from 1", len(storage.smbShares), storage.calls["createSMBShare"])
+	}
+
+	deleteTwice(t, d, volume.GetVolumeId())
+	if _, ok := storage.datasets["tank/smb/"+volume.GetVolumeId()]; ok {
+		t.Error("dataset wasn't deleted")
+	}
+	if len(storage.smbShares) != 0 {
+		t.Errorf("got %d shares left, want 0", len(storage.smbShares))
+	}
+}
+
+// iscsiObjectCounts is how many of each iSCSI object the fake has: extents, initiators, targets and target extents.
+func iscsiObjectCounts(storage *fakeStorage) [4]int {
+	return [4]int{len(storage.extents), len(storage.initiators), len(storage.targets), len(storage.targetExtents)}
+}
+
+func TestISCSICreateDeleteVolumeIdempotent(t *testing.T) {
+	d, storage := newTestDriver(t, TypeISCSI)
+
+	volume := createTwice(t, d, createVolumeRequest("pvc-1", nil))
+	volumeContext := volume.GetVolumeContext()
+	if volumeContext[ISCSIVolumeContextIQN] != "iqn.2005-10.org.freenas.ctl:"+volume.GetVolumeId() {
+		t.Errorf("IQN = %q", volumeContext[ISCSIVolumeContextIQN])
+	}
+	if volumeContext[ISCSIVolumeContextTargetPortal] != "10.0.0.1:3260" {
+		t.Errorf("portal = %q", volumeContext[ISCSIVolumeContextTargetPortal])
+	}
+	if volumeContext[ISCSIVolumeContextLUN] != "0" {
+		t.Errorf("LUN = %q, want 0", volumeContext[ISCSIVolumeContextLUN])
+	}
+	if got, want := iscsiObjectCounts(storage), [4]int{1, 1, 1, 1}; got != want {
+		t.Errorf("got %v iSCSI objects, want %v", got, want)
+	}
+
+	deleteTwice(t, d, volume.GetVolumeId())
+	if _, ok := storage.datasets["tank/iscsi/"+volume.GetVolumeId()]; ok {
+		t.Error("zvol wasn't deleted")
+	}
+	if got := iscsiObjectCounts(storage); got != [4]int{} {
+		t.Errorf("got %v iSCSI objects left, want none", got)
+	}
+}
+
+func TestISCSICreateVolumeSizeMismatch(t *testing.T) {
+	d, _ := newTestDriver(t, TypeISCSI)
+
+	createTwice(t, d, createVolumeRequest("pvc-1", nil))
+	req := createVolumeRequest("pvc-1", nil)
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 4 * giB}
+	if _, err := d.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateVolume with a different size returned %v, want AlreadyExists", err)
+	}
+}
+
+func TestISCSIEnsureRollsBackWhatItCreated(t *testing.T) {
+	d, storage := newTestDriver(t, TypeISCSI)
+	storage.failures["createISCSITarget"] = errors.New("target limit reached")
+
+	// A zvol left behind by an earlier attempt isn't this attempt's to roll back
+	if _, err := storage.createDataset(context.Background(), tnclient.CreateDatasetParams{
+		Name:    "tank/iscsi/" + ISCSIVolumePrefix + "pvc-1",
+		Type:    tnclient.PtrString("VOLUME"),
+		Volsize: tnclient.PtrInt64(2 * giB),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil)); status.Code(err) != codes.Internal {
+		t.Fatalf("CreateVolume returned %v, want Internal", err)
+	}
+	if got := iscsiObjectCounts(storage); got != [4]int{} {
+		t.Errorf("got %v iSCSI objects after rolling back, want none", got)
+	}
+	if _, ok := storage.datasets["tank/iscsi/"+ISCSIVolumePrefix+"pvc-1"]; !ok {
+		t.Error("existing zvol was rolled back")
+	}
+
+	delete(storage.failures, "createISCSITarget")
+	createTwice(t, d, createVolumeRequest("pvc-1", nil))
+	if got, want := iscsiObjectCounts(storage), [4]int{1, 1, 1, 1}; got != want {
+		t.Errorf("got %v iSCSI objects, want %v", got, want)
+	}
+}
+
+func TestISCSITeardownResumes(t *testing.T) {
+	d, storage := newTestDriver(t, TypeISCSI)
+	volume := createTwice(t, d, createVolumeRequest("pvc-1", nil))
+
+	// The target extent goes before the failure, the rest stays for the retry
+	storage.failures["deleteISCSITarget"] = errors.New("target is busy")
+	if _, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()}); err == nil {
+		t.Fatal("DeleteVolume succeeded with the target failing to delete")
+	}
+	if got, want := iscsiObjectCounts(storage), [4]int{1, 1, 1, 0}; got != want {
+		t.Errorf("got %v iSCSI objects after the failure, want %v", got, want)
+	}
+
+	delete(storage.failures, "deleteISCSITarget")
+	deleteTwice(t, d, volume.GetVolumeId())
+	if got := iscsiObjectCounts(storage); got != [4]int{} {
+		t.Errorf("got %v iSCSI objects left, want none", got)
+	}
+	if _, ok := storage.datasets["tank/iscsi/"+volume.GetVolumeId()]; ok {
+		t.Error("zvol wasn't deleted")
+	}
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		driverTypes []string
+		volumeID    string
+		wantCode    codes.Code
+	}{
+		{name: "not attaching", driverTypes: []string{TypeNFS, TypeISCSI}, volumeID: ISCSIVolumePrefix + "pvc-1", wantCode: codes.Unimplemented},
+		{name: "not iSCSI", driverTypes: []string{TypeISCSI}, volumeID: NFSVolumePrefix + "pvc-1", wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDriver(t, tt.driverTypes...)
+			_, err := d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				VolumeId:         tt.volumeID,
+				NodeId:           "node-1",
+				VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("ControllerPublishVolume returned %v, want %s", err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -2,24 +2,21 @@ package driver
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
-	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
-	"strings"
 	"sync"
+	"time"
 
 	"k8s.io/klog/v2"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
-	"golang.org/x/oauth2"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	mount "k8s.io/mount-utils"
@@ -28,6 +25,17 @@ import (
 const (
 	NFSDriverName   = "nfs.truenas-scale.terricain.github.com"
 	ISCSIDriverName = "iscsi.truenas-scale.terricain.github.com"
+	SMBDriverName   = "smb.truenas-scale.terricain.github.com"
+	NVMeDriverName  = "nvme.truenas-scale.terricain.github.com"
+)
+
+// Types of storage the driver can serve, given with --type. A driver can serve several, StorageClasses pick one with
+// the protocol parameter.
+const (
+	TypeNFS   = "nfs"
+	TypeISCSI = "iscsi"
+	TypeSMB   = "smb"
+	TypeNVMe  = "nvme"
 )
 
 var (
@@ -68,16 +76,60 @@ func GetVersionJSON() (string, error) {
 type Driver struct {
 	name    string
 	baseURL string
-	address string
 
 	nfsStoragePath   string
 	iscsiStoragePath string
+	smbStoragePath   string
+	nvmeStoragePath  string
 	nodeID           string
-	client           *tnclient.APIClient
+	storage          storageBackend
 	isController     bool
-	isNFS            bool
-	portalID         int32
-	iscsiConfigDir   string
+	// apiAccess is whether the driver has a TrueNAS access token, nodes only need one for inline volumes
+	apiAccess      bool
+	driverTypes    []string // TypeNFS, TypeISCSI, TypeSMB and/or TypeNVMe, the first is the default
+	portal         string   // portal ID, comment or listen IP used when a StorageClass doesn't choose one
+	portalID       int32    // portal resolved by loadDefaultPortal
+	iscsiConfigDir string
+	// ephemeralStateDir holds which volume each inline volume was created as
+	ephemeralStateDir string
+
+	// nfsAllowedNetworks and nfsAllowedHosts restrict which clients can mount shares, empty allows everyone
+	nfsAllowedNetworks []string
+	nfsAllowedHosts    []string
+	// version of TrueNAS, detected by loadTrueNASVersion
+	version trueNASVersion
+	// nfsShares is the share schema of the TrueNAS version
+	nfsShares nfsShareSchema
+	// apiStateMu protects versionLoaded and portalLoaded. The controller loads both at startup, nodes retry on their
+	// first inline volume if TrueNAS couldn't be reached then
+	apiStateMu    sync.Mutex
+	versionLoaded bool
+	portalLoaded  bool
+	// smbServer is the address nodes mount SMB shares from, defaulting to the host of the API URL
+	smbServer string
+	// nfsServers are the addresses nodes mount shares from, defaulting to the host of the API URL
+	nfsServers []string
+	// nfsNoLock mounts shares without locking
+	nfsNoLock bool
+	// nfsMountTimeout bounds each NFS mount and unmount, 0 leaves them to the request's deadline
+	nfsMountTimeout time.Duration
+	// nfsSubdirDataset is the dataset, already shared, holding subdirectory volumes
+	nfsSubdirDataset string
+	// nvmePort is the NVMe-oF port ID or listen address used when a StorageClass doesn't choose one, empty picks the
+	// first TCP port
+	nvmePort string
+
+	iscsiPortalsMu       sync.Mutex // protects iscsiPortals and iscsiPortalsLoadedAt
+	iscsiPortals         []tnclient.ISCSIPortal
+	iscsiPortalsLoadedAt time.Time // zero when the cache has been invalidated
+
+	// iscsiSharedTargets is the number of targets volumes are packed into as LUNs, 0 gives each volume its own target
+	iscsiSharedTargets int
+	iscsiLUNMu         sync.Mutex // serialises LUN allocation on shared targets
+	iscsiAttachMu      sync.Mutex // serialises updates to the nodes a volume is attached to
+
+	// volumeLocks serialises node operations on a volume, between kubelet's retries and the startup reconcile
+	volumeLocks volumeLocks
 
 	srv      *grpc.Server
 	endpoint string
@@ -87,44 +139,98 @@ type Driver struct {
 	ready   bool
 }
 
-func NewDriver(endpoint, baseURL, accessToken, nfsStoragePath, iscsiStoragePath string, portalID int32, isController bool, nodeID string, isNFS, debugLogging bool, ignoreTLS bool, driverName string) (*Driver, error) {
-	u, err := url.Parse(baseURL)
+// DriverConfig is everything NewDriver needs, as given on the command line.
+type DriverConfig struct {
+	Name         string
+	Endpoint     string
+	BaseURL      string
+	APIType      string // APIREST or APIWebSocket
+	AccessToken  string
+	IgnoreTLS    bool
+	DebugLogging bool
+	IsController bool
+	NodeID       string
+	// DriverTypes are TypeNFS, TypeISCSI, TypeSMB and/or TypeNVMe, the first is the default
+	DriverTypes []string
+
+	NFS   NFSConfig
+	ISCSI ISCSIConfig
+	SMB   SMBConfig
+	NVMe  NVMeConfig
+}
+
+// NFSConfig is the NFS part of a DriverConfig.
+type NFSConfig struct {
+	StoragePath     string
+	AllowedNetworks []string
+	AllowedHosts    []string
+	// Servers default to the host of the API URL
+	Servers       []string
+	NoLock        bool
+	MountTimeout  time.Duration
+	SubdirDataset string
+}
+
+// ISCSIConfig is the iSCSI part of a DriverConfig.
+type ISCSIConfig struct {
+	StoragePath   string
+	Portal        string
+	SharedTargets int
+}
+
+// SMBConfig is the SMB part of a DriverConfig.
+type SMBConfig struct {
+	StoragePath string
+	// Server defaults to the host of the API URL
+	Server string
+}
+
+// NVMeConfig is the NVMe-oF part of a DriverConfig.
+type NVMeConfig struct {
+	StoragePath string
+	Port        string
+}
+
+func NewDriver(cfg DriverConfig) (*Driver, error) {
+	api, u, err := newAPIBackend(cfg.APIType, cfg.BaseURL, cfg.AccessToken, cfg.DebugLogging, cfg.IgnoreTLS)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse address: %w", err)
-	}
-	if !strings.HasSuffix(u.Path, "api/v2.0") {
-		return nil, fmt.Errorf("base URL should end with \"api/v2.0\": %s", u.Path)
+		return nil, err
 	}
 
-	apiCtx := context.Background()
-	tr := &http.Transport{
-		// This defaults to false
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: ignoreTLS}, //nolint:gosec
+	nfsServers := cfg.NFS.Servers
+	if len(nfsServers) == 0 {
+		nfsServers = []string{u.Hostname()}
+	}
+	smbServer := cfg.SMB.Server
+	if smbServer == "" {
+		smbServer = u.Hostname()
 	}
-	tlsClient := &http.Client{Transport: tr}
-	apiCtx = context.WithValue(apiCtx, oauth2.HTTPClient, tlsClient)
-
-	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken})
-	tc := oauth2.NewClient(apiCtx, ts)
-	config := tnclient.NewConfiguration()
-	config.Servers = tnclient.ServerConfigurations{tnclient.ServerConfiguration{URL: baseURL}}
-	config.Debug = debugLogging
-	config.HTTPClient = tc
-	client := tnclient.NewAPIClient(config)
 
 	return &Driver{
-		name:             driverName,
-		baseURL:          baseURL,
-		address:          u.Host,
-		nfsStoragePath:   nfsStoragePath,
-		iscsiStoragePath: iscsiStoragePath,
-		portalID:         portalID,
-		nodeID:           nodeID,
-		client:           client,
-		isController:     isController,
-		isNFS:            isNFS,
-		endpoint:         endpoint,
-		mounter:          mount.New(""),
+		name:               cfg.Name,
+		baseURL:            cfg.BaseURL,
+		nfsStoragePath:     cfg.NFS.StoragePath,
+		nfsAllowedNetworks: cfg.NFS.AllowedNetworks,
+		nfsAllowedHosts:    cfg.NFS.AllowedHosts,
+		nfsShares:          nfsSharePathSchema{},
+		nfsServers:         nfsServers,
+		nfsNoLock:          cfg.NFS.NoLock,
+		nfsMountTimeout:    cfg.NFS.MountTimeout,
+		nfsSubdirDataset:   cfg.NFS.SubdirDataset,
+		iscsiStoragePath:   cfg.ISCSI.StoragePath,
+		portal:             cfg.ISCSI.Portal,
+		iscsiSharedTargets: cfg.ISCSI.SharedTargets,
+		nodeID:             cfg.NodeID,
+		storage:            newAPIStorage(api),
+		isController:       cfg.IsController,
+		apiAccess:          cfg.AccessToken != "",
+		driverTypes:        cfg.DriverTypes,
+		smbStoragePath:     cfg.SMB.StoragePath,
+		smbServer:          smbServer,
+		nvmeStoragePath:    cfg.NVMe.StoragePath,
+		nvmePort:           cfg.NVMe.Port,
+		endpoint:           cfg.Endpoint,
+		mounter:            mount.New(""),
 	}, nil
 }
 
@@ -154,11 +260,51 @@ func (d *Driver) Run(ctx context.Context) error {
 		return fmt.Errorf("failed to make directories for sock, error: %w", err)
 	}
 
-	if !d.isNFS {
+	// Nodes given an access token create inline volumes themselves so need the same as the controller, but only for
+	// those, so they start anyway and try again on the first inline volume
+	if d.isController {
+		if err = d.loadTrueNASVersion(ctx); err != nil {
+			return err
+		}
+	} else if d.apiAccess {
+		if err = d.loadTrueNASVersion(ctx); err != nil {
+			klog.ErrorS(err, "failed to detect TrueNAS version, retrying on the first inline volume")
+		}
+	}
+
+	// Bring shares created before the allowed networks or hosts last changed in line
+	if d.serves(TypeNFS) && d.isController {
+		d.nfsReconcileShareAccess(ctx)
+	}
+
+	if d.serves(TypeISCSI) {
 		d.iscsiConfigDir = path.Join(sockPath, "iscsi_config")
 		if err = os.MkdirAll(d.iscsiConfigDir, 0o750); err != nil {
 			return fmt.Errorf("failed to make directories for config, error: %w", err)
 		}
+
+		// Sort out sessions and mounts left behind by a reboot or crash. This can take a while with many volumes, so
+		// it runs alongside kubelet's calls rather than holding up registration, taking the volume locks they take
+		if !d.isController {
+			go d.iscsiReconcile()
+		}
+
+		if d.isController {
+			if err = d.loadDefaultPortal(ctx); err != nil {
+				return err
+			}
+		} else if d.apiAccess {
+			if err = d.loadDefaultPortal(ctx); err != nil {
+				klog.ErrorS(err, "failed to resolve iSCSI portal, retrying on the first inline volume")
+			}
+		}
+	}
+
+	if !d.isController {
+		d.ephemeralStateDir = path.Join(sockPath, "ephemeral")
+		if err = os.MkdirAll(d.ephemeralStateDir, 0o750); err != nil {
+			return fmt.Errorf("failed to make directories for inline volume state, error: %w", err)
+		}
 	}
 
 	grpcListener, err := net.Listen(u.Scheme, grpcAddr)
@@ -194,7 +340,27 @@ func (d *Driver) Run(ctx context.Context) error {
 		return d.srv.Serve(grpcListener)
 	})
 
-	return eg.Wait()
+	err = eg.Wait()
+	if closeErr := d.storage.close(); closeErr != nil {
+		klog.ErrorS(closeErr, "failed to close TrueNAS API connection")
+	}
+	return err
+}
+
+// serves reports whether the driver was started with the given type.
+func (d *Driver) serves(driverType string) bool {
+	for _, served := range d.driverTypes {
+		if served == driverType {
+			return true
+		}
+	}
+	return false
+}
+
+// iscsiAttaches is whether volumes go through ControllerPublishVolume. attachRequired of the CSIDriver covers every
+// volume, so it's only set when iSCSI is served alone, volumes of the other types have nothing to attach.
+func (d *Driver) iscsiAttaches() bool {
+	return len(d.driverTypes) == 1 && d.serves(TypeISCSI)
 }
 
 func (d *Driver) setReady(state bool) {
@@ -206,3 +372,7 @@ func (d *Driver) setReady(state bool) {
 func (d *Driver) getISCSILibConfigPath(id string) string {
 	return path.Join(d.iscsiConfigDir, id+".json")
 }
+
+func (d *Driver) getISCSIPublishStatePath(id string) string {
+	return path.Join(d.iscsiConfigDir, id+".state")
+}
@@ -0,0 +1,195 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// EphemeralVolumeContextKey is set by kubelet on inline volumes, which get no CreateVolume or DeleteVolume.
+	EphemeralVolumeContextKey = "csi.storage.k8s.io/ephemeral"
+	// EphemeralParamSize is the volumeAttributes key giving the size of an inline volume, e.g. 10Gi.
+	EphemeralParamSize = "size"
+
+	kubeletVolumeContextPrefix = "csi.storage.k8s.io/"
+)
+
+// ephemeralState is persisted for each inline volume so unpublish knows which volume kubelet's ID was created as.
+type ephemeralState struct {
+	VolumeID string `json:"volume_id"`
+}
+
+func (d *Driver) getEphemeralStatePath(id string) string {
+	return path.Join(d.ephemeralStateDir, id+".json")
+}
+
+func (d *Driver) loadEphemeralState(id string) (*ephemeralState, error) {
+	data, err := os.ReadFile(d.getEphemeralStatePath(id))
+	if err != nil {
+		return nil, err
+	}
+	state := &ephemeralState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// ephemeralNodePublishVolume creates a volume for an inline volume from its volumeAttributes, which take the same
+// parameters as a StorageClass, then publishes it like any other.
+func (d *Driver) ephemeralNodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volume, err := d.ephemeralCreateVolume(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	// Kubelet's ID is locked, the startup reconcile takes the lock of the volume it was created as
+	if !d.volumeLocks.tryAcquire(volume.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", volume.GetVolumeId())
+	}
+	defer d.volumeLocks.release(volume.GetVolumeId())
+
+	publishReq := &csi.NodePublishVolumeRequest{
+		VolumeId:         volume.GetVolumeId(),
+		PublishContext:   req.GetPublishContext(),
+		TargetPath:       req.GetTargetPath(),
+		VolumeCapability: req.GetVolumeCapability(),
+		Readonly:         req.GetReadonly(),
+		Secrets:          req.GetSecrets(),
+		VolumeContext:    volume.GetVolumeContext(),
+	}
+	// iSCSI volumes are logged in to, formatted and mounted here as there's no staging
+	if volumeProtocol(volume.GetVolumeId()) == TypeISCSI {
+		return d.iscsiNodePublishVolume(ctx, publishReq)
+	}
+	return d.nfsNodePublishVolume(ctx, publishReq)
+}
+
+// ephemeralCreateVolume creates the NFS or iSCSI volume behind an inline volume, persisting which it is for unpublish.
+func (d *Driver) ephemeralCreateVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.Volume, error) {
+	if !d.apiAccess {
+		return nil, status.Error(codes.FailedPrecondition, "inline volumes need TrueNAS API access on the node, which has no access token")
+	}
+
+	params := make(map[string]string)
+	for key, value := range req.GetVolumeContext() {
+		if !strings.HasPrefix(key, kubeletVolumeContextPrefix) && key != EphemeralParamSize {
+			params[key] = value
+		}
+	}
+
+	protocol, err := d.protocolFor(params)
+	if err != nil {
+		return nil, err
+	}
+	if protocol != TypeNFS && protocol != TypeISCSI {
+		return nil, status.Errorf(codes.InvalidArgument, "inline volumes can only be NFS or iSCSI, not %s", protocol)
+	}
+
+	// Loaded at startup unless TrueNAS couldn't be reached then
+	if err = d.loadTrueNASVersion(ctx); err != nil {
+		klog.ErrorS(err, "failed to detect TrueNAS version")
+		return nil, status.Errorf(codes.Unavailable, "failed to detect TrueNAS version: %v", err)
+	}
+	if protocol == TypeISCSI {
+		if err = d.loadDefaultPortal(ctx); err != nil {
+			klog.ErrorS(err, "failed to resolve iSCSI portal")
+			return nil, status.Errorf(codes.Unavailable, "failed to resolve iSCSI portal: %v", err)
+		}
+	}
+
+	var capacityRange *csi.CapacityRange
+	if value, ok := req.GetVolumeContext()[EphemeralParamSize]; ok {
+		size, err2 := resource.ParseQuantity(value)
+		if err2 != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: %v", EphemeralParamSize, value, err2)
+		}
+		capacityRange = &csi.CapacityRange{RequiredBytes: size.Value()}
+	}
+
+	// Kubelet's volume ID is unique per pod volume, so makes a fine name and a retried publish finds the same volume
+	createReq := &csi.CreateVolumeRequest{
+		Name:               req.GetVolumeId(),
+		CapacityRange:      capacityRange,
+		VolumeCapabilities: []*csi.VolumeCapability{req.GetVolumeCapability()},
+		Parameters:         params,
+	}
+	var createResp *csi.CreateVolumeResponse
+	if protocol == TypeNFS {
+		createResp, err = d.nfsCreateVolume(ctx, createReq)
+	} else {
+		// LUNs of shared targets mapped by other nodes at the same time are caught by iscsiSharedLUNTaken
+		createResp, err = d.iscsiCreateVolume(ctx, createReq)
+	}
+	if err != nil {
+		klog.ErrorS(err, "failed to create inline volume", "volumeID", req.GetVolumeId())
+		return nil, err
+	}
+	volume := createResp.GetVolume()
+
+	data, err := json.Marshal(ephemeralState{VolumeID: volume.GetVolumeId()})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = os.WriteFile(d.getEphemeralStatePath(req.GetVolumeId()), data, 0o600); err != nil {
+		klog.ErrorS(err, "failed to persist inline volume state", "volumeID", req.GetVolumeId())
+		return nil, status.Errorf(codes.Internal, "failed to persist inline volume state: %v", err)
+	}
+	return volume, nil
+}
+
+// ephemeralNodeUnpublishVolume unpublishes an inline volume and deletes it, as nothing else will.
+func (d *Driver) ephemeralNodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest, state *ephemeralState) (*csi.NodeUnpublishVolumeResponse, error) {
+	unpublishReq := &csi.NodeUnpublishVolumeRequest{VolumeId: state.VolumeID, TargetPath: req.GetTargetPath()}
+	if !d.volumeLocks.tryAcquire(state.VolumeID) {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", state.VolumeID)
+	}
+	defer d.volumeLocks.release(state.VolumeID)
+
+	// iSCSI volumes are logged out of before their target goes
+	switch volumeProtocol(state.VolumeID) {
+	case TypeNFS:
+		if _, err := d.nfsNodeUnpublishVolume(ctx, unpublishReq); err != nil {
+			return nil, err
+		}
+	case TypeISCSI:
+		if _, err := d.iscsiNodeUnpublishVolume(ctx, unpublishReq); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, status.Errorf(codes.Internal, "inline volume %s was created as unknown volume %s", req.GetVolumeId(), state.VolumeID)
+	}
+
+	if err := d.ephemeralDeleteVolume(ctx, req.GetVolumeId(), state); err != nil {
+		return nil, err
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// ephemeralDeleteVolume deletes the volume behind an inline volume once unpublished, then its persisted state.
+func (d *Driver) ephemeralDeleteVolume(ctx context.Context, id string, state *ephemeralState) error {
+	var err error
+	deleteReq := &csi.DeleteVolumeRequest{VolumeId: state.VolumeID}
+	if volumeProtocol(state.VolumeID) == TypeISCSI {
+		err = d.iscsiDeleteVolume(ctx, deleteReq)
+	} else {
+		err = d.nfsDeleteVolume(ctx, deleteReq)
+	}
+	if err != nil {
+		klog.ErrorS(err, "failed to delete inline volume", "volumeID", state.VolumeID)
+		return status.Errorf(codes.Internal, "failed to delete inline volume %s: %v", state.VolumeID, err)
+	}
+
+	if err = os.Remove(d.getEphemeralStatePath(id)); err != nil && !os.IsNotExist(err) {
+		klog.ErrorS(err, "failed to remove inline volume state", "volumeID", id)
+	}
+	return nil
+}
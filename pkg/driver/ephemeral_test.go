@@ -0,0 +1,199 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newEphemeralTestDriver returns a node with API access serving the types given.
+func newEphemeralTestDriver(t *testing.T, driverTypes ...string) (*Driver, *fakeStorage) {
+	t.Helper()
+
+	d, storage := newTestDriver(t, driverTypes...)
+	d.isController = false
+	d.ephemeralStateDir = t.TempDir()
+	return d, storage
+}
+
+func inlinePublishRequest(id string, attributes map[string]string) *csi.NodePublishVolumeRequest {
+	volumeContext := map[string]string{
+		EphemeralVolumeContextKey:          "true",
+		"csi.storage.k8s.io/pod.name":      "scratch",
+		"csi.storage.k8s.io/pod.uid":       "0a8d5c5e",
+		"csi.storage.k8s.io/pod.namespace": "default",
+	}
+	for key, value := range attributes {
+		volumeContext[key] = value
+	}
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:         id,
+		TargetPath:       "/var/lib/kubelet/pods/0a8d5c5e/volumes/scratch",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    volumeContext,
+	}
+}
+
+func TestEphemeralCreateDeleteVolume(t *testing.T) {
+	tests := []struct {
+		protocol string
+		datasets string
+	}{
+		{protocol: TypeNFS, datasets: "tank/nfs/"},
+		{protocol: TypeISCSI, datasets: "tank/iscsi/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			d, storage := newEphemeralTestDriver(t, TypeNFS, TypeISCSI)
+			req := inlinePublishRequest("csi-1234", map[string]string{ParamProtocol: tt.protocol, EphemeralParamSize: "4Gi"})
+
+			// Kubelet retries publishes which fail after the volume was created
+			first, err := d.ephemeralCreateVolume(context.Background(), req)
+			if err != nil {
+				t.Fatalf("ephemeralCreateVolume failed: %v", err)
+			}
+			second, err := d.ephemeralCreateVolume(context.Background(), req)
+			if err != nil {
+				t.Fatalf("repeated ephemeralCreateVolume failed: %v", err)
+			}
+			if first.GetVolumeId() != second.GetVolumeId() || volumeProtocol(first.GetVolumeId()) != tt.protocol {
+				t.Fatalf("created %s then %s, want the same %s volume", first.GetVolumeId(), second.GetVolumeId(), tt.protocol)
+			}
+			if first.GetCapacityBytes() != 4*giB {
+				t.Errorf("capacity = %d, want %d", first.GetCapacityBytes(), 4*giB)
+			}
+			if _, ok := storage.datasets[tt.datasets+first.GetVolumeId()]; !ok {
+				t.Errorf("dataset %s wasn't created", tt.datasets+first.GetVolumeId())
+			}
+			// Kubelet's attributes aren't StorageClass parameters
+			if _, ok := first.GetVolumeContext()[EphemeralVolumeContextKey]; ok {
+				t.Error("kubelet's volume context was passed on")
+			}
+
+			state, err := d.loadEphemeralState("csi-1234")
+			if err != nil {
+				t.Fatalf("failed to load inline volume state: %v", err)
+			}
+			if state.VolumeID != first.GetVolumeId() {
+				t.Errorf("state has volume %s, want %s", state.VolumeID, first.GetVolumeId())
+			}
+
+			if err = d.ephemeralDeleteVolume(context.Background(), "csi-1234", state); err != nil {
+				t.Fatalf("ephemeralDeleteVolume failed: %v", err)
+			}
+			if _, ok := storage.datasets[tt.datasets+first.GetVolumeId()]; ok {
+				t.Error("dataset wasn't deleted")
+			}
+			if got := iscsiObjectCounts(storage); got != [4]int{} {
+				t.Errorf("got %v iSCSI objects left, want none", got)
+			}
+			if _, err = d.loadEphemeralState("csi-1234"); !os.IsNotExist(err) {
+				t.Errorf("state wasn't removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestEphemeralCreateVolumeInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiAccess  bool
+		attributes map[string]string
+		wantCode   codes.Code
+	}{
+		{name: "no API access", attributes: nil, wantCode: codes.FailedPrecondition},
+		{name: "SMB", apiAccess: true, attributes: map[string]string{ParamProtocol: TypeSMB}, wantCode: codes.InvalidArgument},
+		{name: "not served", apiAccess: true, attributes: map[string]string{ParamProtocol: TypeNVMe}, wantCode: codes.InvalidArgument},
+		{name: "bad size", apiAccess: true, attributes: map[string]string{EphemeralParamSize: "lots"}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, storage := newEphemeralTestDriver(t, TypeNFS, TypeISCSI, TypeSMB)
+			d.apiAccess = tt.apiAccess
+
+			if _, err := d.ephemeralCreateVolume(context.Background(), inlinePublishRequest("csi-1234", tt.attributes)); status.Code(err) != tt.wantCode {
+				t.Errorf("ephemeralCreateVolume returned %v, want %s", err, tt.wantCode)
+			}
+			if storage.calls["createDataset"] != 0 {
+				t.Error("a dataset was created")
+			}
+		})
+	}
+}
+
+func TestEphemeralCreateVolumeRetriesTrueNASLookups(t *testing.T) {
+	d, storage := newEphemeralTestDriver(t, TypeNFS, TypeISCSI)
+	storage.failures["systemVersion"] = errors.New("connection refused")
+
+	req := inlinePublishRequest("csi-1234", map[string]string{ParamProtocol: TypeISCSI})
+	if _, err := d.ephemeralCreateVolume(context.Background(), req); status.Code(err) != codes.Unavailable {
+		t.Fatalf("ephemeralCreateVolume returned %v, want Unavailable", err)
+	}
+
+	// An unknown portal only holds up iSCSI volumes
+	delete(storage.failures, "systemVersion")
+	d.portal = "storage"
+	if _, err := d.ephemeralCreateVolume(context.Background(), req); status.Code(err) != codes.Unavailable {
+		t.Fatalf("ephemeralCreateVolume returned %v, want Unavailable", err)
+	}
+	if _, err := d.ephemeralCreateVolume(context.Background(), inlinePublishRequest("csi-5678", nil)); err != nil {
+		t.Fatalf("NFS ephemeralCreateVolume failed: %v", err)
+	}
+
+	storage.portals[0].Comment = "storage"
+	if _, err := d.ephemeralCreateVolume(context.Background(), req); err != nil {
+		t.Fatalf("ephemeralCreateVolume failed once the portal exists: %v", err)
+	}
+	if got := storage.calls["systemVersion"]; got != 2 {
+		t.Errorf("version was detected %d times, want 2", got)
+	}
+}
+
+// runUntilReady runs the driver, stopping it once it's serving, and returns what Run returned.
+func runUntilReady(t *testing.T, d *Driver) error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.endpoint = "unix://" + filepath.Join(t.TempDir(), "csi.sock")
+
+	result := make(chan error, 1)
+	go func() {
+		result <- d.Run(ctx)
+	}()
+	for {
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(10 * time.Millisecond):
+		}
+		d.readyMu.Lock()
+		ready := d.ready
+		d.readyMu.Unlock()
+		if ready {
+			cancel()
+			return <-result
+		}
+	}
+}
+
+func TestRunWithoutTrueNAS(t *testing.T) {
+	node, storage := newEphemeralTestDriver(t, TypeNFS)
+	storage.failures["systemVersion"] = errors.New("connection refused")
+	if err := runUntilReady(t, node); err != nil {
+		t.Errorf("node failed to start: %v", err)
+	}
+
+	controller, storage := newTestDriver(t, TypeNFS)
+	storage.failures["systemVersion"] = errors.New("connection refused")
+	if err := runUntilReady(t, controller); err == nil {
+		t.Error("controller started without TrueNAS")
+	}
+}
@@ -3,6 +3,7 @@ package driver
 import (
 	"context"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 
@@ -23,6 +24,8 @@ const (
 	ISCSIVolumeContextIQN          = "iqn"
 	ISCSIVolumeContextLUN          = "lun"
 	ISCSIVolumeContextPortals      = "portals"
+	ISCSIVolumeContextSerial       = "serial"
+	ISCSIVolumeContextNAA          = "naa"
 )
 
 var ISCSIVolumeCapabilites = []csi.VolumeCapability_AccessMode_Mode{
@@ -30,6 +33,7 @@ var ISCSIVolumeCapabilites = []csi.VolumeCapability_AccessMode_Mode{
 	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
 	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
 	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
 }
 
 func iscsiHasCapability(capability csi.VolumeCapability_AccessMode_Mode) bool {
@@ -52,6 +56,11 @@ func iscsiCheckCaps(caps []*csi.VolumeCapability) error {
 		accessType := currentCap.GetAccessType()
 		switch accessType.(type) {
 		case *csi.VolumeCapability_Mount:
+			if fsType := currentCap.GetMount().GetFsType(); fsType != "" {
+				if _, err := iscsiResolveFsType(fsType, nil); err != nil {
+					violations.Insert(err.Error())
+				}
+			}
 		default:
 			violations.Insert(fmt.Sprintf("unsupported access type %v", accessType))
 		}
@@ -62,36 +71,72 @@ func iscsiCheckCaps(caps []*csi.VolumeCapability) error {
 	return nil
 }
 
+// iscsiCheckMultiNode refuses MULTI_NODE_READER_ONLY when volumes aren't attached, as read-write publishes can only be
+// refused while the volume is attached elsewhere.
+func (d *Driver) iscsiCheckMultiNode(caps []*csi.VolumeCapability) error {
+	if d.iscsiAttaches() {
+		return nil
+	}
+	for _, currentCap := range caps {
+		if currentCap.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY {
+			return status.Errorf(codes.InvalidArgument, "volume capabilities cannot be satisified: %s needs iSCSI to be the only type served", csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)
+		}
+	}
+	return nil
+}
+
 func (d *Driver) iscsiCreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	// Validate iSCSI capabilities
 	if err := iscsiCheckCaps(req.GetVolumeCapabilities()); err != nil {
 		klog.ErrorS(err, "invalid volume capabilities")
 		return nil, err
 	}
+	if err := d.iscsiCheckMultiNode(req.GetVolumeCapabilities()); err != nil {
+		klog.ErrorS(err, "invalid volume capabilities")
+		return nil, err
+	}
+
+	// Validate filesystem options up front, the node formats the volume with them on first use
+	capFsType := ""
+	for _, currentCap := range req.GetVolumeCapabilities() {
+		if fsType := currentCap.GetMount().GetFsType(); fsType != "" {
+			capFsType = fsType
+			break
+		}
+	}
+	fsType, err := iscsiResolveFsType(capFsType, req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err = iscsiMkfsArgs(fsType, req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	fsContext := map[string]string{ISCSIParamDefaultFsType: fsType}
+	for _, key := range iscsiMkfsParams {
+		if value, ok := req.GetParameters()[key]; ok {
+			fsContext[key] = value
+		}
+	}
 
 	// Get iSCSI IQN prefix
-	globalConfigResponse, _, err := d.client.IscsiGlobalAPI.GetISCSIGlobalConfiguration(ctx).Execute()
+	globalConfigResponse, err := d.storage.iscsiGlobalConfig(ctx)
 	if err != nil {
 		klog.ErrorS(err, "failed to get global iSCSI config")
 		return nil, status.Errorf(codes.Internal, "failed to get global iSCSI config: %v", err)
 	}
 	iqnBase := globalConfigResponse.Basename
 
-	// Get portal get portal ip and port
-	portalResponse, _, err := d.client.IscsiPortalAPI.GetISCSIPortal(ctx, d.portalID).Execute()
-	if err != nil {
-		klog.ErrorS(err, "failed to get portal", "portalID", d.portalID)
-		return nil, status.Errorf(codes.Internal, "failed to get portal info: %v", err)
+	// Get portal from the StorageClass, falling back to the one given by --portal
+	portalSelector := d.portal
+	if selector := req.GetParameters()[ISCSIParamPortal]; selector != "" {
+		portalSelector = selector
 	}
-	if len(portalResponse.Listen) == 0 {
-		klog.ErrorS(err, "portal has no listen addresses", "portalID", d.portalID)
-		return nil, status.Errorf(codes.Internal, "failed to get active iSCSI portal: %v", err)
-	}
-	if len(portalResponse.Listen) > 1 {
-		klog.InfoS("portal has more than 1 listening address, using first one", "portalID", d.portalID)
+	portal, err := d.iscsiResolvePortal(ctx, portalSelector)
+	if err != nil {
+		klog.ErrorS(err, "failed to resolve portal", "portal", portalSelector)
+		return nil, err
 	}
-	portalListenItem := portalResponse.Listen[0]
-	portalAddr := fmt.Sprintf("%s:%d", portalListenItem.GetIp(), portalListenItem.GetPort())
+	portalAddr := portal.addr
 
 	volumeID := ISCSIVolumePrefix + req.GetName()
 
@@ -107,245 +152,44 @@ func (d *Driver) iscsiCreateVolume(ctx context.Context, req *csi.CreateVolumeReq
 	sizeGB := size / (1 * giB)
 	klog.V(5).InfoS("[Debug] raw size requested in gibibytes", "size", sizeGB)
 
-	datasetName := strings.Join([]string{d.iscsiStoragePath, volumeID}, "/")
-
-	datasetID := ""
-	extentID := int32(-1)
-	initatorID := int32(-1)
-	targetID := int32(-1)
-	// targetExtentID := int32(-1)
-
-	// Create dataset
-	existingDataset, datasetExists, err := FindDataset(ctx, d.client, func(dataset tnclient.Dataset) bool {
-		return dataset.GetName() == datasetName && dataset.GetType() == "VOLUME"
-	})
-	if err != nil {
-		klog.ErrorS(err, "failed to look for existing datasets")
-		return nil, status.Errorf(codes.Internal, "failed to look for existing datasets: %v", err)
-	}
-
-	if datasetExists {
-		datasetID = existingDataset.Id
-		klog.V(5).Info("[Debug] Dataset exists, skipping")
-	} else {
-		// Create dataset as a Volume
-		klog.V(5).Info("[Debug] Dataset does not exist, creating")
-
-		datasetRequest := d.client.DatasetAPI.CreateDataset(ctx).CreateDatasetParams(tnclient.CreateDatasetParams{
-			Name:         datasetName,
-			Type:         tnclient.PtrString("VOLUME"),
-			Volblocksize: tnclient.PtrString("16K"),
-			Volsize:      tnclient.PtrInt64(size),
-		})
-		datasetResponse, _, err2 := datasetRequest.Execute()
-		if err2 != nil {
-			klog.ErrorS(err2, "failed to create dataset", "datasetName", datasetName)
-			return nil, err2
-		}
-		datasetID = datasetResponse.Id
-	}
-
-	// Cleanup functions
-	removeDatasetFunc := func() {
-		klog.V(5).Info("[Debug] Cleaning up dataset")
-		_, err = d.client.DatasetAPI.DeleteDataset(ctx, datasetID).Execute()
-		if err != nil {
-			klog.ErrorS(err, "failed to clean up dataset", "datasetName", datasetName)
-		}
-	}
-	cleanupFunc := func() {
-		removeDatasetFunc()
-	}
-
-	// Create iSCSI extent
-	extentPath := "zvol/" + datasetName
-	existingExtent, extentExists, err := FindISCSIExtent(ctx, d.client, func(extent tnclient.ISCSIExtent) bool {
-		return extent.GetPath() == extentPath
-	})
-	if err != nil {
-		cleanupFunc()
-		klog.ErrorS(err, "failed to look for existing iSCSI extents")
-		return nil, status.Errorf(codes.Internal, "failed to look for existing iSCSI extents: %v", err)
-	}
-
-	if extentExists {
-		klog.V(5).Info("[Debug] iSCSI extent exists, skipping")
-		extentID = existingExtent.Id
-	} else {
-		klog.V(5).Info("[Debug] iSCSI extent does not exist, creating")
-
-		extentRequest := d.client.IscsiExtentAPI.CreateISCSIExtent(ctx).CreateISCSIExtentParams(tnclient.CreateISCSIExtentParams{
-			Name:        volumeID,
-			Rpm:         tnclient.PtrString("SSD"),
-			Type:        "DISK",
-			InsecureTpc: tnclient.PtrBool(true),
-			Xen:         tnclient.PtrBool(false),
-			Comment:     tnclient.PtrString(volumeID + ": Kubernetes managed iSCSI extent"),
-			Blocksize:   tnclient.PtrInt32(512),
-			Disk:        *tnclient.NewNullableString(tnclient.PtrString(extentPath)),
-		})
-		extentResponse, _, err2 := extentRequest.Execute()
-		if err2 != nil {
-			cleanupFunc()
-			klog.ErrorS(err2, "failed to create iSCSI extent", "extentName", volumeID)
-			return nil, err2
-		}
-		extentID = extentResponse.Id
-	}
-
-	removeExtentFunc := func() {
-		klog.V(5).Info("[Debug] Cleaning up iSCSI Extent")
-		_, err = d.client.IscsiExtentAPI.DeleteISCSIExtent(ctx, extentID).DeleteISCSIExtentParams(tnclient.DeleteISCSIExtentParams{
-			Remove: true,
-			Force:  true,
-		}).Execute()
-		if err != nil {
-			klog.ErrorS(err, "failed to cleanup iSCSI Extent", "iSCSIExtentID", extentID)
-		}
-	}
-	cleanupFunc = func() {
-		removeDatasetFunc()
-		removeExtentFunc()
-	}
-
-	// Create iSCSI initiator
-	existingInitiator, initiatorExists, err := FindISCSIInitiator(ctx, d.client, func(initiator tnclient.ISCSIInitiator) bool {
-		return strings.HasPrefix(initiator.GetComment(), volumeID)
-	})
-	if err != nil {
-		cleanupFunc()
-		klog.ErrorS(err, "failed to look for existing iSCSI initiators")
-		return nil, status.Errorf(codes.Internal, "failed to look for existing iSCSI initiators: %v", err)
-	}
-
-	if initiatorExists {
-		klog.V(5).Info("[Debug] iSCSI initiator exists, skipping")
-		initatorID = existingInitiator.Id
-	} else {
-		klog.V(5).Info("[Debug] iSCSI initiator does not exist, creating")
-
-		initiatorRequest := d.client.IscsiInitiatorAPI.CreateISCSIInitiator(ctx).CreateISCSIInitiatorParams(tnclient.CreateISCSIInitiatorParams{
-			Comment: tnclient.PtrString(volumeID + ": Kubernetes managed iSCSI initiator"),
-		})
-		initiatorResponse, _, err2 := initiatorRequest.Execute()
-		if err2 != nil {
-			cleanupFunc()
-			klog.ErrorS(err, "failed to create iSCSI initiator", "initiatorName", volumeID)
-			return nil, err2
-		}
-		initatorID = initiatorResponse.Id
-	}
-
-	removeInitiatorFunc := func() {
-		klog.V(5).Info("[Debug] Cleaning up iSCSI Initiator")
-		_, err = d.client.IscsiInitiatorAPI.DeleteISCSIInitiator(ctx, initatorID).Execute()
-		if err != nil {
-			klog.ErrorS(err, "failed to cleanup iSCSI Initiator", "iSCSIInitiatorID", initatorID)
-		}
-	}
-	cleanupFunc = func() {
-		removeDatasetFunc()
-		removeExtentFunc()
-		removeInitiatorFunc()
-	}
-
-	// Create iSCSI target
-	existingTarget, targetExists, err := FindISCSITarget(ctx, d.client, func(target tnclient.ISCSITarget) bool {
-		return target.GetName() == volumeID
-	})
-	if err != nil {
-		cleanupFunc()
-		klog.ErrorS(err, "failed to look for existing iSCSI targets")
-		return nil, status.Errorf(codes.Internal, "failed to look for existing iSCSI targets: %v", err)
-	}
-
-	if targetExists {
-		klog.V(5).Info("[Debug] iSCSI target exists, skipping")
-		targetID = existingTarget.Id
-	} else {
-		klog.V(5).Info("[Debug] iSCSI target does not exist, creating")
-
-		targetRequest := d.client.IscsiTargetAPI.CreateISCSITarget(ctx).CreateISCSITargetParams(tnclient.CreateISCSITargetParams{
-			Name:  volumeID,
-			Alias: *tnclient.NewNullableString(tnclient.PtrString(volumeID + ": Kubernetes managed iSCSI initiator")),
-			Mode:  tnclient.PtrString("ISCSI"),
-			Groups: []tnclient.CreateISCSITargetParamsGroupsInner{
-				{
-					Portal:     d.portalID,
-					Initiator:  tnclient.PtrInt32(initatorID),
-					Authmethod: "NONE",
-				},
-			},
-		})
-		targetResponse, _, err2 := targetRequest.Execute()
-		if err2 != nil {
-			cleanupFunc()
-			klog.ErrorS(err2, "failed to create iSCSI target", "targetName", volumeID)
-			return nil, err2
+	volume := d.newISCSIVolumeResource(volumeID)
+	volume.size = size
+	volume.capacityRange = req.GetCapacityRange()
+	volume.portalID = portal.id
+	if err = volume.Ensure(ctx); err != nil {
+		if status.Code(err) == codes.AlreadyExists {
+			return nil, err
 		}
-		targetID = targetResponse.Id
+		// The portal may have been changed or deleted on TrueNAS
+		d.iscsiInvalidatePortals()
+		return nil, status.Errorf(codes.Internal, "failed to create iSCSI volume: %v", err)
 	}
 
-	removeTargetFunc := func() {
-		klog.V(5).Info("[Debug] Cleaning up iSCSI Target")
-		_, err = d.client.IscsiTargetAPI.DeleteISCSITarget(ctx, targetID).Body(true).Execute()
-		if err != nil {
-			klog.ErrorS(err, "failed to cleanup iSCSI Target", "iSCSITargetID", targetID)
-		}
-	}
-	cleanupFunc = func() {
-		removeDatasetFunc()
-		removeExtentFunc()
-		removeInitiatorFunc()
-		removeTargetFunc()
-	}
+	iqn := fmt.Sprintf("%s:%s", iqnBase, volume.targetName) // iqnBase:targetName
+	return iscsiCreateVolumeResponse(volumeID, volume.size, portalAddr, iqn, volume.lun, volume.extentSerial, volume.extentNAA, fsContext), nil
+}
 
-	// Create iSCSI target extent mapping
-	_, targetExtentExists, err := FindISCSITargetExtent(ctx, d.client, func(targetExtent tnclient.ISCSITargetExtent) bool {
-		return targetExtent.Target == targetID && targetExtent.Extent == extentID
-	})
-	if err != nil {
-		cleanupFunc()
-		klog.ErrorS(err, "failed to look for existing iSCSI target extents")
-		return nil, status.Errorf(codes.Internal, "failed to look for existing iSCSI target extents: %v", err)
+func iscsiCreateVolumeResponse(volumeID string, size int64, portalAddr, iqn string, lun int32, serial, naa string, fsContext map[string]string) *csi.CreateVolumeResponse {
+	volumeContext := map[string]string{
+		ISCSIVolumeContextTargetPortal: portalAddr,
+		ISCSIVolumeContextIQN:          iqn, // iqn.2005-10.org.freenas.ctl:prometheus
+		ISCSIVolumeContextLUN:          strconv.Itoa(int(lun)),
+		ISCSIVolumeContextPortals:      "[]",
+		ISCSIVolumeContextSerial:       serial, // Checked against the device on the node before it's used
+		ISCSIVolumeContextNAA:          naa,    // The node mounts the device by it, /dev/disk/by-id/wwn-<naa>
 	}
-
-	if targetExtentExists {
-		klog.V(5).Info("[Debug] iSCSI target extent exists, skipping")
-		// targetExtentID = existingTargetExtent.Id
-	} else {
-		klog.V(5).Info("[Debug] iSCSI target extent does not exist, creating")
-
-		targetExtentRequest := d.client.IscsiTargetextentAPI.CreateISCSITargetExtent(ctx).CreateISCSITargetExtentParams(tnclient.CreateISCSITargetExtentParams{
-			Target: targetID,
-			Extent: extentID,
-		})
-		_, _, err2 := targetExtentRequest.Execute()
-		if err2 != nil {
-			cleanupFunc()
-			klog.ErrorS(err, "failed to create iSCSI target extent", "extentID", extentID)
-			return nil, err2
-		}
-		// targetExtentID = targetExtentResponse.Id
+	// Filesystem and mkfs options, applied by the node when it formats the volume
+	for k, v := range fsContext {
+		volumeContext[k] = v
 	}
 
-	// Should be done by now
-	iqn := fmt.Sprintf("%s:%s", iqnBase, volumeID) // iqnBase:targetName
-
-	resp := &csi.CreateVolumeResponse{
+	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeID,
 			CapacityBytes: size,
-			VolumeContext: map[string]string{
-				ISCSIVolumeContextTargetPortal: portalAddr,
-				ISCSIVolumeContextIQN:          iqn, // iqn.2005-10.org.freenas.ctl:prometheus
-				ISCSIVolumeContextLUN:          "0", // We always set it to 0 in the target extent mapping
-				ISCSIVolumeContextPortals:      "[]",
-			},
+			VolumeContext: volumeContext,
 		},
 	}
-
-	return resp, nil
 }
 
 func (d *Driver) iscsiDeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) error {
@@ -354,59 +198,12 @@ func (d *Driver) iscsiDeleteVolume(ctx context.Context, req *csi.DeleteVolumeReq
 		return status.Errorf(codes.NotFound, "Volume ID %s not found", volumeID)
 	}
 
-	// Force delete the target first, else delete dataset will spam "device busy"
-	existingTarget, targetExists, err := FindISCSITarget(ctx, d.client, func(target tnclient.ISCSITarget) bool {
-		return target.GetName() == volumeID
-	})
-	if err != nil {
-		klog.ErrorS(err, "failed to look for existing iSCSI targets")
-		return err
-	}
-	if targetExists {
-		_, err = d.client.IscsiTargetAPI.DeleteISCSITarget(ctx, existingTarget.GetId()).Body(true).Execute()
-		if err != nil {
-			klog.ErrorS(err, "failed to delete iSCSI Target", "iscsi_target_id", existingTarget.GetId())
-			return err
-		}
-	}
-
-	// Deleting the dataset will remove ?
-	datasetName := strings.Join([]string{d.iscsiStoragePath, volumeID}, "/")
-
-	existingDataset, datasetExists, err := FindDataset(ctx, d.client, func(dataset tnclient.Dataset) bool {
-		return dataset.GetName() == datasetName
-	})
-	if err != nil {
-		klog.ErrorS(err, "failed to look for existing datasets")
-		return err
-	}
-
-	if datasetExists {
-		_, err = d.client.DatasetAPI.DeleteDataset(ctx, existingDataset.GetId()).Execute()
-		if err != nil {
-			klog.ErrorS(err, "failed to delete Dataset", "dataset_id", existingDataset.GetId())
-			return err
-		}
-	}
-
-	// Deleting the dataset leaves only the initiator
-	existingInitiator, initiatorExists, err := FindISCSIInitiator(ctx, d.client, func(initiator tnclient.ISCSIInitiator) bool {
-		return strings.HasPrefix(initiator.GetComment(), volumeID)
-	})
-	if err != nil {
-		klog.ErrorS(err, "failed to look for existing iSCSI initiators")
+	// Mappings and the target go first, else deleting the dataset fails as the zvol is busy
+	if err := d.newISCSIVolumeResource(volumeID).Teardown(ctx); err != nil {
+		klog.ErrorS(err, "failed to delete iSCSI volume", "volumeID", volumeID)
 		return err
 	}
 
-	if initiatorExists {
-		klog.V(5).InfoS("[Debug] cleaning up iSCSI Initiator", "iSCSIInitiatorID", existingInitiator.Id)
-		_, err = d.client.IscsiInitiatorAPI.DeleteISCSIInitiator(ctx, existingInitiator.Id).Execute()
-		if err != nil {
-			klog.ErrorS(err, "failed to cleanup iSCSI Initiator", "iSCSIInitiatorID", existingInitiator.Id)
-			return err
-		}
-	}
-
 	return nil
 }
 
@@ -420,6 +217,10 @@ func (d *Driver) iscsiValidateVolumeCapabilities(ctx context.Context, req *csi.V
 		klog.ErrorS(err, "invalid volume capabilities")
 		return nil, err
 	}
+	if err := d.iscsiCheckMultiNode(req.GetVolumeCapabilities()); err != nil {
+		klog.ErrorS(err, "invalid volume capabilities")
+		return nil, err
+	}
 
 	datasetName := strings.Join([]string{d.iscsiStoragePath, volumeID}, "/")
 
@@ -442,9 +243,9 @@ func (d *Driver) iscsiValidateVolumeCapabilities(ctx context.Context, req *csi.V
 	}
 
 	// Look for existing dataset
-	_, datasetExists, err := FindDataset(ctx, d.client, func(dataset tnclient.Dataset) bool {
+	_, datasetExists, err := FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
 		return dataset.GetName() == datasetName
-	})
+	}, FilterEqual("name", datasetName))
 	if err != nil {
 		klog.ErrorS(err, "failed to look for existing datasets")
 		return nil, status.Errorf(codes.Internal, "failed to look for existing datasets: %v", err)
@@ -456,6 +257,9 @@ func (d *Driver) iscsiValidateVolumeCapabilities(ctx context.Context, req *csi.V
 
 	caps := make([]*csi.VolumeCapability, 0)
 	for _, currentCap := range ISCSIVolumeCapabilites {
+		if currentCap == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY && !d.iscsiAttaches() {
+			continue
+		}
 		caps = append(caps, &csi.VolumeCapability{
 			AccessMode: &csi.VolumeCapability_AccessMode{Mode: currentCap},
 		})
@@ -471,7 +275,7 @@ func (d *Driver) iscsiValidateVolumeCapabilities(ctx context.Context, req *csi.V
 
 func (d *Driver) iscsiGetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) { //nolint:unparam
 	// TODO(iscsi) refactor this out as is pretty much same as in nfsGetCapacity
-	resp, _, err := d.client.DatasetAPI.GetDataset(ctx, d.iscsiStoragePath).Execute()
+	resp, err := d.storage.getDataset(ctx, d.iscsiStoragePath)
 	if err != nil {
 		klog.ErrorS(err, "failed to get dataset", "datasetID", d.iscsiStoragePath)
 		return nil, status.Errorf(codes.Internal, "Failed to get iSCSI dataset: %s", err.Error())
@@ -494,9 +298,9 @@ func (d *Driver) iscsiListVolumes(ctx context.Context) ([]*csi.ListVolumesRespon
 	// So, we want all the volumes -> extents -> extent target mappings -> targets
 
 	iscsiStoragePrefix := d.iscsiStoragePath + "/"
-	datasets, err := FindAllDatasets(ctx, d.client, func(dataset tnclient.Dataset) bool {
+	datasets, err := FindAllDatasets(ctx, d.storage, func(dataset tnclient.Dataset) bool {
 		return dataset.GetType() == "VOLUME" && strings.HasPrefix(dataset.GetName(), iscsiStoragePrefix)
-	})
+	}, FilterPrefix("name", iscsiStoragePrefix))
 	if err != nil {
 		klog.ErrorS(err, "failed to get list of datasets")
 		return nil, err
@@ -509,7 +313,7 @@ func (d *Driver) iscsiListVolumes(ctx context.Context) ([]*csi.ListVolumesRespon
 		datasetMap[zvolPath] = &ds
 	}
 
-	extents, err := FindAllISCSIExtents(ctx, d.client, func(extent tnclient.ISCSIExtent) bool {
+	extents, err := FindAllISCSIExtents(ctx, d.storage, func(extent tnclient.ISCSIExtent) bool {
 		_, exists := datasetMap[extent.GetPath()]
 		return exists
 	})
@@ -524,7 +328,7 @@ func (d *Driver) iscsiListVolumes(ctx context.Context) ([]*csi.ListVolumesRespon
 	}
 
 	// Get extent target mapping
-	extentMappings, err := FindAllISCSITargetExtents(ctx, d.client, func(targetExtent tnclient.ISCSITargetExtent) bool {
+	extentMappings, err := FindAllISCSITargetExtents(ctx, d.storage, func(targetExtent tnclient.ISCSITargetExtent) bool {
 		_, exists := extentMap[targetExtent.Extent]
 		return exists
 	})
@@ -533,25 +337,33 @@ func (d *Driver) iscsiListVolumes(ctx context.Context) ([]*csi.ListVolumesRespon
 		return nil, err
 	}
 
-	extentTargetMap := make(map[int32]*tnclient.Dataset)
+	targetIDs := make(map[int32]bool)
 	for _, mapping := range extentMappings {
-		extentTargetMap[mapping.GetTarget()] = extentMap[mapping.GetExtent()]
+		targetIDs[mapping.GetTarget()] = true
 	}
 
-	targets, err := FindAllISCSITargets(ctx, d.client, func(target tnclient.ISCSITarget) bool {
-		_, exists := extentTargetMap[target.GetId()]
-		return exists
+	targets, err := FindAllISCSITargets(ctx, d.storage, func(target tnclient.ISCSITarget) bool {
+		return targetIDs[target.GetId()]
 	})
 	if err != nil {
 		klog.ErrorS(err, "failed to get list of iSCSI targets")
 		return nil, err
 	}
 
+	existingTargets := make(map[int32]bool)
+	for _, target := range targets {
+		existingTargets[target.GetId()] = true
+	}
+
 	result := make([]*csi.ListVolumesResponse_Entry, 0)
 
-	for _, target := range targets {
-		volumeID := target.GetName()
-		dataset := extentTargetMap[target.GetId()]
+	// Shared targets hold many extents, so walk the mappings rather than the targets
+	for _, mapping := range extentMappings {
+		if !existingTargets[mapping.GetTarget()] {
+			continue
+		}
+		dataset := extentMap[mapping.GetExtent()]
+		volumeID := strings.TrimPrefix(dataset.GetName(), iscsiStoragePrefix)
 
 		volsizeComp := dataset.GetVolsize()
 		quota, err := strconv.ParseInt(volsizeComp.GetRawvalue(), 10, 64)
@@ -599,7 +411,10 @@ func (d *Driver) iscsiNodePublishVolume(ctx context.Context, req *csi.NodePublis
 
 	libConfigPath := d.getISCSILibConfigPath(req.GetVolumeId())
 	klog.V(5).InfoS("[Debug] generated lib config path", "configPath", libConfigPath)
-	diskMounter := getISCSIDiskMounter(iscsiInfo, req)
+	diskMounter, err := getISCSIDiskMounter(iscsiInfo, req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	util := &ISCSIUtil{}
 	klog.V(5).Info("[Debug] Attaching disk")
@@ -608,6 +423,19 @@ func (d *Driver) iscsiNodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	// Not fatal, only needed to remount the volume if the plugin restarts
+	if err = d.persistISCSIPublishState(req.GetVolumeId(), iscsiPublishState{
+		TargetPath:   diskMounter.targetPath,
+		FsType:       diskMounter.fsType,
+		ReadOnly:     diskMounter.readOnly,
+		MountOptions: diskMounter.mountOptions,
+		Serial:       diskMounter.serial,
+		NAA:          diskMounter.naa,
+		MkfsArgs:     diskMounter.mkfsArgs,
+	}); err != nil {
+		klog.ErrorS(err, "failed to persist iSCSI publish state", "volumeID", req.GetVolumeId())
+	}
+
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -617,6 +445,9 @@ func (d *Driver) iscsiNodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	libConfigPath := d.getISCSILibConfigPath(req.GetVolumeId())
 	klog.V(5).InfoS("[Debug] generated lib config path", "configPath", libConfigPath)
 	diskUnmounter := getISCSIDiskUnmounter(req)
+	diskUnmounter.targetInUse = func(targetIqn string) (bool, error) {
+		return d.iscsiTargetInUse(req.GetVolumeId(), targetIqn)
+	}
 
 	iscsiutil := &ISCSIUtil{}
 	klog.V(5).Info("[Debug] Detaching disk")
@@ -625,5 +456,9 @@ func (d *Driver) iscsiNodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	if err := os.Remove(d.getISCSIPublishStatePath(req.GetVolumeId())); err != nil && !os.IsNotExist(err) {
+		klog.ErrorS(err, "failed to remove iSCSI publish state", "volumeID", req.GetVolumeId())
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -0,0 +1,140 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+
+	"k8s.io/klog/v2"
+	"k8s.io/utils/mount"
+)
+
+// StorageClass parameters controlling the filesystem created on iSCSI volumes, passed on to the node in the volume
+// context under the same keys.
+const (
+	ISCSIParamDefaultFsType         = "defaultFsType"
+	ISCSIParamMkfsInodeRatio        = "mkfsInodeRatio"
+	ISCSIParamMkfsReservedBlocksPct = "mkfsReservedBlocksPercent"
+	ISCSIParamMkfsBlockSize         = "mkfsBlockSize"
+	ISCSIParamMkfsXFSReflink        = "mkfsXfsReflink"
+
+	defaultISCSIFsType = "ext4"
+)
+
+var (
+	iscsiSupportedFsTypes = []string{"ext3", "ext4", "xfs"}
+	iscsiMkfsParams       = []string{ISCSIParamMkfsInodeRatio, ISCSIParamMkfsReservedBlocksPct, ISCSIParamMkfsBlockSize, ISCSIParamMkfsXFSReflink}
+)
+
+func isExtFs(fsType string) bool {
+	return fsType == "ext3" || fsType == "ext4"
+}
+
+// iscsiResolveFsType picks the filesystem from the volume capability, then the volume's default, then ours.
+func iscsiResolveFsType(capFsType string, params map[string]string) (string, error) {
+	fsType := capFsType
+	if fsType == "" {
+		fsType = params[ISCSIParamDefaultFsType]
+	}
+	if fsType == "" {
+		fsType = defaultISCSIFsType
+	}
+
+	for _, supported := range iscsiSupportedFsTypes {
+		if fsType == supported {
+			return fsType, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported filesystem %q, must be one of %v", fsType, iscsiSupportedFsTypes)
+}
+
+// iscsiMkfsArgs validates the mkfs parameters against the filesystem and returns the arguments to pass to mkfs, the
+// device is appended by the caller.
+func iscsiMkfsArgs(fsType string, params map[string]string) ([]string, error) {
+	var args []string
+
+	if isExtFs(fsType) {
+		// Same as mount-utils, nothing reserved for root unless asked for
+		reserved := "0"
+		if value, ok := params[ISCSIParamMkfsReservedBlocksPct]; ok {
+			pct, err := strconv.Atoi(value)
+			if err != nil || pct < 0 || pct > 50 {
+				return nil, fmt.Errorf("%s must be a percentage between 0 and 50: %q", ISCSIParamMkfsReservedBlocksPct, value)
+			}
+			reserved = value
+		}
+		args = append(args, "-F", "-m", reserved)
+
+		if value, ok := params[ISCSIParamMkfsInodeRatio]; ok {
+			ratio, err := strconv.Atoi(value)
+			if err != nil || ratio < 1024 || ratio > 67108864 {
+				return nil, fmt.Errorf("%s must be a number of bytes between 1024 and 67108864: %q", ISCSIParamMkfsInodeRatio, value)
+			}
+			args = append(args, "-i", value)
+		}
+		if value, ok := params[ISCSIParamMkfsBlockSize]; ok {
+			if value != "1024" && value != "2048" && value != "4096" {
+				return nil, fmt.Errorf("%s must be 1024, 2048 or 4096 for %s: %q", ISCSIParamMkfsBlockSize, fsType, value)
+			}
+			args = append(args, "-b", value)
+		}
+		if _, ok := params[ISCSIParamMkfsXFSReflink]; ok {
+			return nil, fmt.Errorf("%s is only supported on xfs", ISCSIParamMkfsXFSReflink)
+		}
+
+		return args, nil
+	}
+
+	// xfs
+	args = append(args, "-f")
+	if _, ok := params[ISCSIParamMkfsInodeRatio]; ok {
+		return nil, fmt.Errorf("%s is not supported on xfs", ISCSIParamMkfsInodeRatio)
+	}
+	if _, ok := params[ISCSIParamMkfsReservedBlocksPct]; ok {
+		return nil, fmt.Errorf("%s is not supported on xfs", ISCSIParamMkfsReservedBlocksPct)
+	}
+	if value, ok := params[ISCSIParamMkfsBlockSize]; ok {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 512 || size > 65536 || size&(size-1) != 0 {
+			return nil, fmt.Errorf("%s must be a power of 2 between 512 and 65536 for xfs: %q", ISCSIParamMkfsBlockSize, value)
+		}
+		args = append(args, "-b", "size="+value)
+	}
+	if value, ok := params[ISCSIParamMkfsXFSReflink]; ok {
+		reflink, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false: %q", ISCSIParamMkfsXFSReflink, value)
+		}
+		if reflink {
+			args = append(args, "-m", "reflink=1")
+		} else {
+			args = append(args, "-m", "reflink=0")
+		}
+	}
+
+	return args, nil
+}
+
+// formatDisk runs mkfs with our own arguments if the disk has no filesystem yet. mount-utils always puts its own
+// defaults after any format options, so this is done before handing over to FormatAndMount which will then just mount.
+func formatDisk(mounter *mount.SafeFormatAndMount, devicePath, fsType string, mkfsArgs []string) error {
+	if len(mkfsArgs) == 0 {
+		// Volumes published before mkfs options existed, mount-utils formats them as it always did
+		return nil
+	}
+
+	existingFormat, err := mounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to get disk format of %s: %w", devicePath, err)
+	}
+	if existingFormat != "" {
+		return nil
+	}
+
+	args := append(append([]string{}, mkfsArgs...), devicePath)
+	klog.InfoS("formatting iSCSI disk", "devicePath", devicePath, "fsType", fsType, "args", args)
+	output, err := mounter.Exec.Command("mkfs."+fsType, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("format of disk %s as %s failed: %w, output: %s", devicePath, fsType, err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// iscsiExtentSerialLength matches the length of the serials TrueNAS generates itself.
+const iscsiExtentSerialLength = 15
+
+// iscsiExtentSerial derives the extent serial from the volume ID so the node can tell which LUN it's looking at.
+func iscsiExtentSerial(volumeID string) string {
+	sum := sha256.Sum256([]byte(volumeID))
+	return hex.EncodeToString(sum[:])[:iscsiExtentSerialLength]
+}
+
+// verifyDeviceSerial checks the SCSI unit serial number (VPD page 0x80) of a device, or every path of a multipath
+// device, matches the serial of the extent we expect to be connected to.
+func verifyDeviceSerial(devicePath, serial string) error {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve device path %s: %w", devicePath, err)
+	}
+	name := filepath.Base(realPath)
+
+	devices := []string{name}
+	if slaves, _ := filepath.Glob(filepath.Join("/sys/block", name, "slaves", "*")); len(slaves) > 0 {
+		devices = devices[:0]
+		for _, slave := range slaves {
+			devices = append(devices, filepath.Base(slave))
+		}
+	}
+
+	for _, device := range devices {
+		deviceSerial, err := readDeviceSerial(device)
+		if err != nil {
+			return err
+		}
+		if deviceSerial != serial {
+			return fmt.Errorf("device %s has serial %q but volume expects %q, refusing to use it", device, deviceSerial, serial)
+		}
+	}
+	return nil
+}
+
+func readDeviceSerial(device string) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/sys/block", device, "device", "vpd_pg80"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read serial of device %s: %w", device, err)
+	}
+
+	// Byte 1 is the page code, bytes 2-3 the length of the serial which starts at byte 4
+	if len(data) < 4 || data[1] != 0x80 {
+		return "", fmt.Errorf("device %s has an invalid unit serial number page", device)
+	}
+	length := int(data[2])<<8 | int(data[3])
+	if len(data) < 4+length {
+		return "", fmt.Errorf("device %s has a truncated unit serial number page", device)
+	}
+	return strings.TrimSpace(string(data[4 : 4+length])), nil
+}
+
+const (
+	// iscsiNAAPrefix is the IEEE registered extended NAA prefix TrueNAS gives its extents.
+	iscsiNAAPrefix = "0x6589cfc000000"
+	// iscsiNAALength is the length of an NAA including its 0x, 16 bytes as hex.
+	iscsiNAALength = 34
+)
+
+// iscsiExtentNAA derives the extent NAA from the volume ID in the format TrueNAS generates them, so the device is the
+// same on every node and after the extent is recreated.
+func iscsiExtentNAA(volumeID string) string {
+	sum := sha256.Sum256([]byte(volumeID))
+	return iscsiNAAPrefix + hex.EncodeToString(sum[:])[:iscsiNAALength-len(iscsiNAAPrefix)]
+}
+
+// iscsiDeviceByNAA returns the /dev/disk/by-id path of the LUN with the NAA, making sure it's the device csi-lib-iscsi
+// connected. Multipath devices are found by their device mapper UUID, single paths by their WWN.
+func iscsiDeviceByNAA(connectedPath, naa string, retries int, interval time.Duration) (string, error) {
+	connected, err := filepath.EvalSymlinks(connectedPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve device path %s: %w", connectedPath, err)
+	}
+
+	wwn := strings.TrimPrefix(strings.ToLower(naa), "0x")
+	byIDPath := filepath.Join("/dev/disk/by-id", "wwn-0x"+wwn)
+	if strings.HasPrefix(filepath.Base(connected), "dm-") {
+		byIDPath = filepath.Join("/dev/disk/by-id", "dm-uuid-mpath-3"+wwn)
+	}
+
+	// udev may not have made the link yet
+	var device string
+	for attempt := 0; ; attempt++ {
+		if device, err = filepath.EvalSymlinks(byIDPath); err == nil || attempt >= retries {
+			break
+		}
+		time.Sleep(interval)
+	}
+	if err != nil {
+		return "", fmt.Errorf("no device with NAA %s found at %s: %w", naa, byIDPath, err)
+	}
+	if device != connected {
+		return "", fmt.Errorf("device with NAA %s is %s but the LUN connected as %s, refusing to use it", naa, device, connected)
+	}
+	return byIDPath, nil
+}
@@ -59,6 +59,8 @@ func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
 		bkportal = append(bkportal, portalMounter(portal))
 	}
 
+	serial := req.GetVolumeContext()[ISCSIVolumeContextSerial]
+	naa := req.GetVolumeContext()[ISCSIVolumeContextNAA]
 	iface := req.GetVolumeContext()["iscsiInterface"]
 	initiatorName := req.GetVolumeContext()["initiatorName"]
 	chapDiscovery := false
@@ -91,6 +93,8 @@ func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
 		sessionSecret:   sessionSecret,
 		discoverySecret: discoverySecret,
 		InitiatorName:   initiatorName,
+		serial:          serial,
+		naa:             naa,
 	}
 
 	return iscsiDisk, nil
@@ -119,14 +123,32 @@ func buildISCSIConnector(iscsiInfo *iscsiDisk) *iscsiLib.Connector {
 	return &c
 }
 
-func getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.NodePublishVolumeRequest) *iscsiDiskMounter {
-	readOnly := req.GetReadonly()
-	fsType := req.GetVolumeCapability().GetMount().GetFsType()
+func getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.NodePublishVolumeRequest) (*iscsiDiskMounter, error) {
+	readOnly := req.GetReadonly() ||
+		req.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY ||
+		req.GetPublishContext()[ISCSIPublishContextReadOnly] == "true"
+	fsType, err := iscsiResolveFsType(req.GetVolumeCapability().GetMount().GetFsType(), req.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
+	mkfsArgs, err := iscsiMkfsArgs(fsType, req.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
 	mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
+	if readOnly {
+		// Replaying the journal writes to the disk, which other nodes may have mounted too
+		if isExtFs(fsType) {
+			mountOptions = append(mountOptions, "noload")
+		} else {
+			mountOptions = append(mountOptions, "norecovery")
+		}
+	}
 
 	diskMounter := &iscsiDiskMounter{
 		iscsiDisk:    iscsiInfo,
 		fsType:       fsType,
+		mkfsArgs:     mkfsArgs,
 		readOnly:     readOnly,
 		mountOptions: mountOptions,
 		mounter:      &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()},
@@ -135,7 +157,7 @@ func getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.NodePublishVolumeRequest
 		connector:    buildISCSIConnector(iscsiInfo),
 	}
 
-	return diskMounter
+	return diskMounter, nil
 }
 
 func getISCSIDiskUnmounter(req *csi.NodeUnpublishVolumeRequest) *iscsiDiskUnmounter {
@@ -228,12 +250,15 @@ type iscsiDisk struct {
 	discoverySecret iscsiLib.Secrets
 	InitiatorName   string
 	VolName         string
+	serial          string
+	naa             string
 }
 
 type iscsiDiskMounter struct {
 	*iscsiDisk
 	readOnly     bool
 	fsType       string
+	mkfsArgs     []string
 	mountOptions []string
 	mounter      *mount.SafeFormatAndMount
 	exec         exec.Interface
@@ -245,4 +270,6 @@ type iscsiDiskUnmounter struct {
 	*iscsiDisk
 	mounter mount.Interface
 	exec    exec.Interface
+	// targetInUse reports whether other volumes still need the session to the target
+	targetInUse func(targetIqn string) (bool, error)
 }
@@ -0,0 +1,253 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	iscsiLib "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+	"k8s.io/utils/exec"
+	"k8s.io/utils/mount"
+)
+
+// iscsiPublishState is persisted next to the csi-lib-iscsi connector so a volume can be mounted again after the node
+// or plugin restarts without kubelet calling NodePublishVolume.
+type iscsiPublishState struct {
+	TargetPath   string   `json:"target_path"`
+	FsType       string   `json:"fs_type"`
+	ReadOnly     bool     `json:"read_only"`
+	MountOptions []string `json:"mount_options"`
+	Serial       string   `json:"serial"`
+	NAA          string   `json:"naa"`
+	MkfsArgs     []string `json:"mkfs_args"`
+}
+
+func (d *Driver) persistISCSIPublishState(id string, state iscsiPublishState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(d.getISCSIPublishStatePath(id), data, 0o600)
+}
+
+func (d *Driver) loadISCSIPublishState(id string) (*iscsiPublishState, error) {
+	data, err := os.ReadFile(d.getISCSIPublishStatePath(id))
+	if err != nil {
+		return nil, err
+	}
+	state := &iscsiPublishState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// iscsiActiveSessions returns the portals of every target this node is logged in to, keyed by target IQN.
+func iscsiActiveSessions() (map[string][]string, error) {
+	result := make(map[string][]string)
+
+	out, err := iscsiLib.GetSessions()
+	if err != nil {
+		// iscsiadm exits with 21 when there are no sessions
+		var exitErr *osexec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 21 {
+			return result, nil
+		}
+		return nil, err
+	}
+
+	// tcp: [1] 192.168.1.2:3260,1 iqn.2005-10.org.freenas.ctl:iscsi-pvc-1234 (non-flash)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		result[fields[3]] = append(result[fields[3]], strings.Split(fields[2], ",")[0])
+	}
+	return result, nil
+}
+
+// isDriverManagedIQN checks if a target IQN was created by this driver, so sessions to other storage are left alone.
+func isDriverManagedIQN(iqn string) bool {
+	idx := strings.LastIndex(iqn, ":")
+	if idx == -1 {
+		return false
+	}
+	name := iqn[idx+1:]
+	return strings.HasPrefix(name, ISCSIVolumePrefix) || strings.HasPrefix(name, ISCSISharedTargetPrefix)
+}
+
+// iscsiReconcile compares the persisted connectors, the active iSCSI sessions and the mounts on this node after a
+// restart. Volumes whose target path still exists are logged in and mounted again, anything else is cleaned up.
+func (d *Driver) iscsiReconcile() {
+	klog.InfoS("reconciling iSCSI volumes", "configDir", d.iscsiConfigDir)
+
+	entries, err := os.ReadDir(d.iscsiConfigDir)
+	if err != nil {
+		klog.ErrorS(err, "failed to list iSCSI config dir", "configDir", d.iscsiConfigDir)
+		return
+	}
+
+	sessions, err := iscsiActiveSessions()
+	if err != nil {
+		klog.ErrorS(err, "failed to list iSCSI sessions, skipping reconcile")
+		return
+	}
+
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		klog.ErrorS(err, "failed to list mounts, skipping reconcile")
+		return
+	}
+	mounts := make(map[string]string, len(mountPoints))
+	for _, mp := range mountPoints {
+		mounts[mp.Path] = mp.Device
+	}
+
+	usedTargets := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		volumeID := strings.TrimSuffix(entry.Name(), ".json")
+
+		if !d.volumeLocks.tryAcquire(volumeID) {
+			// Kubelet got to it first, so it's being published or unpublished already
+			klog.InfoS("iSCSI volume is busy, leaving it to kubelet", "volumeID", volumeID)
+			continue
+		}
+		targetIqn, keep := d.iscsiReconcileVolume(volumeID, sessions, mounts)
+		d.volumeLocks.release(volumeID)
+		if keep {
+			usedTargets[targetIqn] = true
+		}
+	}
+
+	// Publish state without a connector is left over from a failed publish
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".state" {
+			continue
+		}
+		volumeID := strings.TrimSuffix(entry.Name(), ".state")
+		if _, err = os.Stat(d.getISCSILibConfigPath(volumeID)); os.IsNotExist(err) {
+			klog.InfoS("removing orphaned iSCSI publish state", "volumeID", volumeID)
+			_ = os.Remove(d.getISCSIPublishStatePath(volumeID))
+		}
+	}
+
+	for targetIqn, portals := range sessions {
+		if usedTargets[targetIqn] || !isDriverManagedIQN(targetIqn) {
+			continue
+		}
+		// A publish logs in before persisting its connector, so leave sessions alone while any is running and look
+		// at the connectors again in case one finished since they were listed
+		if d.volumeLocks.busy() {
+			klog.InfoS("volumes are being published or unpublished, leaving orphaned iSCSI sessions for now")
+			break
+		}
+		if inUse, err2 := d.iscsiTargetInUse("", targetIqn); err2 != nil || inUse {
+			continue
+		}
+		klog.InfoS("logging out of orphaned iSCSI session", "targetIqn", targetIqn)
+		iscsiLib.Disconnect(targetIqn, portals)
+	}
+
+	klog.InfoS("finished reconciling iSCSI volumes")
+}
+
+// iscsiReconcileVolume brings a single persisted volume back in line, returning its target IQN and whether the volume
+// is still in use.
+func (d *Driver) iscsiReconcileVolume(volumeID string, sessions map[string][]string, mounts map[string]string) (string, bool) {
+	libConfigPath := d.getISCSILibConfigPath(volumeID)
+	data, err := os.ReadFile(libConfigPath)
+	if err != nil {
+		klog.ErrorS(err, "failed to read iSCSI connector", "volumeID", volumeID)
+		return "", false
+	}
+	// Not using GetConnectorFromFile as it fails if the devices have gone away, which is what we're looking for
+	connector := iscsiLib.Connector{}
+	if err = json.Unmarshal(data, &connector); err != nil {
+		klog.ErrorS(err, "failed to parse iSCSI connector, removing", "volumeID", volumeID)
+		_ = os.Remove(libConfigPath)
+		return "", false
+	}
+
+	state, err := d.loadISCSIPublishState(volumeID)
+	if err != nil {
+		// Without a target path there is no way to tell if the volume is in use, so leave it to kubelet
+		klog.ErrorS(err, "failed to read iSCSI publish state, skipping", "volumeID", volumeID)
+		return connector.TargetIqn, true
+	}
+
+	targetPathExists := false
+	if _, err = os.Stat(state.TargetPath); err == nil || mount.IsCorruptedMnt(err) {
+		targetPathExists = true
+	}
+
+	device, mounted := mounts[state.TargetPath]
+	_, sessionActive := sessions[connector.TargetIqn]
+	deviceExists := false
+	if mounted {
+		_, err = os.Stat(device)
+		deviceExists = err == nil
+	}
+
+	if !targetPathExists {
+		// The pod has gone, so nothing will ever unpublish this volume
+		klog.InfoS("cleaning up orphaned iSCSI volume", "volumeID", volumeID, "targetIqn", connector.TargetIqn)
+		if mounted {
+			if err = d.mounter.Unmount(state.TargetPath); err != nil {
+				klog.ErrorS(err, "failed to unmount orphaned iSCSI volume", "targetPath", state.TargetPath)
+			}
+		}
+		if sessionActive && connector.MountTargetDevice != nil {
+			if err = connector.DisconnectVolume(); err != nil {
+				klog.ErrorS(err, "failed to remove devices of orphaned iSCSI volume", "volumeID", volumeID)
+			}
+		}
+		_ = os.Remove(libConfigPath)
+		_ = os.Remove(d.getISCSIPublishStatePath(volumeID))
+		return connector.TargetIqn, false
+	}
+
+	if sessionActive && mounted && deviceExists {
+		klog.V(4).InfoS("iSCSI volume is healthy", "volumeID", volumeID)
+		return connector.TargetIqn, true
+	}
+
+	// Either the node rebooted or the mount points at a device which has gone away
+	if mounted {
+		klog.InfoS("unmounting stale iSCSI volume", "volumeID", volumeID, "targetPath", state.TargetPath, "device", device)
+		if err = d.mounter.Unmount(state.TargetPath); err != nil {
+			klog.ErrorS(err, "failed to unmount stale iSCSI volume", "targetPath", state.TargetPath)
+			return connector.TargetIqn, true
+		}
+	}
+
+	klog.InfoS("logging in and remounting iSCSI volume", "volumeID", volumeID, "targetIqn", connector.TargetIqn, "targetPath", state.TargetPath)
+	connector.Devices = nil
+	connector.MountTargetDevice = nil
+	diskMounter := iscsiDiskMounter{
+		iscsiDisk:    &iscsiDisk{VolName: volumeID, Iqn: connector.TargetIqn, Portals: connector.TargetPortals, lun: connector.Lun, serial: state.Serial, naa: state.NAA},
+		readOnly:     state.ReadOnly,
+		fsType:       state.FsType,
+		mkfsArgs:     state.MkfsArgs,
+		mountOptions: state.MountOptions,
+		mounter:      &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()},
+		exec:         exec.New(),
+		targetPath:   state.TargetPath,
+		connector:    &connector,
+	}
+	util := &ISCSIUtil{}
+	if _, err = util.AttachDisk(diskMounter, libConfigPath); err != nil {
+		// Leave the files in place, kubelet will retry the publish or unpublish and sort it out
+		klog.ErrorS(err, "failed to remount iSCSI volume", "volumeID", volumeID)
+	}
+
+	return connector.TargetIqn, true
+}
@@ -18,6 +18,7 @@ Modified to change logging
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"k8s.io/klog/v2"
 
@@ -31,6 +32,8 @@ import (
 type ISCSIUtil struct{}
 
 func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter, iscsiInfoPath string) (string, error) {
+	// A session to a shared target may predate the LUN of this volume
+	iscsiRescanSessions(b.exec, b.connector.TargetIqn)
 	devicePath, err := (*b.connector).Connect()
 	if err != nil {
 		return "", err
@@ -38,6 +41,23 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter, iscsiInfoPath string) (str
 	if devicePath == "" {
 		return "", fmt.Errorf("connect reported success, but no path returned")
 	}
+	// Make sure a LUN mix-up can never lead to formatting someone else's disk
+	if b.serial != "" {
+		if err = verifyDeviceSerial(devicePath, b.serial); err != nil {
+			klog.ErrorS(err, "iSCSI device does not match volume", "devicePath", devicePath)
+			return "", err
+		}
+	}
+	// The by-id path is tied to the extent rather than the order LUNs were connected in. Volumes from before the NAA
+	// was passed along keep using the path csi-lib-iscsi returned
+	if b.naa != "" {
+		byIDPath, err := iscsiDeviceByNAA(devicePath, b.naa, int(b.connector.RetryCount), time.Duration(b.connector.CheckInterval)*time.Second)
+		if err != nil {
+			klog.ErrorS(err, "iSCSI device does not match volume", "devicePath", devicePath)
+			return "", err
+		}
+		devicePath = byIDPath
+	}
 	// Mount device
 	mntPath := b.targetPath
 	notMnt, err := b.mounter.IsLikelyNotMountPoint(mntPath)
@@ -70,6 +90,13 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter, iscsiInfoPath string) (str
 	}
 	options = append(options, b.mountOptions...)
 
+	if !b.readOnly {
+		if err = formatDisk(b.mounter, devicePath, b.fsType, b.mkfsArgs); err != nil {
+			klog.ErrorS(err, "iSCSI failed to format iSCSI volume", "devicePath", devicePath, "fsType", b.fsType)
+			return devicePath, err
+		}
+	}
+
 	err = b.mounter.FormatAndMount(devicePath, mntPath, b.fsType, options)
 	if err != nil {
 		klog.ErrorS(err, "iSCSI failed to mount iSCSI volume", "devicePath", devicePath, "fsType", b.fsType)
@@ -117,7 +144,27 @@ func (util *ISCSIUtil) DetachDisk(c iscsiDiskUnmounter, targetPath, iscsiInfoPat
 		return err
 	}
 
-	iscsiLib.Disconnect(connector.TargetIqn, connector.TargetPortals)
+	inUse := false
+	if c.targetInUse != nil {
+		if inUse, err = c.targetInUse(connector.TargetIqn); err != nil {
+			// Logging out from under other volumes is far worse than a session left behind
+			klog.ErrorS(err, "failed to check whether iSCSI target is used by other volumes, keeping session", "targetIqn", connector.TargetIqn)
+			inUse = true
+		}
+	}
+	if inUse {
+		klog.InfoS("iSCSI target still in use by other volumes, keeping session", "targetIqn", connector.TargetIqn)
+		devices := connector.Devices
+		if connector.MountTargetDevice != nil {
+			devices = append(devices, *connector.MountTargetDevice)
+		}
+		if err = deleteSCSIDevices(devices...); err != nil {
+			klog.ErrorS(err, "iSCSI detach disk: failed to delete SCSI devices of LUN", "targetIqn", connector.TargetIqn)
+			return err
+		}
+	} else {
+		iscsiLib.Disconnect(connector.TargetIqn, connector.TargetPortals)
+	}
 	if err = os.RemoveAll(targetPath); err != nil {
 		klog.ErrorS(err, "iSCSI: failed to remove mount path")
 	}
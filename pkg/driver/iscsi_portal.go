@@ -0,0 +1,142 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+// ISCSIParamPortal is the StorageClass parameter choosing the portal volumes are exposed on, by ID, comment or listen
+// IP. Without it the portal given by --portal is used.
+const ISCSIParamPortal = "portal"
+
+// iscsiPortalCacheTTL is how long portals are cached for before being loaded from TrueNAS again, so changes made on
+// the NAS are picked up without restarting the controller.
+const iscsiPortalCacheTTL = 5 * time.Minute
+
+type iscsiPortal struct {
+	id   int32
+	addr string // ip:port initiators connect to
+}
+
+// iscsiLoadPortals refreshes the cached portals from TrueNAS.
+func (d *Driver) iscsiLoadPortals(ctx context.Context) error {
+	portals, err := d.storage.listISCSIPortals(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list iSCSI portals: %w", err)
+	}
+
+	d.iscsiPortalsMu.Lock()
+	defer d.iscsiPortalsMu.Unlock()
+	d.iscsiPortals = portals
+	d.iscsiPortalsLoadedAt = time.Now()
+	return nil
+}
+
+// loadDefaultPortal resolves the portal given by --portal, unless already done. Its ID names the shared targets.
+func (d *Driver) loadDefaultPortal(ctx context.Context) error {
+	d.apiStateMu.Lock()
+	defer d.apiStateMu.Unlock()
+	if d.portalLoaded {
+		return nil
+	}
+
+	if err := d.iscsiLoadPortals(ctx); err != nil {
+		return err
+	}
+	portal, found := d.iscsiFindPortal(d.portal)
+	if !found {
+		return fmt.Errorf("iSCSI portal %q does not exist or has no listen addresses, --portal must be a portal ID, comment or listen IP", d.portal)
+	}
+	d.portalID = portal.id
+	d.portalLoaded = true
+	klog.InfoS("using iSCSI portal", "portal", d.portal, "portalID", portal.id, "address", portal.addr)
+	return nil
+}
+
+// iscsiInvalidatePortals makes the next resolve load the portals from TrueNAS again, for when a volume failed to be
+// created on a portal which may have changed.
+func (d *Driver) iscsiInvalidatePortals() {
+	d.iscsiPortalsMu.Lock()
+	defer d.iscsiPortalsMu.Unlock()
+	d.iscsiPortalsLoadedAt = time.Time{}
+}
+
+func (d *Driver) iscsiPortalsStale() bool {
+	d.iscsiPortalsMu.Lock()
+	defer d.iscsiPortalsMu.Unlock()
+	return time.Since(d.iscsiPortalsLoadedAt) > iscsiPortalCacheTTL
+}
+
+// iscsiFindPortal matches a portal selector against the cached portals, an ID takes precedence over a comment or IP.
+func (d *Driver) iscsiFindPortal(selector string) (iscsiPortal, bool) {
+	d.iscsiPortalsMu.Lock()
+	defer d.iscsiPortalsMu.Unlock()
+
+	var match *tnclient.ISCSIPortal
+	if id, err := strconv.ParseInt(selector, 10, 32); err == nil {
+		for i := range d.iscsiPortals {
+			if d.iscsiPortals[i].Id == int32(id) {
+				match = &d.iscsiPortals[i]
+				break
+			}
+		}
+	}
+	for i := range d.iscsiPortals {
+		if match != nil {
+			break
+		}
+		if d.iscsiPortals[i].Comment == selector {
+			match = &d.iscsiPortals[i]
+			break
+		}
+		for _, listen := range d.iscsiPortals[i].Listen {
+			if listen.GetIp() == selector {
+				match = &d.iscsiPortals[i]
+				break
+			}
+		}
+	}
+	if match == nil || len(match.Listen) == 0 {
+		return iscsiPortal{}, false
+	}
+
+	// Prefer the listen address that was asked for, otherwise the first one
+	listen := match.Listen[0]
+	for _, item := range match.Listen {
+		if item.GetIp() == selector {
+			listen = item
+			break
+		}
+	}
+	if len(match.Listen) > 1 && listen.GetIp() != selector {
+		klog.V(5).InfoS("[Debug] portal has more than 1 listening address, using first one", "portalID", match.Id)
+	}
+
+	return iscsiPortal{id: match.Id, addr: fmt.Sprintf("%s:%d", listen.GetIp(), listen.GetPort())}, true
+}
+
+// iscsiResolvePortal finds the portal for a selector. The portals are reloaded from TrueNAS once the cache has expired
+// or been invalidated, and once if the selector isn't cached as the portal may have been added since.
+func (d *Driver) iscsiResolvePortal(ctx context.Context, selector string) (iscsiPortal, error) {
+	if !d.iscsiPortalsStale() {
+		if portal, found := d.iscsiFindPortal(selector); found {
+			return portal, nil
+		}
+	}
+
+	if err := d.iscsiLoadPortals(ctx); err != nil {
+		return iscsiPortal{}, status.Error(codes.Internal, err.Error())
+	}
+	if portal, found := d.iscsiFindPortal(selector); found {
+		return portal, nil
+	}
+	return iscsiPortal{}, status.Errorf(codes.InvalidArgument, "iSCSI portal %q does not exist or has no listen addresses, must be a portal ID, comment or listen IP", selector)
+}
@@ -0,0 +1,161 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+const (
+	// ISCSIPublishContextReadOnly tells the node the volume must be mounted read-only.
+	ISCSIPublishContextReadOnly = "readOnly"
+
+	// iscsiAttachmentsProperty is the ZFS user property on the zvol recording which nodes it's attached to, the value
+	// being whether the attachment is read-only.
+	iscsiAttachmentsProperty = "truenas-csi:attachments"
+)
+
+type iscsiAttachments map[string]bool
+
+// iscsiGetAttachments returns the zvol backing a volume along with the nodes it is currently attached to.
+func (d *Driver) iscsiGetAttachments(ctx context.Context, volumeID string) (*tnclient.Dataset, iscsiAttachments, error) {
+	datasetName := strings.Join([]string{d.iscsiStoragePath, volumeID}, "/")
+	dataset, datasetExists, err := FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+		return dataset.GetName() == datasetName && dataset.GetType() == "VOLUME"
+	}, FilterEqual("name", datasetName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look for existing datasets: %w", err)
+	}
+	if !datasetExists {
+		return nil, nil, nil
+	}
+
+	attachments := make(iscsiAttachments)
+	if value := GetDatasetUserProperty(dataset, iscsiAttachmentsProperty); value != "" {
+		if err = json.Unmarshal([]byte(value), &attachments); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse attachments of %s: %w", datasetName, err)
+		}
+	}
+	return &dataset, attachments, nil
+}
+
+func (d *Driver) iscsiSetAttachments(ctx context.Context, datasetID string, attachments iscsiAttachments) error {
+	value := ""
+	if len(attachments) > 0 {
+		data, err := json.Marshal(attachments)
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	}
+
+	return d.storage.updateDataset(ctx, datasetID, tnclient.UpdateDatasetParams{
+		AdditionalProperties: map[string]interface{}{
+			"user_properties_update": DatasetUserProperties(map[string]string{iscsiAttachmentsProperty: value}),
+		},
+	})
+}
+
+// iscsiControllerPublishVolume records the node as attached. A volume can be attached read-only to any number of nodes
+// but read-write only while no other node has it.
+func (d *Driver) iscsiControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if err := iscsiCheckCaps([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, err
+	}
+
+	volumeID := req.GetVolumeId()
+	nodeID := req.GetNodeId()
+	readOnly := req.GetReadonly() || req.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+
+	d.iscsiAttachMu.Lock()
+	defer d.iscsiAttachMu.Unlock()
+
+	dataset, attachments, err := d.iscsiGetAttachments(ctx, volumeID)
+	if err != nil {
+		klog.ErrorS(err, "failed to get iSCSI volume attachments", "volumeID", volumeID)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if dataset == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s does not exist", volumeID)
+	}
+
+	publishContext := map[string]string{ISCSIPublishContextReadOnly: strconv.FormatBool(readOnly)}
+
+	if attachedReadOnly, attached := attachments[nodeID]; attached && attachedReadOnly == readOnly {
+		klog.V(5).InfoS("[Debug] iSCSI volume already attached to node, skipping", "volumeID", volumeID, "nodeID", nodeID)
+		return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+	}
+
+	var otherNodes, writers []string
+	for otherNode, otherReadOnly := range attachments {
+		if otherNode == nodeID {
+			continue
+		}
+		otherNodes = append(otherNodes, otherNode)
+		if !otherReadOnly {
+			writers = append(writers, otherNode)
+		}
+	}
+	sort.Strings(otherNodes)
+	sort.Strings(writers)
+
+	if !readOnly && len(otherNodes) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s cannot be attached read-write as it is attached to %s", volumeID, strings.Join(otherNodes, ", "))
+	}
+	if len(writers) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s cannot be attached as it is attached read-write to %s", volumeID, strings.Join(writers, ", "))
+	}
+
+	attachments[nodeID] = readOnly
+	if err = d.iscsiSetAttachments(ctx, dataset.GetId(), attachments); err != nil {
+		klog.ErrorS(err, "failed to record iSCSI volume attachment", "volumeID", volumeID, "nodeID", nodeID)
+		return nil, status.Errorf(codes.Internal, "failed to record attachment: %v", err)
+	}
+
+	return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+}
+
+func (d *Driver) iscsiControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	nodeID := req.GetNodeId()
+
+	d.iscsiAttachMu.Lock()
+	defer d.iscsiAttachMu.Unlock()
+
+	dataset, attachments, err := d.iscsiGetAttachments(ctx, volumeID)
+	if err != nil {
+		klog.ErrorS(err, "failed to get iSCSI volume attachments", "volumeID", volumeID)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if dataset == nil {
+		// Volume has gone so it's not attached anywhere
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	// An empty node ID means detach from everywhere
+	if nodeID == "" {
+		attachments = nil
+	} else {
+		if _, attached := attachments[nodeID]; !attached {
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		delete(attachments, nodeID)
+	}
+
+	if err = d.iscsiSetAttachments(ctx, dataset.GetId(), attachments); err != nil {
+		klog.ErrorS(err, "failed to remove iSCSI volume attachment", "volumeID", volumeID, "nodeID", nodeID)
+		return nil, status.Errorf(codes.Internal, "failed to remove attachment: %v", err)
+	}
+
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
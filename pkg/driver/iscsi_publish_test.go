@@ -0,0 +1,105 @@
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func publishISCSI(d *Driver, volumeID, nodeID string, mode csi.VolumeCapability_AccessMode_Mode) (*csi.ControllerPublishVolumeResponse, error) {
+	return d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           nodeID,
+		VolumeCapability: mountCapability(mode),
+	})
+}
+
+func unpublishISCSI(t *testing.T, d *Driver, volumeID, nodeID string) {
+	t.Helper()
+	if _, err := d.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: nodeID}); err != nil {
+		t.Fatalf("ControllerUnpublishVolume from %s failed: %v", nodeID, err)
+	}
+}
+
+// iscsiAttachedNodes returns the nodes recorded on the zvol, with whether each is read-only.
+func iscsiAttachedNodes(t *testing.T, d *Driver, volumeID string) iscsiAttachments {
+	t.Helper()
+	_, attachments, err := d.iscsiGetAttachments(context.Background(), volumeID)
+	if err != nil {
+		t.Fatalf("failed to get attachments: %v", err)
+	}
+	return attachments
+}
+
+func TestISCSIPublishReadWriteIsExclusive(t *testing.T) {
+	d, _ := newTestDriver(t, TypeISCSI)
+	volumeID := createTwice(t, d, createVolumeRequest("pvc-1", nil)).GetVolumeId()
+
+	for i := 0; i < 2; i++ {
+		resp, err := publishISCSI(d, volumeID, "node-1", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+		if err != nil {
+			t.Fatalf("ControllerPublishVolume %d failed: %v", i+1, err)
+		}
+		if got := resp.GetPublishContext()[ISCSIPublishContextReadOnly]; got != "false" {
+			t.Errorf("publish context read-only = %q, want false", got)
+		}
+	}
+	if got, want := iscsiAttachedNodes(t, d, volumeID), (iscsiAttachments{"node-1": false}); !reflect.DeepEqual(got, want) {
+		t.Errorf("attachments = %v, want %v", got, want)
+	}
+
+	if _, err := publishISCSI(d, volumeID, "node-2", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("read-write publish to a second node returned %v, want FailedPrecondition", err)
+	}
+	if _, err := publishISCSI(d, volumeID, "node-2", csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("read-only publish while attached read-write returned %v, want FailedPrecondition", err)
+	}
+
+	// Once detached the volume can move
+	unpublishISCSI(t, d, volumeID, "node-1")
+	unpublishISCSI(t, d, volumeID, "node-1")
+	if _, err := publishISCSI(d, volumeID, "node-2", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER); err != nil {
+		t.Errorf("ControllerPublishVolume after detaching failed: %v", err)
+	}
+	if got, want := iscsiAttachedNodes(t, d, volumeID), (iscsiAttachments{"node-2": false}); !reflect.DeepEqual(got, want) {
+		t.Errorf("attachments = %v, want %v", got, want)
+	}
+}
+
+func TestISCSIPublishReadOnlyToManyNodes(t *testing.T) {
+	d, _ := newTestDriver(t, TypeISCSI)
+	volumeID := createTwice(t, d, createVolumeRequest("pvc-1", nil)).GetVolumeId()
+
+	for _, nodeID := range []string{"node-1", "node-2"} {
+		resp, err := publishISCSI(d, volumeID, nodeID, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)
+		if err != nil {
+			t.Fatalf("ControllerPublishVolume to %s failed: %v", nodeID, err)
+		}
+		if got := resp.GetPublishContext()[ISCSIPublishContextReadOnly]; got != "true" {
+			t.Errorf("publish context read-only = %q, want true", got)
+		}
+	}
+	if _, err := publishISCSI(d, volumeID, "node-3", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("read-write publish while attached read-only returned %v, want FailedPrecondition", err)
+	}
+
+	// An empty node ID detaches from everywhere
+	unpublishISCSI(t, d, volumeID, "")
+	if got := iscsiAttachedNodes(t, d, volumeID); len(got) != 0 {
+		t.Errorf("attachments = %v, want none", got)
+	}
+}
+
+func TestISCSIPublishMissingVolume(t *testing.T) {
+	d, _ := newTestDriver(t, TypeISCSI)
+
+	if _, err := publishISCSI(d, ISCSIVolumePrefix+"pvc-1", "node-1", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER); status.Code(err) != codes.NotFound {
+		t.Errorf("ControllerPublishVolume returned %v, want NotFound", err)
+	}
+	// Nothing to detach from a volume that has gone
+	unpublishISCSI(t, d, ISCSIVolumePrefix+"pvc-1", "node-1")
+}
@@ -0,0 +1,407 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+// iscsiVolumeResource is the chain of TrueNAS objects behind an iSCSI volume: zvol, extent, initiator group, target and
+// target extent. Volumes on shared targets only own the zvol, the extent and the target extent mapping their LUN.
+//
+// Every object is looked up by name before being created so Ensure can resume after a partial failure, and anything
+// an Ensure call created is torn down again in reverse order if a later step fails.
+type iscsiVolumeResource struct {
+	d *Driver
+
+	volumeID    string
+	datasetName string
+	extentPath  string
+	size        int64
+	portalID    int32
+	// capacityRange is what an existing zvol's size has to satisfy, nil accepts any size
+	capacityRange *csi.CapacityRange
+
+	datasetID    string
+	extentID     int32
+	extentSerial string
+	extentNAA    string
+	initiatorID  int32
+	targetID     int32
+	targetName   string
+	lun          int32
+}
+
+type iscsiResourceStep struct {
+	name string
+	// ensure returns whether the object had to be created
+	ensure func(ctx context.Context) (bool, error)
+	// teardown removes the object if it exists
+	teardown func(ctx context.Context) error
+}
+
+func (d *Driver) newISCSIVolumeResource(volumeID string) *iscsiVolumeResource {
+	datasetName := strings.Join([]string{d.iscsiStoragePath, volumeID}, "/")
+	return &iscsiVolumeResource{
+		d:            d,
+		volumeID:     volumeID,
+		datasetName:  datasetName,
+		extentPath:   "zvol/" + datasetName,
+		extentID:     -1,
+		extentSerial: iscsiExtentSerial(volumeID),
+		extentNAA:    iscsiExtentNAA(volumeID),
+		initiatorID:  -1,
+		targetID:     -1,
+	}
+}
+
+// steps returns the objects in dependency order, each one may only refer to those before it.
+func (r *iscsiVolumeResource) steps(shared bool) []iscsiResourceStep {
+	steps := []iscsiResourceStep{
+		{name: "dataset", ensure: r.ensureDataset, teardown: r.deleteDataset},
+		{name: "extent", ensure: r.ensureExtent, teardown: r.deleteExtent},
+	}
+	if shared {
+		return append(steps, iscsiResourceStep{name: "shared target LUN", ensure: r.ensureSharedLUN, teardown: r.deleteTargetExtents})
+	}
+	return append(steps,
+		iscsiResourceStep{name: "initiator", ensure: r.ensureInitiator, teardown: r.deleteInitiator},
+		iscsiResourceStep{name: "target", ensure: r.ensureTarget, teardown: r.deleteTarget},
+		iscsiResourceStep{name: "target extent", ensure: r.ensureTargetExtent, teardown: r.deleteTargetExtents},
+	)
+}
+
+// Ensure creates whatever is missing of the volume, rolling back the objects it created itself on failure.
+func (r *iscsiVolumeResource) Ensure(ctx context.Context) error {
+	var created []iscsiResourceStep
+	for _, step := range r.steps(r.d.iscsiSharedTargets > 0) {
+		wasCreated, err := step.ensure(ctx)
+		if err != nil {
+			klog.ErrorS(err, "failed to ensure iSCSI object, rolling back", "volumeID", r.volumeID, "object", step.name)
+			for i := len(created) - 1; i >= 0; i-- {
+				klog.V(5).InfoS("[Debug] rolling back iSCSI object", "volumeID", r.volumeID, "object", created[i].name)
+				if err2 := created[i].teardown(ctx); err2 != nil {
+					// Whatever is left is picked up again by the next attempt or by DeleteVolume
+					klog.ErrorS(err2, "failed to roll back iSCSI object", "volumeID", r.volumeID, "object", created[i].name)
+				}
+			}
+			return fmt.Errorf("failed to ensure iSCSI %s: %w", step.name, err)
+		}
+		if wasCreated {
+			created = append(created, step)
+		}
+	}
+	return nil
+}
+
+// Teardown removes every object of the volume in reverse dependency order, covering both dedicated and shared targets
+// as the mode may have changed since the volume was created.
+func (r *iscsiVolumeResource) Teardown(ctx context.Context) error {
+	steps := r.steps(false)
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err := steps[i].teardown(ctx); err != nil {
+			return fmt.Errorf("failed to delete iSCSI %s: %w", steps[i].name, err)
+		}
+	}
+	return nil
+}
+
+func (r *iscsiVolumeResource) findDataset(ctx context.Context) (tnclient.Dataset, bool, error) {
+	return FindDataset(ctx, r.d.storage, func(dataset tnclient.Dataset) bool {
+		return dataset.GetName() == r.datasetName && dataset.GetType() == "VOLUME"
+	}, FilterEqual("name", r.datasetName))
+}
+
+func (r *iscsiVolumeResource) ensureDataset(ctx context.Context) (bool, error) {
+	existingDataset, datasetExists, err := r.findDataset(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to look for existing datasets: %w", err)
+	}
+	if datasetExists {
+		volsize := existingDataset.GetVolsize()
+		size, err2 := strconv.ParseInt(volsize.GetRawvalue(), 10, 64)
+		if err2 != nil {
+			return false, fmt.Errorf("failed to parse size %q of zvol %s: %w", volsize.GetRawvalue(), r.datasetName, err2)
+		}
+		if !capacityInRange(r.capacityRange, size) {
+			return false, status.Errorf(codes.AlreadyExists, "volume %s already exists with size %d, which doesn't fit the requested capacity", r.volumeID, size)
+		}
+		klog.V(5).Info("[Debug] Dataset exists, skipping")
+		r.datasetID = existingDataset.Id
+		r.size = size
+		return false, nil
+	}
+
+	klog.V(5).Info("[Debug] Dataset does not exist, creating")
+	datasetResponse, err := r.d.storage.createDataset(ctx, tnclient.CreateDatasetParams{
+		Name:         r.datasetName,
+		Type:         tnclient.PtrString("VOLUME"),
+		Volblocksize: tnclient.PtrString("16K"),
+		Volsize:      tnclient.PtrInt64(r.size),
+	})
+	if err != nil {
+		return false, err
+	}
+	r.datasetID = datasetResponse.Id
+	return true, nil
+}
+
+func (r *iscsiVolumeResource) deleteDataset(ctx context.Context) error {
+	existingDataset, datasetExists, err := r.findDataset(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to look for existing datasets: %w", err)
+	}
+	if !datasetExists {
+		return nil
+	}
+
+	klog.V(5).InfoS("[Debug] deleting dataset", "datasetID", existingDataset.GetId())
+	err = r.d.storage.deleteDataset(ctx, existingDataset.GetId())
+	return err
+}
+
+func (r *iscsiVolumeResource) findExtent(ctx context.Context) (tnclient.ISCSIExtent, bool, error) {
+	return FindISCSIExtent(ctx, r.d.storage, func(extent tnclient.ISCSIExtent) bool {
+		return extent.GetPath() == r.extentPath
+	}, FilterEqual("path", r.extentPath))
+}
+
+func (r *iscsiVolumeResource) ensureExtent(ctx context.Context) (bool, error) {
+	existingExtent, extentExists, err := r.findExtent(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to look for existing iSCSI extents: %w", err)
+	}
+	if extentExists {
+		klog.V(5).Info("[Debug] iSCSI extent exists, skipping")
+		r.extentID = existingExtent.Id
+		// Extents from older versions have a serial and NAA generated by TrueNAS
+		r.extentSerial = existingExtent.GetSerial()
+		if err = r.readExtentNAA(ctx); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	klog.V(5).Info("[Debug] iSCSI extent does not exist, creating")
+	params := tnclient.CreateISCSIExtentParams{
+		Name:        r.volumeID,
+		Rpm:         tnclient.PtrString("SSD"),
+		Type:        "DISK",
+		InsecureTpc: tnclient.PtrBool(true),
+		Xen:         tnclient.PtrBool(false),
+		Comment:     tnclient.PtrString(r.volumeID + ": Kubernetes managed iSCSI extent"),
+		Blocksize:   tnclient.PtrInt32(512),
+		Disk:        *tnclient.NewNullableString(tnclient.PtrString(r.extentPath)),
+		Serial:      *tnclient.NewNullableString(tnclient.PtrString(r.extentSerial)),
+	}
+	extentResponse, err := r.d.storage.createISCSIExtent(ctx, params, r.extentNAA)
+	if apiFieldRejected(err, "naa") {
+		// Versions which don't take the NAA on create generate one, which is read back below. It stays the same for
+		// the life of the extent but isn't derived from the volume ID
+		klog.InfoS("TrueNAS doesn't take an NAA for iSCSI extents, the volume has no fixed NAA", "volumeID", r.volumeID, "err", err)
+		extentResponse, err = r.d.storage.createISCSIExtent(ctx, params, "")
+	}
+	if err != nil {
+		return false, err
+	}
+	r.extentID = extentResponse.Id
+	// Picked up again by the next attempt like any other partially created volume
+	if err = r.readExtentNAA(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readExtentNAA takes the NAA the extent ended up with, so the node looks for the device TrueNAS really presents.
+func (r *iscsiVolumeResource) readExtentNAA(ctx context.Context) error {
+	naa, err := r.d.storage.iscsiExtentNAA(ctx, r.extentID)
+	if err != nil {
+		return fmt.Errorf("failed to get NAA of iSCSI extent %d: %w", r.extentID, err)
+	}
+	r.extentNAA = naa
+	return nil
+}
+
+func (r *iscsiVolumeResource) deleteExtent(ctx context.Context) error {
+	existingExtent, extentExists, err := r.findExtent(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to look for existing iSCSI extents: %w", err)
+	}
+	if !extentExists {
+		return nil
+	}
+
+	klog.V(5).InfoS("[Debug] deleting iSCSI extent", "iSCSIExtentID", existingExtent.GetId())
+	err = r.d.storage.deleteISCSIExtent(ctx, existingExtent.GetId())
+	return err
+}
+
+func (r *iscsiVolumeResource) initiatorComment() string {
+	return r.volumeID + ": Kubernetes managed iSCSI initiator"
+}
+
+func (r *iscsiVolumeResource) findInitiator(ctx context.Context) (tnclient.ISCSIInitiator, bool, error) {
+	// Match up to the colon, else iscsi-pvc-1 would find the initiator of iscsi-pvc-10
+	return FindISCSIInitiator(ctx, r.d.storage, func(initiator tnclient.ISCSIInitiator) bool {
+		return strings.HasPrefix(initiator.GetComment(), r.volumeID+":")
+	}, FilterPrefix("comment", r.volumeID+":"))
+}
+
+func (r *iscsiVolumeResource) ensureInitiator(ctx context.Context) (bool, error) {
+	existingInitiator, initiatorExists, err := r.findInitiator(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to look for existing iSCSI initiators: %w", err)
+	}
+	if initiatorExists {
+		klog.V(5).Info("[Debug] iSCSI initiator exists, skipping")
+		r.initiatorID = existingInitiator.Id
+		return false, nil
+	}
+
+	klog.V(5).Info("[Debug] iSCSI initiator does not exist, creating")
+	initiatorResponse, err := r.d.storage.createISCSIInitiator(ctx, tnclient.CreateISCSIInitiatorParams{
+		Comment: tnclient.PtrString(r.initiatorComment()),
+	})
+	if err != nil {
+		return false, err
+	}
+	r.initiatorID = initiatorResponse.Id
+	return true, nil
+}
+
+func (r *iscsiVolumeResource) deleteInitiator(ctx context.Context) error {
+	existingInitiator, initiatorExists, err := r.findInitiator(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to look for existing iSCSI initiators: %w", err)
+	}
+	if !initiatorExists {
+		return nil
+	}
+
+	klog.V(5).InfoS("[Debug] deleting iSCSI initiator", "iSCSIInitiatorID", existingInitiator.Id)
+	err = r.d.storage.deleteISCSIInitiator(ctx, existingInitiator.Id)
+	return err
+}
+
+func (r *iscsiVolumeResource) findTarget(ctx context.Context) (tnclient.ISCSITarget, bool, error) {
+	return FindISCSITarget(ctx, r.d.storage, func(target tnclient.ISCSITarget) bool {
+		return target.GetName() == r.volumeID
+	}, FilterEqual("name", r.volumeID))
+}
+
+func (r *iscsiVolumeResource) ensureTarget(ctx context.Context) (bool, error) {
+	r.targetName = r.volumeID
+
+	existingTarget, targetExists, err := r.findTarget(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to look for existing iSCSI targets: %w", err)
+	}
+	if targetExists {
+		klog.V(5).Info("[Debug] iSCSI target exists, skipping")
+		r.targetID = existingTarget.Id
+		return false, nil
+	}
+
+	klog.V(5).Info("[Debug] iSCSI target does not exist, creating")
+	targetResponse, err := r.d.storage.createISCSITarget(ctx, tnclient.CreateISCSITargetParams{
+		Name:  r.volumeID,
+		Alias: *tnclient.NewNullableString(tnclient.PtrString(r.volumeID + ": Kubernetes managed iSCSI initiator")),
+		Mode:  tnclient.PtrString("ISCSI"),
+		Groups: []tnclient.CreateISCSITargetParamsGroupsInner{
+			{
+				Portal:     r.portalID,
+				Initiator:  tnclient.PtrInt32(r.initiatorID),
+				Authmethod: "NONE",
+			},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	r.targetID = targetResponse.Id
+	return true, nil
+}
+
+func (r *iscsiVolumeResource) deleteTarget(ctx context.Context) error {
+	existingTarget, targetExists, err := r.findTarget(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to look for existing iSCSI targets: %w", err)
+	}
+	if !targetExists {
+		return nil
+	}
+
+	// Forced, as the target may still have sessions from nodes which never cleaned up
+	klog.V(5).InfoS("[Debug] deleting iSCSI target", "iSCSITargetID", existingTarget.GetId())
+	err = r.d.storage.deleteISCSITarget(ctx, existingTarget.GetId())
+	return err
+}
+
+func (r *iscsiVolumeResource) ensureTargetExtent(ctx context.Context) (bool, error) {
+	_, targetExtentExists, err := FindISCSITargetExtent(ctx, r.d.storage, func(targetExtent tnclient.ISCSITargetExtent) bool {
+		return targetExtent.Target == r.targetID && targetExtent.Extent == r.extentID
+	}, FilterEqual("target", strconv.Itoa(int(r.targetID))), FilterEqual("extent", strconv.Itoa(int(r.extentID))))
+	if err != nil {
+		return false, fmt.Errorf("failed to look for existing iSCSI target extents: %w", err)
+	}
+	// We always set the LUN to 0 in the target extent mapping of a dedicated target
+	r.lun = 0
+	if targetExtentExists {
+		klog.V(5).Info("[Debug] iSCSI target extent exists, skipping")
+		return false, nil
+	}
+
+	klog.V(5).Info("[Debug] iSCSI target extent does not exist, creating")
+	_, err = r.d.storage.createISCSITargetExtent(ctx, tnclient.CreateISCSITargetExtentParams{
+		Target: r.targetID,
+		Extent: r.extentID,
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *iscsiVolumeResource) ensureSharedLUN(ctx context.Context) (bool, error) {
+	targetName, lun, err := r.d.iscsiMapSharedLUN(ctx, r.portalID, r.extentID)
+	if err != nil {
+		return false, err
+	}
+	r.targetName = targetName
+	r.lun = lun
+	// Mapping is the last step so there is never anything after it to fail and roll it back
+	return false, nil
+}
+
+// deleteTargetExtents unmaps the extent from every target, which for a shared target frees up its LUN.
+func (r *iscsiVolumeResource) deleteTargetExtents(ctx context.Context) error {
+	existingExtent, extentExists, err := r.findExtent(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to look for existing iSCSI extents: %w", err)
+	}
+	if !extentExists {
+		return nil
+	}
+
+	targetExtents, err := FindAllISCSITargetExtents(ctx, r.d.storage, func(targetExtent tnclient.ISCSITargetExtent) bool {
+		return targetExtent.GetExtent() == existingExtent.GetId()
+	}, FilterEqual("extent", strconv.Itoa(int(existingExtent.GetId()))))
+	if err != nil {
+		return fmt.Errorf("failed to look for existing iSCSI target extents: %w", err)
+	}
+	for _, targetExtent := range targetExtents {
+		klog.V(5).InfoS("[Debug] deleting iSCSI target extent", "iSCSITargetExtentID", targetExtent.GetId())
+		if err = r.d.storage.deleteISCSITargetExtent(ctx, targetExtent.GetId()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
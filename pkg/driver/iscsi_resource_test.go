@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestISCSIExtentNAAIsDerivedFromVolumeID(t *testing.T) {
+	d, storage := newTestDriver(t, TypeISCSI)
+
+	volume := createTwice(t, d, createVolumeRequest("pvc-1", nil))
+	want := iscsiExtentNAA(volume.GetVolumeId())
+	if got := volume.GetVolumeContext()[ISCSIVolumeContextNAA]; got != want {
+		t.Errorf("NAA = %q, want %q", got, want)
+	}
+	if len(want) != iscsiNAALength {
+		t.Errorf("NAA %q is %d characters, want %d", want, len(want), iscsiNAALength)
+	}
+	if got := storage.calls["createISCSIExtent"]; got != 1 {
+		t.Errorf("extent was created %d times, want 1", got)
+	}
+}
+
+func TestISCSIExtentWithoutNAASupport(t *testing.T) {
+	d, storage := newTestDriver(t, TypeISCSI)
+	storage.extentNAAError = &restStatusError{statusCode: 422, body: `{"iscsi_extent_create.naa": [{"message": "Field was not expected", "errno": 22}]}`}
+
+	volume := createTwice(t, d, createVolumeRequest("pvc-1", nil))
+	// The node has to look for the NAA TrueNAS generated instead
+	got := volume.GetVolumeContext()[ISCSIVolumeContextNAA]
+	if got == "" || got == iscsiExtentNAA(volume.GetVolumeId()) {
+		t.Errorf("NAA = %q, want the one TrueNAS generated", got)
+	}
+	if got := storage.calls["createISCSIExtent"]; got != 2 {
+		t.Errorf("extent was created %d times, want 2", got)
+	}
+}
+
+func TestISCSIExtentOtherRejectionsKeepNAA(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "other field", err: &restStatusError{statusCode: 422, body: `{"iscsi_extent_create.disk": [{"message": "Disk is in use", "errno": 22}]}`}},
+		{name: "unauthorised", err: &restStatusError{statusCode: 401, body: "Unauthorized"}},
+		{name: "server error", err: &webSocketCallError{code: -32001, errname: "EFAULT"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, storage := newTestDriver(t, TypeISCSI)
+			storage.extentNAAError = tt.err
+
+			if _, err := d.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil)); status.Code(err) != codes.Internal {
+				t.Fatalf("CreateVolume returned %v, want Internal", err)
+			}
+			if got := storage.calls["createISCSIExtent"]; got != 1 {
+				t.Errorf("extent was created %d times, want 1", got)
+			}
+			if len(storage.extents) != 0 {
+				t.Errorf("got %d extents, want none", len(storage.extents))
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	iscsiLib "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/exec"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+const (
+	ISCSISharedTargetPrefix = "iscsi-shared-"
+
+	// iscsiSharedTargetMaxLUNs is the number of LUN IDs TrueNAS allows per target (0-1023).
+	iscsiSharedTargetMaxLUNs = 1024
+
+	// iscsiSharedLUNAttempts is how many times mapping an extent is retried if the chosen LUN got taken.
+	iscsiSharedLUNAttempts = 3
+)
+
+var iscsiSharedInitiatorComment = ISCSISharedTargetPrefix + "initiator: Kubernetes managed iSCSI initiator"
+
+// iscsiSharedTargetName names the shared targets of the default portal iscsi-shared-N, and those of portals chosen by
+// a StorageClass iscsi-shared-pID-N.
+func (d *Driver) iscsiSharedTargetName(portalID int32, index int) string {
+	if portalID == d.portalID {
+		return ISCSISharedTargetPrefix + strconv.Itoa(index)
+	}
+	return fmt.Sprintf("%sp%d-%d", ISCSISharedTargetPrefix, portalID, index)
+}
+
+// iscsiEnsureSharedTargets returns the names of the shared targets on a portal keyed by ID, creating any which are
+// missing along with the initiator group they all use.
+func (d *Driver) iscsiEnsureSharedTargets(ctx context.Context, portalID int32) (map[int32]string, error) {
+	wanted := make(map[string]bool, d.iscsiSharedTargets)
+	for i := 0; i < d.iscsiSharedTargets; i++ {
+		wanted[d.iscsiSharedTargetName(portalID, i)] = true
+	}
+
+	existingTargets, err := FindAllISCSITargets(ctx, d.storage, func(target tnclient.ISCSITarget) bool {
+		return wanted[target.GetName()]
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for existing shared iSCSI targets: %w", err)
+	}
+
+	result := make(map[int32]string, d.iscsiSharedTargets)
+	for _, target := range existingTargets {
+		result[target.GetId()] = target.GetName()
+		delete(wanted, target.GetName())
+	}
+	if len(wanted) == 0 {
+		return result, nil
+	}
+
+	existingInitiator, initiatorExists, err := FindISCSIInitiator(ctx, d.storage, func(initiator tnclient.ISCSIInitiator) bool {
+		return initiator.GetComment() == iscsiSharedInitiatorComment
+	}, FilterEqual("comment", iscsiSharedInitiatorComment))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for existing shared iSCSI initiator: %w", err)
+	}
+
+	initiatorID := existingInitiator.Id
+	if !initiatorExists {
+		klog.V(5).Info("[Debug] shared iSCSI initiator does not exist, creating")
+		initiatorResponse, err2 := d.storage.createISCSIInitiator(ctx, tnclient.CreateISCSIInitiatorParams{
+			Comment: tnclient.PtrString(iscsiSharedInitiatorComment),
+		})
+		if err2 != nil {
+			return nil, fmt.Errorf("failed to create shared iSCSI initiator: %w", err2)
+		}
+		initiatorID = initiatorResponse.Id
+	}
+
+	for name := range wanted {
+		klog.V(5).InfoS("[Debug] shared iSCSI target does not exist, creating", "targetName", name)
+		targetResponse, err2 := d.storage.createISCSITarget(ctx, tnclient.CreateISCSITargetParams{
+			Name:  name,
+			Alias: *tnclient.NewNullableString(tnclient.PtrString(name + ": Kubernetes managed shared iSCSI target")),
+			Mode:  tnclient.PtrString("ISCSI"),
+			Groups: []tnclient.CreateISCSITargetParamsGroupsInner{
+				{
+					Portal:     portalID,
+					Initiator:  tnclient.PtrInt32(initiatorID),
+					Authmethod: "NONE",
+				},
+			},
+		})
+		if err2 != nil {
+			return nil, fmt.Errorf("failed to create shared iSCSI target %s: %w", name, err2)
+		}
+		result[targetResponse.GetId()] = name
+	}
+
+	return result, nil
+}
+
+// iscsiMapSharedLUN maps an extent into the least used shared target on a portal, returning the target name and
+// allocated LUN. If the extent is already mapped to a shared target then that mapping is returned.
+func (d *Driver) iscsiMapSharedLUN(ctx context.Context, portalID, extentID int32) (string, int32, error) {
+	// LUN IDs are allocated by looking at what is in use, so only one allocation can be in flight at a time. This only
+	// covers this process, allocations made elsewhere are caught by iscsiSharedLUNTaken after mapping.
+	d.iscsiLUNMu.Lock()
+	defer d.iscsiLUNMu.Unlock()
+
+	var lastErr error
+	for attempt := 0; attempt < iscsiSharedLUNAttempts; attempt++ {
+		targets, err := d.iscsiEnsureSharedTargets(ctx, portalID)
+		if err != nil {
+			return "", 0, err
+		}
+
+		targetExtents, err := FindAllISCSITargetExtents(ctx, d.storage, func(targetExtent tnclient.ISCSITargetExtent) bool {
+			_, exists := targets[targetExtent.GetTarget()]
+			return exists
+		})
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to look for existing iSCSI target extents: %w", err)
+		}
+
+		usedLUNs := make(map[int32]map[int32]bool, len(targets))
+		for targetID := range targets {
+			usedLUNs[targetID] = make(map[int32]bool)
+		}
+		for _, targetExtent := range targetExtents {
+			if targetExtent.GetExtent() == extentID {
+				klog.V(5).Info("[Debug] iSCSI extent already mapped to shared target, skipping")
+				return targets[targetExtent.GetTarget()], targetExtent.GetLunid(), nil
+			}
+			usedLUNs[targetExtent.GetTarget()][targetExtent.GetLunid()] = true
+		}
+
+		// Pick the target with the fewest LUNs, falling back to the lowest name so the choice is stable
+		targetID := int32(-1)
+		for id, luns := range usedLUNs {
+			if len(luns) >= iscsiSharedTargetMaxLUNs {
+				continue
+			}
+			if targetID == -1 || len(luns) < len(usedLUNs[targetID]) ||
+				(len(luns) == len(usedLUNs[targetID]) && targets[id] < targets[targetID]) {
+				targetID = id
+			}
+		}
+		if targetID == -1 {
+			return "", 0, fmt.Errorf("all %d shared iSCSI targets have %d LUNs mapped", len(targets), iscsiSharedTargetMaxLUNs)
+		}
+
+		lun := int32(0)
+		for usedLUNs[targetID][lun] {
+			lun++
+		}
+
+		klog.V(5).InfoS("[Debug] mapping iSCSI extent to shared target", "extentID", extentID, "targetName", targets[targetID], "lun", lun)
+		created, err := d.storage.createISCSITargetExtent(ctx, tnclient.CreateISCSITargetExtentParams{
+			Target: targetID,
+			Extent: extentID,
+			Lunid:  *tnclient.NewNullableInt32(tnclient.PtrInt32(lun)),
+		})
+		if err != nil {
+			// Something outside of this driver may have grabbed the LUN, look again
+			klog.ErrorS(err, "failed to map iSCSI extent to shared target", "extentID", extentID, "targetID", targetID, "lun", lun, "attempt", attempt)
+			lastErr = err
+			continue
+		}
+
+		taken, err := d.iscsiSharedLUNTaken(ctx, created)
+		if err != nil {
+			return "", 0, err
+		}
+		if !taken {
+			return targets[targetID], lun, nil
+		}
+
+		klog.InfoS("iSCSI LUN was mapped concurrently by someone else, unmapping and retrying", "extentID", extentID, "targetID", targetID, "lun", lun, "attempt", attempt)
+		if err = d.storage.deleteISCSITargetExtent(ctx, created.GetId()); err != nil {
+			return "", 0, fmt.Errorf("failed to unmap iSCSI extent %d from LUN %d taken concurrently: %w", extentID, lun, err)
+		}
+		lastErr = fmt.Errorf("LUN %d of shared target %s was taken concurrently", lun, targets[targetID])
+	}
+
+	return "", 0, fmt.Errorf("failed to map iSCSI extent %d to a shared target: %w", extentID, lastErr)
+}
+
+// iscsiSharedLUNTaken checks whether another mapping got the same LUN of the target while this one was being made. Of
+// two mappings racing for a LUN, the one created later gives it up.
+func (d *Driver) iscsiSharedLUNTaken(ctx context.Context, mapping tnclient.ISCSITargetExtent) (bool, error) {
+	_, taken, err := FindISCSITargetExtent(ctx, d.storage, func(targetExtent tnclient.ISCSITargetExtent) bool {
+		return targetExtent.GetTarget() == mapping.GetTarget() && targetExtent.GetLunid() == mapping.GetLunid() &&
+			targetExtent.GetId() < mapping.GetId()
+	}, FilterEqual("target", strconv.Itoa(int(mapping.GetTarget()))), FilterEqual("lunid", strconv.Itoa(int(mapping.GetLunid()))))
+	if err != nil {
+		return false, fmt.Errorf("failed to check iSCSI LUN %d is not mapped twice: %w", mapping.GetLunid(), err)
+	}
+	return taken, nil
+}
+
+// iscsiTargetInUse checks the persisted connectors on this node for any other volume logged in to the same target,
+// in which case the session must outlive the volume being detached. A connector which can't be read may be for the
+// same target, so that is an error rather than a guess.
+func (d *Driver) iscsiTargetInUse(volumeID, targetIqn string) (bool, error) {
+	entries, err := os.ReadDir(d.iscsiConfigDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to list iSCSI config dir %s: %w", d.iscsiConfigDir, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == volumeID+".json" || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(d.iscsiConfigDir, entry.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Detached in the meantime
+				continue
+			}
+			return false, fmt.Errorf("failed to read iSCSI connector %s: %w", entry.Name(), err)
+		}
+
+		var connector struct {
+			TargetIqn string `json:"target_iqn"`
+		}
+		if err = json.Unmarshal(data, &connector); err != nil {
+			return false, fmt.Errorf("failed to parse iSCSI connector %s: %w", entry.Name(), err)
+		}
+
+		if connector.TargetIqn == targetIqn {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// iscsiRescanSessions rescans the sessions this node already has to a target, so a LUN mapped into a shared target
+// after logging in to it shows up.
+func iscsiRescanSessions(executor exec.Interface, targetIqn string) {
+	sessions, err := iscsiLib.GetSessions()
+	if err != nil {
+		// iscsiadm fails when there are no sessions at all
+		klog.V(4).InfoS("failed to list iSCSI sessions", "err", err)
+		return
+	}
+
+	// Lines look like: tcp: [3] 10.0.0.1:3260,1 iqn.2005-10.org.freenas.ctl:iscsi-shared-0 (non-flash)
+	for _, line := range strings.Split(sessions, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] != targetIqn {
+			continue
+		}
+		sessionID := strings.Trim(fields[1], "[]")
+		klog.V(4).InfoS("rescanning iSCSI session", "targetIqn", targetIqn, "sessionID", sessionID)
+		if out, err := executor.Command("iscsiadm", "-m", "session", "-r", sessionID, "-R").CombinedOutput(); err != nil {
+			klog.ErrorS(err, "failed to rescan iSCSI session", "sessionID", sessionID, "output", string(out))
+		}
+	}
+}
+
+// deleteSCSIDevices removes the SCSI devices of a detached LUN whose session is kept, as only logging out of the
+// session would get rid of them otherwise. Devices which are already gone are skipped.
+func deleteSCSIDevices(devices ...iscsiLib.Device) error {
+	for _, device := range devices {
+		if device.Type == "mpath" || device.Name == "" {
+			continue
+		}
+		deletePath := filepath.Join("/sys/block", device.Name, "device", "delete")
+		if _, err := os.Stat(deletePath); os.IsNotExist(err) {
+			continue
+		}
+		klog.V(4).InfoS("deleting SCSI device", "device", device.Name)
+		if err := os.WriteFile(deletePath, []byte("1"), 0o200); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete SCSI device %s: %w", device.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sharedLUN returns the target and LUN a volume was mapped to.
+func sharedLUN(volume *csi.Volume) [2]string {
+	return [2]string{volume.GetVolumeContext()[ISCSIVolumeContextIQN], volume.GetVolumeContext()[ISCSIVolumeContextLUN]}
+}
+
+func TestISCSISharedTargetsAllocateLUNs(t *testing.T) {
+	d, storage := newTestDriver(t, TypeISCSI)
+	d.iscsiSharedTargets = 1
+
+	first := createTwice(t, d, createVolumeRequest("pvc-1", nil))
+	second := createTwice(t, d, createVolumeRequest("pvc-2", nil))
+	if first.GetVolumeContext()[ISCSIVolumeContextIQN] != second.GetVolumeContext()[ISCSIVolumeContextIQN] {
+		t.Errorf("volumes are on different targets, %q and %q", first.GetVolumeContext()[ISCSIVolumeContextIQN], second.GetVolumeContext()[ISCSIVolumeContextIQN])
+	}
+	if got := []string{first.GetVolumeContext()[ISCSIVolumeContextLUN], second.GetVolumeContext()[ISCSIVolumeContextLUN]}; !reflect.DeepEqual(got, []string{"0", "1"}) {
+		t.Errorf("LUNs = %v, want [0 1]", got)
+	}
+
+	// The shared target outlives its volumes
+	deleteTwice(t, d, first.GetVolumeId())
+	deleteTwice(t, d, second.GetVolumeId())
+	if got, want := iscsiObjectCounts(storage), [4]int{0, 1, 1, 0}; got != want {
+		t.Errorf("got %v iSCSI objects left, want %v", got, want)
+	}
+}
+
+func TestISCSISharedTargetsReuseFreedLUNs(t *testing.T) {
+	d, _ := newTestDriver(t, TypeISCSI)
+	d.iscsiSharedTargets = 1
+
+	first := createTwice(t, d, createVolumeRequest("pvc-1", nil))
+	createTwice(t, d, createVolumeRequest("pvc-2", nil))
+	deleteTwice(t, d, first.GetVolumeId())
+
+	third := createTwice(t, d, createVolumeRequest("pvc-3", nil))
+	if got := third.GetVolumeContext()[ISCSIVolumeContextLUN]; got != "0" {
+		t.Errorf("LUN = %s, want the freed LUN 0", got)
+	}
+}
+
+func TestISCSISharedTargetsSpreadLUNs(t *testing.T) {
+	d, storage := newTestDriver(t, TypeISCSI)
+	d.iscsiSharedTargets = 2
+
+	iqn := "iqn.2005-10.org.freenas.ctl:" + ISCSISharedTargetPrefix
+	want := [][2]string{{iqn + "0", "0"}, {iqn + "1", "0"}, {iqn + "0", "1"}}
+	for i, name := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		if got := sharedLUN(createTwice(t, d, createVolumeRequest(name, nil))); got != want[i] {
+			t.Errorf("%s mapped to %v, want %v", name, got, want[i])
+		}
+	}
+	// Both targets share the one initiator group
+	if got, want := iscsiObjectCounts(storage), [4]int{3, 1, 2, 3}; got != want {
+		t.Errorf("got %v iSCSI objects, want %v", got, want)
+	}
+}
+
+func TestISCSISharedTargetsRetryFailedMapping(t *testing.T) {
+	d, storage := newTestDriver(t, TypeISCSI)
+	d.iscsiSharedTargets = 1
+	storage.failOnce["createISCSITargetExtent"] = errors.New("LUN 0 is already in use")
+
+	volume := createTwice(t, d, createVolumeRequest("pvc-1", nil))
+	if got := volume.GetVolumeContext()[ISCSIVolumeContextLUN]; got != "0" {
+		t.Errorf("LUN = %s, want 0", got)
+	}
+	if got := storage.calls["createISCSITargetExtent"]; got != 2 {
+		t.Errorf("mapping was made %d times, want 2", got)
+	}
+}
+
+func TestISCSISharedTargetsGiveUpMapping(t *testing.T) {
+	d, storage := newTestDriver(t, TypeISCSI)
+	d.iscsiSharedTargets = 1
+	storage.failures["createISCSITargetExtent"] = errors.New("LUN 0 is already in use")
+
+	if _, err := d.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil)); status.Code(err) != codes.Internal {
+		t.Fatalf("CreateVolume returned %v, want Internal", err)
+	}
+	if got := storage.calls["createISCSITargetExtent"]; got != iscsiSharedLUNAttempts {
+		t.Errorf("mapping was made %d times, want %d", got, iscsiSharedLUNAttempts)
+	}
+	// The zvol and extent are rolled back, the shared target stays for the next volume
+	if _, ok := storage.datasets["tank/iscsi/"+ISCSIVolumePrefix+"pvc-1"]; ok {
+		t.Error("zvol wasn't rolled back")
+	}
+	if got, want := iscsiObjectCounts(storage), [4]int{0, 1, 1, 0}; got != want {
+		t.Errorf("got %v iSCSI objects, want %v", got, want)
+	}
+}
+
+func TestISCSISharedTargetName(t *testing.T) {
+	d := &Driver{portalID: 1}
+
+	if got := d.iscsiSharedTargetName(1, 3); got != "iscsi-shared-3" {
+		t.Errorf("target of the default portal is named %q, want iscsi-shared-3", got)
+	}
+	if got := d.iscsiSharedTargetName(2, 3); got != "iscsi-shared-p2-3" {
+		t.Errorf("target of another portal is named %q, want iscsi-shared-p2-3", got)
+	}
+}
@@ -2,7 +2,9 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"strconv"
 	"strings"
@@ -66,6 +68,14 @@ func nfsCheckCaps(caps []*csi.VolumeCapability) error {
 }
 
 func (d *Driver) nfsCreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	switch mode := req.GetParameters()[NFSParamProvisioningMode]; mode {
+	case "", NFSProvisioningDataset:
+	case NFSProvisioningSubdir:
+		return d.nfsSubdirCreateVolume(ctx, req)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "%s must be %s or %s: %q", NFSParamProvisioningMode, NFSProvisioningDataset, NFSProvisioningSubdir, mode)
+	}
+
 	// Validate NFS capabilities
 	if err := nfsCheckCaps(req.GetVolumeCapabilities()); err != nil {
 		klog.ErrorS(err, "invalid volume capabilities")
@@ -85,13 +95,35 @@ func (d *Driver) nfsCreateVolume(ctx context.Context, req *csi.CreateVolumeReque
 	sizeGB := size / (1 * giB)
 	klog.V(5).InfoS("[Debug] Raw size requested in gigabytes", "rawSizeGibibytes", sizeGB)
 
+	access, accessProperties, err := d.nfsAccessForVolume(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	shareOptions, err := d.nfsShareOptionsForVolume(ctx, req.GetParameters())
+	if err != nil {
+		klog.ErrorS(err, "invalid NFS share options")
+		return nil, err
+	}
+	mountOptions, err := nfsMountOptionsForVolume(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	servers, err := d.nfsServersForVolume(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	permissions, err := parseNFSDatasetPermissions(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	datasetName := strings.Join([]string{d.nfsStoragePath, volumeID}, "/")
 	datasetMountpoint := ""
 
 	// Look for existing dataset
-	existingDataset, datasetExists, err := FindDataset(ctx, d.client, func(dataset tnclient.Dataset) bool {
+	existingDataset, datasetExists, err := FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
 		return dataset.GetName() == datasetName
-	})
+	}, FilterEqual("name", datasetName))
 	if err != nil {
 		klog.ErrorS(err, "failed to look for existing datasets")
 		return nil, status.Errorf(codes.Internal, "failed to look for existing datasets: %v", err)
@@ -103,15 +135,17 @@ func (d *Driver) nfsCreateVolume(ctx context.Context, req *csi.CreateVolumeReque
 	} else {
 		klog.V(5).Info("[Debug] Dataset does not exist, creating")
 
-		datasetRequest := d.client.DatasetAPI.CreateDataset(ctx).CreateDatasetParams(tnclient.CreateDatasetParams{
-			Name:              datasetName,
-			Casesensitivity:   tnclient.PtrString("SENSITIVE"),
-			Copies:            tnclient.PtrInt32(1),
-			InheritEncryption: tnclient.PtrBool(true),
-			ShareType:         tnclient.PtrString("GENERIC"),
-			Refquota:          tnclient.PtrInt64(size),
+		datasetProperties := permissions.datasetProperties()
+		datasetProperties["user_properties"] = DatasetUserProperties(accessProperties)
+		datasetResponse, err2 := d.storage.createDataset(ctx, tnclient.CreateDatasetParams{
+			Name:                 datasetName,
+			Casesensitivity:      tnclient.PtrString("SENSITIVE"),
+			Copies:               tnclient.PtrInt32(1),
+			InheritEncryption:    tnclient.PtrBool(true),
+			ShareType:            tnclient.PtrString("GENERIC"),
+			Refquota:             tnclient.PtrInt64(size),
+			AdditionalProperties: datasetProperties,
 		})
-		datasetResponse, _, err2 := datasetRequest.Execute()
 		if err2 != nil {
 			klog.ErrorS(err2, "failed to create dataset", "datasetName", datasetName)
 			return nil, err2
@@ -119,42 +153,31 @@ func (d *Driver) nfsCreateVolume(ctx context.Context, req *csi.CreateVolumeReque
 		datasetMountpoint = datasetResponse.GetMountpoint()
 	}
 
-	_, shareExists, err := FindNFSShare(ctx, d.client, func(share tnclient.ShareNFS) bool {
-		return NormaliseNFSShareMountpaths(share) == datasetMountpoint
-	})
+	_, shareExists, err := FindNFSShare(ctx, d.storage, func(share tnclient.ShareNFS) bool {
+		return d.nfsShares.path(share) == datasetMountpoint
+	}, d.nfsShares.pathFilters(datasetMountpoint)...)
 	if err != nil {
 		klog.ErrorS(err, "failed to look for existing NFS shares")
 		return nil, status.Errorf(codes.Internal, "failed to look for existing NFS shares: %v", err)
 	}
 
 	if !shareExists {
-		sharingRequest := d.client.SharingAPI.CreateShareNFS(ctx).CreateShareNFSParams(tnclient.CreateShareNFSParams{
-			Path:         tnclient.PtrString(datasetMountpoint),
-			Comment:      tnclient.PtrString(fmt.Sprintf("Share for Kubernetes PV %s", req.GetName())),
-			Enabled:      tnclient.PtrBool(true),
-			Ro:           tnclient.PtrBool(false),
-			MaprootGroup: tnclient.PtrString("root"),
-			MaprootUser:  tnclient.PtrString("root"),
-			// Can't use additionalProperties
-		})
-		_, _, err = sharingRequest.Execute()
-
-		// TODO Remove on next major version
-		// Fall back to older API (no api versioning, see https://github.com/terricain/truenas-scale-csi/pull/4)
-		if err != nil && strings.Contains(err.Error(), "422 Unprocessable Entity") {
-			sharingRequest = d.client.SharingAPI.CreateShareNFS(ctx).CreateShareNFSParams(tnclient.CreateShareNFSParams{
-				Paths:        []string{datasetMountpoint},
-				Comment:      tnclient.PtrString(fmt.Sprintf("Share for Kubernetes PV %s", req.GetName())),
-				Enabled:      tnclient.PtrBool(true),
-				Ro:           tnclient.PtrBool(false),
-				MaprootGroup: tnclient.PtrString("root"),
-				MaprootUser:  tnclient.PtrString("root"),
-				// Can't use additionalProperties
-			})
-			_, _, err = sharingRequest.Execute()
+		// Done whenever the share is missing so a retry after a failure here still sets them
+		if err = d.nfsSetDatasetPermissions(ctx, datasetMountpoint, permissions); err != nil {
+			klog.ErrorS(err, "failed to set dataset permissions", "datasetName", datasetName)
+			return nil, status.Error(codes.Internal, err.Error())
 		}
 
-		if err != nil {
+		shareParams := tnclient.CreateShareNFSParams{
+			Comment:  tnclient.PtrString(fmt.Sprintf("Share for Kubernetes PV %s", req.GetName())),
+			Enabled:  tnclient.PtrBool(true),
+			Networks: access.networks,
+			Hosts:    access.hosts,
+			// Can't use additionalProperties
+		}
+		d.nfsShares.setPath(&shareParams, datasetMountpoint)
+		shareOptions.apply(&shareParams)
+		if err = d.storage.createNFSShare(ctx, shareParams); err != nil {
 			klog.ErrorS(err, "failed to create NFS share", "datasetName", datasetName, "mountpoint", datasetMountpoint)
 			return nil, err
 		}
@@ -166,11 +189,13 @@ func (d *Driver) nfsCreateVolume(ctx context.Context, req *csi.CreateVolumeReque
 			CapacityBytes: size,
 			VolumeContext: map[string]string{
 				NFSVolumeContextParamMountPoint: datasetMountpoint,
-				NFSVolumeContextParamHost:       d.address,
-				// "options": "",
+				NFSVolumeContextParamHost:       servers,
 			},
 		},
 	}
+	if len(mountOptions) > 0 {
+		resp.Volume.VolumeContext[NFSVolumeContextParamOptions] = strings.Join(mountOptions, ",")
+	}
 
 	return resp, nil
 }
@@ -180,20 +205,23 @@ func (d *Driver) nfsDeleteVolume(ctx context.Context, req *csi.DeleteVolumeReque
 	if !strings.HasPrefix(volumeID, NFSVolumePrefix) {
 		return status.Errorf(codes.NotFound, "Volume ID %s not found", volumeID)
 	}
+	if strings.HasPrefix(volumeID, NFSSubdirVolumePrefix) {
+		return d.nfsSubdirDeleteVolume(ctx, volumeID)
+	}
 
 	// Deleting the dataset will remove the NFS share :)
 	datasetName := strings.Join([]string{d.nfsStoragePath, volumeID}, "/")
 
-	existingDataset, datasetExists, err := FindDataset(ctx, d.client, func(dataset tnclient.Dataset) bool {
+	existingDataset, datasetExists, err := FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
 		return dataset.GetName() == datasetName
-	})
+	}, FilterEqual("name", datasetName))
 	if err != nil {
 		klog.ErrorS(err, "failed to look for existing datasets")
 		return err
 	}
 
 	if datasetExists {
-		_, err = d.client.DatasetAPI.DeleteDataset(ctx, existingDataset.GetId()).Execute()
+		err = d.storage.deleteDataset(ctx, existingDataset.GetId())
 		if err != nil {
 			klog.ErrorS(err, "failed to delete Dataset", "datasetID", existingDataset.GetId())
 			return err
@@ -230,13 +258,22 @@ func (d *Driver) nfsValidateVolumeCapabilities(ctx context.Context, req *csi.Val
 		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("%s, %s keys missing from volume context", NFSVolumeContextParamHost, NFSVolumeContextParamMountPoint))
 	}
 
-	// Look for existing dataset
-	_, datasetExists, err := FindDataset(ctx, d.client, func(dataset tnclient.Dataset) bool {
-		return dataset.GetName() == datasetName
-	})
-	if err != nil {
-		klog.ErrorS(err, "failed to look for existing datasets")
-		return nil, status.Errorf(codes.Internal, "failed to look for existing datasets: %v", err)
+	// Look for existing dataset, or directory for subdirectory volumes
+	var datasetExists bool
+	var err error
+	if strings.HasPrefix(volumeID, NFSSubdirVolumePrefix) {
+		datasetExists, err = d.nfsSubdirVolumeExists(ctx, volumeID)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		_, datasetExists, err = FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+			return dataset.GetName() == datasetName
+		}, FilterEqual("name", datasetName))
+		if err != nil {
+			klog.ErrorS(err, "failed to look for existing datasets")
+			return nil, status.Errorf(codes.Internal, "failed to look for existing datasets: %v", err)
+		}
 	}
 
 	if !datasetExists {
@@ -259,7 +296,7 @@ func (d *Driver) nfsValidateVolumeCapabilities(ctx context.Context, req *csi.Val
 }
 
 func (d *Driver) nfsGetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) { //nolint:unparam
-	resp, _, err := d.client.DatasetAPI.GetDataset(ctx, d.nfsStoragePath).Execute()
+	resp, err := d.storage.getDataset(ctx, d.nfsStoragePath)
 	if err != nil {
 		klog.ErrorS(err, "failed to get dataset", "datasetID", d.nfsStoragePath)
 		return nil, status.Errorf(codes.Internal, "Failed to get NFS dataset: %s", err.Error())
@@ -281,9 +318,9 @@ func (d *Driver) nfsGetCapacity(ctx context.Context, req *csi.GetCapacityRequest
 func (d *Driver) nfsListVolumes(ctx context.Context) ([]*csi.ListVolumesResponse_Entry, error) {
 	// Get all mountpoints that are part of Kube datasets
 	nfsStoragePrefix := d.nfsStoragePath + "/"
-	datasets, err := FindAllDatasets(ctx, d.client, func(dataset tnclient.Dataset) bool {
+	datasets, err := FindAllDatasets(ctx, d.storage, func(dataset tnclient.Dataset) bool {
 		return strings.HasPrefix(dataset.GetName(), nfsStoragePrefix)
-	})
+	}, FilterPrefix("name", nfsStoragePrefix))
 	if err != nil {
 		klog.ErrorS(err, "failed to get list of datasets")
 		return nil, err
@@ -295,8 +332,8 @@ func (d *Driver) nfsListVolumes(ctx context.Context) ([]*csi.ListVolumesResponse
 		mountpointDataset[dataset.GetMountpoint()] = ds
 	}
 
-	shares, err := FindAllNFSShares(ctx, d.client, func(share tnclient.ShareNFS) bool {
-		path := NormaliseNFSShareMountpaths(share)
+	shares, err := FindAllNFSShares(ctx, d.storage, func(share tnclient.ShareNFS) bool {
+		path := d.nfsShares.path(share)
 		if len(path) == 0 {
 			return false
 		}
@@ -312,7 +349,7 @@ func (d *Driver) nfsListVolumes(ctx context.Context) ([]*csi.ListVolumesResponse
 	result := make([]*csi.ListVolumesResponse_Entry, 0)
 
 	for _, share := range shares {
-		path := NormaliseNFSShareMountpaths(share)
+		path := d.nfsShares.path(share)
 		dataset := mountpointDataset[path] // we know this exists by this point
 		volumeID := strings.TrimPrefix(dataset.GetName(), nfsStoragePrefix)
 
@@ -331,7 +368,11 @@ func (d *Driver) nfsListVolumes(ctx context.Context) ([]*csi.ListVolumesResponse
 		})
 	}
 
-	return result, nil
+	subdirVolumes, err := d.nfsSubdirListVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, subdirVolumes...), nil
 }
 
 func (d *Driver) nfsNodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) { //nolint:unparam
@@ -339,26 +380,28 @@ func (d *Driver) nfsNodePublishVolume(ctx context.Context, req *csi.NodePublishV
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
 
-	mountOptions := volCap.GetMount().GetMountFlags()
-	if req.GetReadonly() {
-		mountOptions = append(mountOptions, "ro")
-	}
-
-	// Conditionally allow nolock if specified by environment variable
-	if os.Getenv("NFS_NOLOCK") == "true" {
-		mountOptions = append(mountOptions, "nolock")
-	}
-
 	var server, baseDir string
+	// Options from the volume context go first so the capability's mount flags win
+	mountOptions := make([]string, 0)
 	for k, v := range req.GetVolumeContext() {
 		switch k {
 		case NFSVolumeContextParamHost:
 			server = v
 		case NFSVolumeContextParamMountPoint:
 			baseDir = v
+		case NFSVolumeContextParamOptions:
+			mountOptions = append(mountOptions, SplitList(v)...)
 		}
 	}
 
+	mountOptions = append(mountOptions, volCap.GetMount().GetMountFlags()...)
+	if req.GetReadonly() {
+		mountOptions = append(mountOptions, "ro")
+	}
+	if d.nfsNoLock {
+		mountOptions = append(mountOptions, "nolock")
+	}
+
 	if server == "" {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", NFSVolumeContextParamHost))
 	}
@@ -366,12 +409,22 @@ func (d *Driver) nfsNodePublishVolume(ctx context.Context, req *csi.NodePublishV
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", NFSVolumeContextParamMountPoint))
 	}
 
-	server = getServerFromSource(server)
-	source := fmt.Sprintf("%s:%s", server, baseDir)
+	// Servers are tried in order until one mounts
+	servers := SplitList(server)
+	if len(servers) == 0 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", NFSVolumeContextParamHost))
+	}
 
 	notMnt, err := d.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if mountutils.IsCorruptedMnt(err) {
+			// Left behind by the server rebooting or the dataset being re-created, mount it afresh
+			klog.InfoS("unmounting stale NFS volume", "volumeID", volumeID, "targetPath", targetPath, "err", err)
+			if err = d.nfsForceUnmount(targetPath); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to unmount stale volume at %s: %v", targetPath, err)
+			}
+			notMnt = true
+		} else if os.IsNotExist(err) {
 			if err = os.MkdirAll(targetPath, os.FileMode(0o777)); err != nil {
 				return nil, status.Error(codes.Internal, err.Error())
 			}
@@ -384,8 +437,20 @@ func (d *Driver) nfsNodePublishVolume(ctx context.Context, req *csi.NodePublishV
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	klog.V(5).InfoS("[Debug] mounting options", "volumeID", volumeID, "nfsSource", source, "targetPath", targetPath, "mountOptions", mountOptions)
-	err = d.mounter.Mount(source, targetPath, "nfs", mountOptions)
+	var source string
+	for _, server = range servers {
+		source = fmt.Sprintf("%s:%s", getServerFromSource(server), baseDir)
+		klog.V(5).InfoS("[Debug] mounting options", "volumeID", volumeID, "nfsSource", source, "targetPath", targetPath, "mountOptions", mountOptions)
+		err = d.nfsMount(ctx, source, targetPath, mountOptions)
+		if err == nil {
+			break
+		}
+		if statusErr := timeoutStatus(err, "mount "+source); statusErr != nil {
+			klog.ErrorS(err, "timed out mounting NFS volume", "volumeID", volumeID, "nfsSource", source, "targetPath", targetPath)
+			return nil, statusErr
+		}
+		klog.ErrorS(err, "failed to mount NFS volume", "volumeID", volumeID, "nfsSource", source, "targetPath", targetPath)
+	}
 	if err != nil {
 		if os.IsPermission(err) {
 			return nil, status.Error(codes.PermissionDenied, err.Error())
@@ -396,6 +461,20 @@ func (d *Driver) nfsNodePublishVolume(ctx context.Context, req *csi.NodePublishV
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	if group := volCap.GetMount().GetVolumeMountGroup(); group != "" && !req.GetReadonly() {
+		if err = nfsApplyMountGroup(targetPath, group); err != nil {
+			klog.ErrorS(err, "failed to apply volume mount group", "volumeID", volumeID, "targetPath", targetPath, "group", group)
+			// Unmount so the retry doesn't find it mounted and skip this
+			if unmountErr := d.nfsUnmount(ctx, targetPath); unmountErr != nil {
+				klog.ErrorS(unmountErr, "failed unmounting volume", "volumeID", volumeID, "targetPath", targetPath)
+			}
+			if errors.Is(err, fs.ErrPermission) {
+				return nil, status.Errorf(codes.PermissionDenied, "%v, the share may be squashing root", err)
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
 	klog.InfoS("mounting NFS volume success", "volumeID", volumeID, "nfsSource", source, "targetPath", targetPath)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -404,9 +483,12 @@ func (d *Driver) nfsNodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpubl
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
 	klog.V(5).InfoS("[Debug] unmounting volume", "volumeID", volumeID, "targetPath", targetPath)
-	err := mountutils.CleanupMountPoint(targetPath, d.mounter, true)
+	err := d.nfsUnmount(ctx, targetPath)
 	if err != nil {
 		klog.ErrorS(err, "failed unmounting volume", "volumeID", volumeID, "targetPath", targetPath)
+		if statusErr := timeoutStatus(err, "unmount "+targetPath); statusErr != nil {
+			return nil, statusErr
+		}
 		return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
 	}
 	klog.InfoS("unmounting NFS volume success", "volumeID", volumeID)
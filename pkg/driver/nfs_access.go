@@ -0,0 +1,157 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+// StorageClass parameters restricting which clients can mount a share, comma separated. When set they replace the
+// lists given to the driver for that volume.
+const (
+	NFSParamAllowedNetworks = "allowedNetworks"
+	NFSParamAllowedHosts    = "allowedHosts"
+)
+
+// ZFS user properties recording the lists a StorageClass set on a volume, so the reconcile leaves them alone.
+const (
+	nfsAllowedNetworksProperty = "truenas-csi:allowed-networks"
+	nfsAllowedHostsProperty    = "truenas-csi:allowed-hosts"
+)
+
+type nfsShareAccess struct {
+	networks []string
+	hosts    []string
+}
+
+// SplitList splits a comma separated list, dropping empty items.
+func SplitList(value string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// ValidateNFSAccess checks networks are in CIDR notation and hosts are single hostnames or IPs.
+func ValidateNFSAccess(networks, hosts []string) error {
+	for _, network := range networks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("allowed network %q is not in CIDR notation", network)
+		}
+	}
+	for _, host := range hosts {
+		if strings.ContainsAny(host, " \t/") {
+			return fmt.Errorf("allowed host %q is not a hostname or IP address", host)
+		}
+	}
+	return nil
+}
+
+// nfsAccessForVolume returns the access lists for a new volume along with the user properties to store on its dataset
+// if the StorageClass overrides the driver's lists.
+func (d *Driver) nfsAccessForVolume(params map[string]string) (nfsShareAccess, map[string]string, error) {
+	access := nfsShareAccess{networks: d.nfsAllowedNetworks, hosts: d.nfsAllowedHosts}
+	properties := make(map[string]string)
+
+	// An empty list falls back to the driver's, as that's what the reconcile would set it to anyway
+	if networks := SplitList(params[NFSParamAllowedNetworks]); len(networks) > 0 {
+		access.networks = networks
+		properties[nfsAllowedNetworksProperty] = strings.Join(networks, ",")
+	}
+	if hosts := SplitList(params[NFSParamAllowedHosts]); len(hosts) > 0 {
+		access.hosts = hosts
+		properties[nfsAllowedHostsProperty] = strings.Join(hosts, ",")
+	}
+
+	if err := ValidateNFSAccess(access.networks, access.hosts); err != nil {
+		return nfsShareAccess{}, nil, err
+	}
+	return access, properties, nil
+}
+
+// nfsAccessForDataset returns the access lists an existing volume should have.
+func (d *Driver) nfsAccessForDataset(dataset tnclient.Dataset) nfsShareAccess {
+	access := nfsShareAccess{networks: d.nfsAllowedNetworks, hosts: d.nfsAllowedHosts}
+	if value := GetDatasetUserProperty(dataset, nfsAllowedNetworksProperty); value != "" {
+		access.networks = SplitList(value)
+	}
+	if value := GetDatasetUserProperty(dataset, nfsAllowedHostsProperty); value != "" {
+		access.hosts = SplitList(value)
+	}
+	return access
+}
+
+func sameList(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// nfsReconcileShareAccess updates the networks and hosts of every share the driver manages which no longer match the
+// configured lists.
+func (d *Driver) nfsReconcileShareAccess(ctx context.Context) {
+	klog.InfoS("reconciling NFS share access", "allowedNetworks", d.nfsAllowedNetworks, "allowedHosts", d.nfsAllowedHosts)
+
+	nfsStoragePrefix := d.nfsStoragePath + "/"
+	datasets, err := FindAllDatasets(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+		return strings.HasPrefix(dataset.GetName(), nfsStoragePrefix)
+	}, FilterPrefix("name", nfsStoragePrefix))
+	if err != nil {
+		klog.ErrorS(err, "failed to get list of datasets, skipping reconcile")
+		return
+	}
+
+	mountpointDataset := make(map[string]tnclient.Dataset)
+	for _, dataset := range datasets {
+		mountpointDataset[dataset.GetMountpoint()] = dataset
+	}
+
+	shares, err := FindAllNFSShares(ctx, d.storage, func(share tnclient.ShareNFS) bool {
+		_, exists := mountpointDataset[d.nfsShares.path(share)]
+		return exists
+	})
+	if err != nil {
+		klog.ErrorS(err, "failed to get list of NFS shares, skipping reconcile")
+		return
+	}
+
+	for _, share := range shares {
+		dataset := mountpointDataset[d.nfsShares.path(share)]
+		access := d.nfsAccessForDataset(dataset)
+		if sameList(share.GetNetworks(), access.networks) && sameList(share.GetHosts(), access.hosts) {
+			continue
+		}
+
+		klog.InfoS("updating NFS share access", "shareID", share.GetId(), "datasetName", dataset.GetName(),
+			"networks", access.networks, "hosts", access.hosts)
+		// Non-nil empty lists so an unrestricted share is sent as such rather than left out
+		err = d.storage.updateNFSShare(ctx, share.GetId(), tnclient.CreateShareNFSParams{
+			Networks: append([]string{}, access.networks...),
+			Hosts:    append([]string{}, access.hosts...),
+		})
+		if err != nil {
+			klog.ErrorS(err, "failed to update NFS share access", "shareID", share.GetId())
+		}
+	}
+
+	klog.InfoS("finished reconciling NFS share access")
+}
@@ -0,0 +1,92 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NFSVolumeContextParamOptions holds the comma separated mount options the node mounts the share with.
+const NFSVolumeContextParamOptions = "options"
+
+// StorageClass parameters setting NFS mount options, passed on to nodes in the volume context. Mount options on the
+// StorageClass itself are applied after these, so take precedence.
+const (
+	NFSParamVersion  = "nfsVersion" // 3, 4, 4.0, 4.1 or 4.2
+	NFSParamProto    = "nfsProto"   // tcp, udp or rdma
+	NFSParamRsize    = "nfsRsize"
+	NFSParamWsize    = "nfsWsize"
+	NFSParamTimeo    = "nfsTimeo" // tenths of a second
+	NFSParamRetrans  = "nfsRetrans"
+	NFSParamHard     = "nfsHard" // true for hard, false for soft
+	NFSParamNconnect = "nfsNconnect"
+)
+
+var (
+	nfsVersions = []string{"3", "4", "4.0", "4.1", "4.2"}
+	nfsProtos   = []string{"tcp", "udp", "rdma"}
+)
+
+// nfsMountOptionsForVolume turns the mount option parameters of a StorageClass into mount options.
+func nfsMountOptionsForVolume(params map[string]string) ([]string, error) {
+	options := make([]string, 0)
+
+	for _, param := range []struct {
+		name    string
+		option  string
+		allowed []string
+	}{
+		{NFSParamVersion, "nfsvers", nfsVersions},
+		{NFSParamProto, "proto", nfsProtos},
+	} {
+		value, ok := params[param.name]
+		if !ok {
+			continue
+		}
+		value = strings.ToLower(value)
+		valid := false
+		for _, allowed := range param.allowed {
+			valid = valid || value == allowed
+		}
+		if !valid {
+			return nil, fmt.Errorf("%s %q is not one of %v", param.name, value, param.allowed)
+		}
+		options = append(options, param.option+"="+value)
+	}
+
+	for _, param := range []struct {
+		name   string
+		option string
+		max    int64
+	}{
+		{NFSParamRsize, "rsize", 1 << 20},
+		{NFSParamWsize, "wsize", 1 << 20},
+		{NFSParamTimeo, "timeo", 6000},
+		{NFSParamRetrans, "retrans", 100},
+		{NFSParamNconnect, "nconnect", 16},
+	} {
+		value, ok := params[param.name]
+		if !ok {
+			continue
+		}
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || number < 1 || number > param.max {
+			return nil, fmt.Errorf("%s must be a number between 1 and %d: %q", param.name, param.max, value)
+		}
+		options = append(options, fmt.Sprintf("%s=%d", param.option, number))
+	}
+
+	if value, ok := params[NFSParamHard]; ok {
+		hard, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false: %q", NFSParamHard, value)
+		}
+		if hard {
+			options = append(options, "hard")
+		} else {
+			options = append(options, "soft")
+		}
+	}
+
+	return options, nil
+}
@@ -0,0 +1,130 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// StorageClass parameters setting the ownership and permissions of the root of new NFS datasets.
+const (
+	NFSParamUID     = "uid"
+	NFSParamGID     = "gid"
+	NFSParamMode    = "mode"    // octal, e.g. 0775
+	NFSParamACLType = "aclType" // POSIX or NFSV4
+)
+
+type nfsDatasetPermissions struct {
+	uid     *int64
+	gid     *int64
+	mode    string // octal without a leading 0, as TrueNAS wants it
+	aclType string
+}
+
+// parseNFSDatasetPermissions validates the permission parameters of a StorageClass.
+func parseNFSDatasetPermissions(params map[string]string) (nfsDatasetPermissions, error) {
+	perms := nfsDatasetPermissions{}
+
+	for param, target := range map[string]**int64{NFSParamUID: &perms.uid, NFSParamGID: &perms.gid} {
+		value, ok := params[param]
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || id < 0 {
+			return nfsDatasetPermissions{}, fmt.Errorf("%s must be a non-negative number: %q", param, value)
+		}
+		*target = &id
+	}
+
+	if value, ok := params[NFSParamMode]; ok {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 0o7777 {
+			return nfsDatasetPermissions{}, fmt.Errorf("%s must be an octal file mode such as 0775: %q", NFSParamMode, value)
+		}
+		perms.mode = strconv.FormatUint(mode, 8)
+	}
+
+	if value, ok := params[NFSParamACLType]; ok {
+		perms.aclType = strings.ToUpper(value)
+		if perms.aclType != "POSIX" && perms.aclType != "NFSV4" {
+			return nfsDatasetPermissions{}, fmt.Errorf("%s must be POSIX or NFSV4: %q", NFSParamACLType, value)
+		}
+	}
+
+	return perms, nil
+}
+
+// datasetProperties returns the properties to create the dataset with for the ACL type.
+func (perms nfsDatasetPermissions) datasetProperties() map[string]interface{} {
+	switch perms.aclType {
+	case "POSIX":
+		// TrueNAS insists on discard with POSIX ACLs
+		return map[string]interface{}{"acltype": "POSIX", "aclmode": "DISCARD"}
+	case "NFSV4":
+		return map[string]interface{}{"acltype": "NFSV4", "aclmode": "PASSTHROUGH"}
+	}
+	return map[string]interface{}{}
+}
+
+// nfsSetDatasetPermissions sets the owner and mode of the dataset's mountpoint, waiting for TrueNAS to finish.
+func (d *Driver) nfsSetDatasetPermissions(ctx context.Context, mountpoint string, perms nfsDatasetPermissions) error {
+	if perms.uid == nil && perms.gid == nil && perms.mode == "" {
+		return nil
+	}
+
+	body := map[string]interface{}{
+		"path": mountpoint,
+		"options": map[string]interface{}{
+			// Only the root of a new dataset, and a mode can't be set on top of a non-trivial ACL
+			"recursive": false,
+			"stripacl":  perms.mode != "",
+		},
+	}
+	if perms.uid != nil {
+		body["uid"] = *perms.uid
+	}
+	if perms.gid != nil {
+		body["gid"] = *perms.gid
+	}
+	if perms.mode != "" {
+		body["mode"] = perms.mode
+	}
+
+	klog.V(5).InfoS("[Debug] setting dataset permissions", "mountpoint", mountpoint, "permissions", body)
+	if err := d.storage.setPermissions(ctx, body); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", mountpoint, err)
+	}
+	return nil
+}
+
+// nfsApplyMountGroup gives the group ownership of the root of a mounted volume, making it group writable. Only the root
+// is changed, files created beneath it inherit the group through setgid.
+func nfsApplyMountGroup(targetPath, group string) error {
+	gid, err := strconv.Atoi(group)
+	if err != nil || gid < 0 {
+		return fmt.Errorf("volume mount group must be a GID: %q", group)
+	}
+
+	info, err := os.Stat(targetPath)
+	if err != nil {
+		return err
+	}
+	mode := info.Mode().Perm() | 0o070 | os.ModeSetgid
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Gid) == gid && info.Mode()&(os.ModePerm|os.ModeSetgid) == mode {
+		return nil
+	}
+
+	if err = os.Chown(targetPath, -1, gid); err != nil {
+		return fmt.Errorf("failed to change group of %s to %d: %w", targetPath, gid, err)
+	}
+	if err = os.Chmod(targetPath, mode); err != nil {
+		return fmt.Errorf("failed to change mode of %s: %w", targetPath, err)
+	}
+	return nil
+}
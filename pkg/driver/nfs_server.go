@@ -0,0 +1,32 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NFSParamServer is a StorageClass parameter overriding the addresses nodes mount shares from, comma separated. Nodes
+// try them in order.
+const NFSParamServer = "nfsServer"
+
+// ValidateNFSServers checks servers are hostnames or IPs without a port.
+func ValidateNFSServers(servers []string) error {
+	for _, server := range servers {
+		if !isHostAddress(server) {
+			return fmt.Errorf("NFS server %q is not a hostname or IP address", server)
+		}
+	}
+	return nil
+}
+
+// nfsServersForVolume returns the addresses a new volume is mounted from, as stored in the volume context.
+func (d *Driver) nfsServersForVolume(params map[string]string) (string, error) {
+	servers := d.nfsServers
+	if value := SplitList(params[NFSParamServer]); len(value) > 0 {
+		if err := ValidateNFSServers(value); err != nil {
+			return "", err
+		}
+		servers = value
+	}
+	return strings.Join(servers, ","), nil
+}
@@ -0,0 +1,149 @@
+package driver
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+// StorageClass parameters controlling how clients are mapped on the share. Users and groups can be given by name or
+// by UID/GID, maproot and mapall can't be combined. Without either root is mapped to root.
+const (
+	NFSParamMaprootUser  = "maprootUser"
+	NFSParamMaprootGroup = "maprootGroup"
+	NFSParamMapallUser   = "mapallUser"
+	NFSParamMapallGroup  = "mapallGroup"
+	NFSParamReadOnly     = "readOnly"
+	NFSParamSecurity     = "security" // comma separated list of sys, krb5, krb5i and krb5p
+)
+
+var nfsSecurityFlavours = []string{"sys", "krb5", "krb5i", "krb5p"}
+
+type nfsShareOptions struct {
+	maprootUser  string
+	maprootGroup string
+	mapallUser   string
+	mapallGroup  string
+	readOnly     bool
+	security     []string
+}
+
+// nfsShareOptionsForVolume validates the share parameters of a StorageClass, resolving users and groups to the names
+// TrueNAS expects.
+func (d *Driver) nfsShareOptionsForVolume(ctx context.Context, params map[string]string) (nfsShareOptions, error) {
+	opts := nfsShareOptions{
+		maprootUser:  params[NFSParamMaprootUser],
+		maprootGroup: params[NFSParamMaprootGroup],
+		mapallUser:   params[NFSParamMapallUser],
+		mapallGroup:  params[NFSParamMapallGroup],
+	}
+
+	maproot := opts.maprootUser != "" || opts.maprootGroup != ""
+	mapall := opts.mapallUser != "" || opts.mapallGroup != ""
+	if maproot && mapall {
+		return nfsShareOptions{}, status.Errorf(codes.InvalidArgument, "%s/%s and %s/%s can't be used together",
+			NFSParamMaprootUser, NFSParamMaprootGroup, NFSParamMapallUser, NFSParamMapallGroup)
+	}
+	if !maproot && !mapall {
+		opts.maprootUser = "root"
+		opts.maprootGroup = "root"
+	}
+
+	if value, ok := params[NFSParamReadOnly]; ok {
+		readOnly, err := strconv.ParseBool(value)
+		if err != nil {
+			return nfsShareOptions{}, status.Errorf(codes.InvalidArgument, "%s must be true or false: %q", NFSParamReadOnly, value)
+		}
+		opts.readOnly = readOnly
+	}
+
+	for _, flavour := range SplitList(params[NFSParamSecurity]) {
+		flavour = strings.ToLower(flavour)
+		valid := false
+		for _, supported := range nfsSecurityFlavours {
+			valid = valid || flavour == supported
+		}
+		if !valid {
+			return nfsShareOptions{}, status.Errorf(codes.InvalidArgument, "%s %q is not one of %v", NFSParamSecurity, flavour, nfsSecurityFlavours)
+		}
+		// TrueNAS wants them in upper case
+		opts.security = append(opts.security, strings.ToUpper(flavour))
+	}
+
+	var err error
+	for _, user := range []*string{&opts.maprootUser, &opts.mapallUser} {
+		if *user == "" || *user == "root" {
+			continue
+		}
+		if *user, err = d.resolveTrueNASUser(ctx, *user); err != nil {
+			return nfsShareOptions{}, err
+		}
+	}
+	for _, group := range []*string{&opts.maprootGroup, &opts.mapallGroup} {
+		if *group == "" || *group == "root" {
+			continue
+		}
+		if *group, err = d.resolveTrueNASGroup(ctx, *group); err != nil {
+			return nfsShareOptions{}, err
+		}
+	}
+
+	return opts, nil
+}
+
+// apply sets the options on share creation parameters.
+func (opts nfsShareOptions) apply(params *tnclient.CreateShareNFSParams) {
+	params.Ro = tnclient.PtrBool(opts.readOnly)
+	if opts.maprootUser != "" {
+		params.MaprootUser = tnclient.PtrString(opts.maprootUser)
+	}
+	if opts.maprootGroup != "" {
+		params.MaprootGroup = tnclient.PtrString(opts.maprootGroup)
+	}
+	if opts.mapallUser != "" {
+		params.MapallUser = tnclient.PtrString(opts.mapallUser)
+	}
+	if opts.mapallGroup != "" {
+		params.MapallGroup = tnclient.PtrString(opts.mapallGroup)
+	}
+	if len(opts.security) > 0 {
+		params.Security = opts.security
+	}
+}
+
+// resolveTrueNASUser returns the name of a TrueNAS user given its name or UID.
+func (d *Driver) resolveTrueNASUser(ctx context.Context, user string) (string, error) {
+	users, err := d.storage.listUsers(ctx)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to list users: %v", err)
+	}
+
+	uid, uidErr := strconv.ParseInt(user, 10, 32)
+	for _, u := range users {
+		if u.GetUsername() == user || (uidErr == nil && u.Uid != nil && u.GetUid() == int32(uid)) {
+			return u.GetUsername(), nil
+		}
+	}
+	return "", status.Errorf(codes.InvalidArgument, "user %q does not exist on TrueNAS", user)
+}
+
+// resolveTrueNASGroup returns the name of a TrueNAS group given its name or GID.
+func (d *Driver) resolveTrueNASGroup(ctx context.Context, group string) (string, error) {
+	groups, err := d.storage.listGroups(ctx)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to list groups: %v", err)
+	}
+
+	gid, gidErr := strconv.ParseInt(group, 10, 32)
+	for _, g := range groups {
+		if g.GetGroup() == group || (gidErr == nil && g.Gid != nil && g.GetGid() == int32(gid)) {
+			return g.GetGroup(), nil
+		}
+	}
+	return "", status.Errorf(codes.InvalidArgument, "group %q does not exist on TrueNAS", group)
+}
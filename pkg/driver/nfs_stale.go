@@ -0,0 +1,18 @@
+package driver
+
+import (
+	"time"
+
+	mount "k8s.io/mount-utils"
+)
+
+// nfsForceUnmountTimeout is how long a normal unmount of a stale mount gets before it's forced.
+const nfsForceUnmountTimeout = 10 * time.Second
+
+// nfsForceUnmount unmounts a target, forcing it if it doesn't unmount in time as happens with stale file handles.
+func (d *Driver) nfsForceUnmount(targetPath string) error {
+	if forceUnmounter, ok := d.mounter.(mount.MounterForceUnmounter); ok {
+		return forceUnmounter.UnmountWithForce(targetPath, nfsForceUnmountTimeout)
+	}
+	return d.mounter.Unmount(targetPath)
+}
@@ -0,0 +1,211 @@
+package driver
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+const (
+	// NFSSubdirVolumePrefix marks volumes which are a directory in the shared dataset rather than a dataset of their
+	// own. It starts with NFSVolumePrefix as they're NFS volumes all the same.
+	NFSSubdirVolumePrefix = NFSVolumePrefix + "subdir-"
+
+	// NFSParamProvisioningMode picks between a dataset and share per volume, the default, or a subdirectory of the
+	// dataset given to the driver with --nfs-subdir-dataset.
+	NFSParamProvisioningMode = "provisioningMode"
+	NFSProvisioningDataset   = "dataset"
+	NFSProvisioningSubdir    = "subdirectory"
+
+	// NFSVolumeContextParamCapacityEnforced is set to false on subdirectory volumes, their size isn't limited.
+	NFSVolumeContextParamCapacityEnforced = "capacityEnforced"
+)
+
+// nfsSubdirUnsupportedParams apply to a dataset or share of its own so can't be used with subdirectories.
+var nfsSubdirUnsupportedParams = []string{
+	NFSParamAllowedNetworks, NFSParamAllowedHosts, NFSParamMaprootUser, NFSParamMaprootGroup, NFSParamMapallUser,
+	NFSParamMapallGroup, NFSParamReadOnly, NFSParamSecurity, NFSParamACLType,
+}
+
+// nfsSubdirNamePattern is what a directory name has to look like, it is joined to the shared mountpoint.
+var nfsSubdirNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// nfsSubdirMountpoint returns the mountpoint of the shared dataset, checking it is shared over NFS.
+func (d *Driver) nfsSubdirMountpoint(ctx context.Context) (string, error) {
+	if d.nfsSubdirDataset == "" {
+		return "", status.Errorf(codes.InvalidArgument, "%s %s needs the driver to be started with --nfs-subdir-dataset", NFSParamProvisioningMode, NFSProvisioningSubdir)
+	}
+
+	dataset, datasetExists, err := FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+		return dataset.GetName() == d.nfsSubdirDataset
+	}, FilterEqual("name", d.nfsSubdirDataset))
+	if err != nil {
+		klog.ErrorS(err, "failed to look for subdirectory dataset", "datasetName", d.nfsSubdirDataset)
+		return "", status.Errorf(codes.Internal, "failed to look for existing datasets: %v", err)
+	}
+	if !datasetExists {
+		return "", status.Errorf(codes.FailedPrecondition, "subdirectory dataset %s does not exist", d.nfsSubdirDataset)
+	}
+
+	mountpoint := dataset.GetMountpoint()
+	_, shareExists, err := FindNFSShare(ctx, d.storage, func(share tnclient.ShareNFS) bool {
+		return d.nfsShares.path(share) == mountpoint
+	}, d.nfsShares.pathFilters(mountpoint)...)
+	if err != nil {
+		klog.ErrorS(err, "failed to look for existing NFS shares")
+		return "", status.Errorf(codes.Internal, "failed to look for existing NFS shares: %v", err)
+	}
+	if !shareExists {
+		return "", status.Errorf(codes.FailedPrecondition, "subdirectory dataset %s is not shared over NFS", d.nfsSubdirDataset)
+	}
+
+	return mountpoint, nil
+}
+
+// pathExists checks for a path on TrueNAS.
+func (d *Driver) pathExists(ctx context.Context, p string) (bool, error) {
+	entries, err := d.storage.listDir(ctx, path.Dir(p), path.Base(p))
+	if err != nil {
+		return false, err
+	}
+	return len(entries) > 0, nil
+}
+
+// nfsSubdirCreateVolume creates a volume as a directory of the shared dataset. Its size isn't enforced.
+func (d *Driver) nfsSubdirCreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if err := nfsCheckCaps(req.GetVolumeCapabilities()); err != nil {
+		klog.ErrorS(err, "invalid volume capabilities")
+		return nil, err
+	}
+
+	if !nfsSubdirNamePattern.MatchString(req.GetName()) {
+		return nil, status.Errorf(codes.InvalidArgument, "volume name %q can't be used as a directory name", req.GetName())
+	}
+	volumeID := NFSSubdirVolumePrefix + req.GetName()
+
+	size, err := extractStorage(req.GetCapacityRange())
+	if err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
+	}
+
+	for _, param := range nfsSubdirUnsupportedParams {
+		if _, ok := req.GetParameters()[param]; ok {
+			return nil, status.Errorf(codes.InvalidArgument, "%s can't be used with %s %s", param, NFSParamProvisioningMode, NFSProvisioningSubdir)
+		}
+	}
+	mountOptions, err := nfsMountOptionsForVolume(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	servers, err := d.nfsServersForVolume(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	permissions, err := parseNFSDatasetPermissions(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	sharedMountpoint, err := d.nfsSubdirMountpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dirPath := path.Join(sharedMountpoint, volumeID)
+
+	exists, err := d.pathExists(ctx, dirPath)
+	if err != nil {
+		klog.ErrorS(err, "failed to look for existing directory", "path", dirPath)
+		return nil, status.Errorf(codes.Internal, "failed to look for existing directory: %v", err)
+	}
+	if exists {
+		klog.V(5).Info("[Debug] Directory exists, skipping")
+	} else {
+		klog.V(5).InfoS("[Debug] Directory does not exist, creating", "path", dirPath)
+		if err = d.storage.mkdir(ctx, dirPath); err != nil {
+			klog.ErrorS(err, "failed to create directory", "path", dirPath)
+			return nil, status.Errorf(codes.Internal, "failed to create directory: %v", err)
+		}
+	}
+
+	// Always applied, there's no share to tell whether a previous attempt got this far
+	if err = d.nfsSetDatasetPermissions(ctx, dirPath, permissions); err != nil {
+		klog.ErrorS(err, "failed to set directory permissions", "path", dirPath)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resp := &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId: volumeID,
+			// The requested size is reported but nothing stops the volume growing past it
+			CapacityBytes: size,
+			VolumeContext: map[string]string{
+				NFSVolumeContextParamMountPoint:       dirPath,
+				NFSVolumeContextParamHost:             servers,
+				NFSVolumeContextParamCapacityEnforced: "false",
+			},
+		},
+	}
+	if len(mountOptions) > 0 {
+		resp.Volume.VolumeContext[NFSVolumeContextParamOptions] = strings.Join(mountOptions, ",")
+	}
+
+	return resp, nil
+}
+
+// nfsSubdirDeleteVolume leaves the directory of a volume in place, it has to be removed on TrueNAS by hand as the API
+// has no way to remove or rename a directory.
+func (d *Driver) nfsSubdirDeleteVolume(_ context.Context, volumeID string) error {
+	klog.InfoS("retaining directory of deleted volume", "volumeID", volumeID, "dataset", d.nfsSubdirDataset)
+	return nil
+}
+
+// nfsSubdirListVolumes lists the volumes in the shared dataset.
+func (d *Driver) nfsSubdirListVolumes(ctx context.Context) ([]*csi.ListVolumesResponse_Entry, error) {
+	result := make([]*csi.ListVolumesResponse_Entry, 0)
+	if d.nfsSubdirDataset == "" {
+		return result, nil
+	}
+
+	sharedMountpoint, err := d.nfsSubdirMountpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := d.storage.listDir(ctx, sharedMountpoint, "")
+	if err != nil {
+		klog.ErrorS(err, "failed to list directories", "path", sharedMountpoint)
+		return nil, status.Errorf(codes.Internal, "failed to list directories: %v", err)
+	}
+
+	for _, entry := range entries {
+		if entry.Type != "DIRECTORY" || !strings.HasPrefix(entry.Name, NFSSubdirVolumePrefix) {
+			continue
+		}
+		result = append(result, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{VolumeId: entry.Name},
+		})
+	}
+	return result, nil
+}
+
+// nfsSubdirVolumeExists checks a subdirectory volume's directory is still there.
+func (d *Driver) nfsSubdirVolumeExists(ctx context.Context, volumeID string) (bool, error) {
+	sharedMountpoint, err := d.nfsSubdirMountpoint(ctx)
+	if err != nil {
+		return false, err
+	}
+	exists, err := d.pathExists(ctx, path.Join(sharedMountpoint, volumeID))
+	if err != nil {
+		klog.ErrorS(err, "failed to look for existing directory", "volumeID", volumeID)
+		return false, status.Errorf(codes.Internal, "failed to look for existing directory: %v", err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,148 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+var subdirParams = map[string]string{NFSParamProvisioningMode: NFSProvisioningSubdir}
+
+// newSubdirTestDriver returns an NFS controller with tank/shared, shared over NFS, as its subdirectory dataset.
+func newSubdirTestDriver(t *testing.T) (*Driver, *fakeStorage) {
+	t.Helper()
+
+	d, storage := newTestDriver(t, TypeNFS)
+	d.nfsSubdirDataset = "tank/shared"
+	storage.addDataset("tank/shared", 100*giB)
+	if err := storage.createNFSShare(context.Background(), tnclient.CreateShareNFSParams{Path: tnclient.PtrString("/mnt/tank/shared")}); err != nil {
+		t.Fatal(err)
+	}
+	return d, storage
+}
+
+func TestNFSSubdirCreateDeleteVolume(t *testing.T) {
+	d, storage := newSubdirTestDriver(t)
+
+	volume := createTwice(t, d, createVolumeRequest("pvc-1", subdirParams))
+	if volume.GetVolumeId() != NFSSubdirVolumePrefix+"pvc-1" {
+		t.Errorf("volume ID = %q, want %q", volume.GetVolumeId(), NFSSubdirVolumePrefix+"pvc-1")
+	}
+	volumeContext := volume.GetVolumeContext()
+	if got, want := volumeContext[NFSVolumeContextParamMountPoint], "/mnt/tank/shared/"+volume.GetVolumeId(); got != want {
+		t.Errorf("mount point = %q, want %q", got, want)
+	}
+	if got := volumeContext[NFSVolumeContextParamCapacityEnforced]; got != "false" {
+		t.Errorf("%s = %q, want false", NFSVolumeContextParamCapacityEnforced, got)
+	}
+	if got := storage.calls["mkdir"]; got != 1 {
+		t.Errorf("directory was made %d times, want 1", got)
+	}
+	// No dataset or share of its own
+	if len(storage.nfsShares) != 1 || storage.calls["createDataset"] != 0 {
+		t.Errorf("got %d shares and %d datasets created, want only the shared dataset's share", len(storage.nfsShares), storage.calls["createDataset"])
+	}
+
+	resp, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	if len(resp.GetEntries()) != 1 || resp.GetEntries()[0].GetVolume().GetVolumeId() != volume.GetVolumeId() {
+		t.Errorf("ListVolumes returned %v, want only %s", resp.GetEntries(), volume.GetVolumeId())
+	}
+
+	// The directory is retained, the API can't remove it
+	deleteTwice(t, d, volume.GetVolumeId())
+	if !storage.dirs["/mnt/tank/shared/"+volume.GetVolumeId()] {
+		t.Error("directory was removed")
+	}
+}
+
+func TestNFSSubdirCreateVolumeInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(d *Driver, storage *fakeStorage)
+		volume   string
+		params   map[string]string
+		wantCode codes.Code
+	}{
+		{
+			name:     "no subdirectory dataset",
+			setup:    func(d *Driver, _ *fakeStorage) { d.nfsSubdirDataset = "" },
+			volume:   "pvc-1",
+			params:   subdirParams,
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "dataset missing",
+			setup:    func(d *Driver, _ *fakeStorage) { d.nfsSubdirDataset = "tank/missing" },
+			volume:   "pvc-1",
+			params:   subdirParams,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name: "dataset not shared",
+			setup: func(_ *Driver, storage *fakeStorage) {
+				storage.nfsShares = make(map[int32]tnclient.ShareNFS)
+			},
+			volume:   "pvc-1",
+			params:   subdirParams,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "not a directory name",
+			volume:   "../pvc-1",
+			params:   subdirParams,
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "share parameter",
+			volume:   "pvc-1",
+			params:   map[string]string{NFSParamProvisioningMode: NFSProvisioningSubdir, NFSParamReadOnly: "true"},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, storage := newSubdirTestDriver(t)
+			if tt.setup != nil {
+				tt.setup(d, storage)
+			}
+
+			if _, err := d.CreateVolume(context.Background(), createVolumeRequest(tt.volume, tt.params)); status.Code(err) != tt.wantCode {
+				t.Errorf("CreateVolume returned %v, want %s", err, tt.wantCode)
+			}
+			if storage.calls["mkdir"] != 0 {
+				t.Error("directory was made")
+			}
+		})
+	}
+}
+
+func TestNFSSubdirListVolumesFails(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(storage *fakeStorage)
+	}{
+		{name: "dataset not shared", setup: func(storage *fakeStorage) { storage.nfsShares = make(map[int32]tnclient.ShareNFS) }},
+		{name: "directories can't be listed", setup: func(storage *fakeStorage) { storage.failures["listDir"] = errors.New("TrueNAS is down") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, storage := newSubdirTestDriver(t)
+			createTwice(t, d, createVolumeRequest("pvc-1", subdirParams))
+			tt.setup(storage)
+
+			// A partial list would look like the subdirectory volumes had gone
+			if resp, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{}); err == nil {
+				t.Errorf("ListVolumes returned %v, want an error", resp.GetEntries())
+			}
+		})
+	}
+}
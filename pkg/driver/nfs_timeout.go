@@ -0,0 +1,108 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+// nfsLazyUnmountTimeout bounds the lazy unmount fallen back to, it detaches rather than waiting on the server.
+const nfsLazyUnmountTimeout = 10 * time.Second
+
+// nfsMountContext bounds ctx by the mount timeout, a timeout of 0 leaves it to the request's deadline.
+func (d *Driver) nfsMountContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.nfsMountTimeout > 0 {
+		return context.WithTimeout(ctx, d.nfsMountTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// nfsMount runs mount.nfs itself rather than through the mounter, so it's killed when the mount timeout passes
+// instead of being left hanging on an unresponsive server.
+func (d *Driver) nfsMount(ctx context.Context, source, targetPath string, options []string) error {
+	ctx, cancel := d.nfsMountContext(ctx)
+	defer cancel()
+
+	args := []string{source, targetPath}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	output, err := exec.CommandContext(ctx, "mount.nfs", args...).CombinedOutput()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("mount failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// nfsNotMounted is whether umount's output says there was nothing mounted to begin with.
+func nfsNotMounted(output []byte) bool {
+	return strings.Contains(string(output), "not mounted") || strings.Contains(string(output), "no mount point")
+}
+
+// timeoutStatus turns a timed out or cancelled operation into a status, nil for any other error.
+func timeoutStatus(err error, operation string) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Errorf(codes.DeadlineExceeded, "timed out waiting to %s", operation)
+	case errors.Is(err, context.Canceled):
+		return status.Errorf(codes.Canceled, "cancelled while waiting to %s", operation)
+	}
+	return nil
+}
+
+// nfsUnmount unmounts and removes a target within the mount timeout, falling back to a lazy unmount if that fails.
+func (d *Driver) nfsUnmount(ctx context.Context, targetPath string) error {
+	err := d.nfsUnmountTarget(ctx, targetPath)
+	if err == nil {
+		return nil
+	}
+	klog.ErrorS(err, "failed unmounting NFS volume, unmounting lazily", "targetPath", targetPath)
+
+	// The request may be what's run out of time, the lazy unmount still gets its own
+	lazyCtx, cancel := context.WithTimeout(context.Background(), nfsLazyUnmountTimeout)
+	defer cancel()
+	output, lazyErr := exec.CommandContext(lazyCtx, "umount", "-l", targetPath).CombinedOutput()
+	if lazyErr != nil && !nfsNotMounted(output) {
+		klog.ErrorS(errors.New(strings.TrimSpace(string(output))), "failed lazily unmounting NFS volume", "targetPath", targetPath)
+		return err
+	}
+	if lazyErr = mount.CleanupMountPoint(targetPath, d.mounter, false); lazyErr != nil {
+		klog.ErrorS(lazyErr, "failed removing lazily unmounted NFS volume", "targetPath", targetPath)
+		return err
+	}
+	return nil
+}
+
+// nfsUnmountTarget runs umount, killed when the mount timeout passes, and removes the target.
+func (d *Driver) nfsUnmountTarget(ctx context.Context, targetPath string) error {
+	if _, err := os.Lstat(targetPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	ctx, cancel := d.nfsMountContext(ctx)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "umount", targetPath).CombinedOutput()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil && !nfsNotMounted(output) {
+		return fmt.Errorf("unmount failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	if err = os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
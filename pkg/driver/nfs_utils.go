@@ -2,6 +2,7 @@ package driver
 
 import (
 	"context"
+	"sort"
 
 	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
 )
@@ -11,84 +12,56 @@ type (
 	NFSShareMatcher func(share tnclient.ShareNFS) bool
 )
 
-func FindDataset(ctx context.Context, client *tnclient.APIClient, fn DatasetMatcher) (tnclient.Dataset, bool, error) {
-	datasets, _, err := client.DatasetAPI.ListDatasets(ctx).Execute()
-	if err != nil {
+func FindDataset(ctx context.Context, storage datasetStorage, fn DatasetMatcher, filters ...QueryFilter) (tnclient.Dataset, bool, error) {
+	datasets, err := storage.queryDatasets(ctx, fn, true, filters)
+	if err != nil || len(datasets) == 0 {
 		return tnclient.Dataset{}, false, err
 	}
 
-	for _, dataset := range datasets {
-		if fn(dataset) {
-			return dataset, true, nil
-		}
-	}
-
-	return tnclient.Dataset{}, false, nil
+	return datasets[0], true, nil
 }
 
-func FindAllDatasets(ctx context.Context, client *tnclient.APIClient, fn DatasetMatcher) ([]tnclient.Dataset, error) {
-	datasets, _, err := client.DatasetAPI.ListDatasets(ctx).Execute()
-	if err != nil {
-		return []tnclient.Dataset{}, err
-	}
-
-	result := make([]tnclient.Dataset, 0)
-
-	for _, dataset := range datasets {
-		ds := dataset
-		if fn(ds) {
-			result = append(result, ds)
-		}
-	}
-
-	return result, nil
+func FindAllDatasets(ctx context.Context, storage datasetStorage, fn DatasetMatcher, filters ...QueryFilter) ([]tnclient.Dataset, error) {
+	return storage.queryDatasets(ctx, fn, false, filters)
 }
 
-func FindNFSShare(ctx context.Context, client *tnclient.APIClient, fn NFSShareMatcher) (tnclient.ShareNFS, bool, error) {
-	shares, _, err := client.SharingAPI.ListSharesNFS(ctx).Execute()
-	if err != nil {
+func FindNFSShare(ctx context.Context, storage nfsShareStorage, fn NFSShareMatcher, filters ...QueryFilter) (tnclient.ShareNFS, bool, error) {
+	shares, err := storage.queryNFSShares(ctx, fn, true, filters)
+	if err != nil || len(shares) == 0 {
 		return tnclient.ShareNFS{}, false, err
 	}
 
-	for _, share := range shares {
-		if fn(share) {
-			return share, true, nil
-		}
-	}
-
-	return tnclient.ShareNFS{}, false, nil
+	return shares[0], true, nil
 }
 
-func FindAllNFSShares(ctx context.Context, client *tnclient.APIClient, fn NFSShareMatcher) ([]tnclient.ShareNFS, error) {
-	shares, _, err := client.SharingAPI.ListSharesNFS(ctx).Execute()
-	if err != nil {
-		return []tnclient.ShareNFS{}, err
-	}
-
-	result := make([]tnclient.ShareNFS, 0)
-
-	for _, share := range shares {
-		s := share
-		if fn(s) {
-			result = append(result, s)
-		}
-	}
+func FindAllNFSShares(ctx context.Context, storage nfsShareStorage, fn NFSShareMatcher, filters ...QueryFilter) ([]tnclient.ShareNFS, error) {
+	return storage.queryNFSShares(ctx, fn, false, filters)
+}
 
-	return result, nil
+// GetDatasetUserProperty returns the value of a ZFS user property on a dataset, empty if it isn't set.
+func GetDatasetUserProperty(dataset tnclient.Dataset, key string) string {
+	userProperties, _ := dataset.AdditionalProperties["user_properties"].(map[string]interface{})
+	property, _ := userProperties[key].(map[string]interface{})
+	value, _ := property["value"].(string)
+	return value
 }
 
-// NormaliseNFSShareMountpaths Returns a string of the first or only NFS path, empty if none
-// this hides an issues where TrueNAS Scale broke an API without bumping an API version
-// by moving from paths to path.
-func NormaliseNFSShareMountpaths(share tnclient.ShareNFS) string {
-	path := share.GetPath()
-	if len(path) > 0 {
-		return path
+// DatasetUserProperties converts ZFS user properties into the list the dataset create and update calls take, an empty
+// value removes the property.
+func DatasetUserProperties(properties map[string]string) []map[string]interface{} {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
 	}
-
-	paths := share.GetPaths()
-	if len(paths) > 0 {
-		return paths[0]
+	sort.Strings(keys)
+
+	result := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		if properties[key] == "" {
+			result = append(result, map[string]interface{}{"key": key, "remove": true})
+		} else {
+			result = append(result, map[string]interface{}{"key": key, "value": properties[key]})
+		}
 	}
-	return ""
+	return result
 }
@@ -2,13 +2,16 @@ package driver
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume"
+	mount "k8s.io/mount-utils"
 )
 
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
@@ -24,10 +27,20 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 
 	caps := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 		// csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 		// csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		csi.NodeServiceCapability_RPC_UNKNOWN,
 	}
+	// Group ownership of NFS and SMB volumes is set on mount rather than kubelet chowning the whole tree. Kubelet then
+	// leaves fsGroup to us for every volume, so only when all types served can do it
+	mountGroup := true
+	for _, driverType := range d.driverTypes {
+		mountGroup = mountGroup && (driverType == TypeNFS || driverType == TypeSMB)
+	}
+	if mountGroup {
+		caps = append(caps, csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP)
+	}
 
 	for _, nodeCap := range caps {
 		nodeServiceCaps = append(nodeServiceCaps, &csi.NodeServiceCapability{
@@ -52,11 +65,29 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume path was empty")
 	}
 
-	if _, err := os.Lstat(req.GetVolumePath()); err != nil {
+	info, err := os.Lstat(req.GetVolumePath())
+	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "path %s does not exist", req.GetVolumePath())
 		}
-		return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", req.GetVolumePath(), err)
+		if !mount.IsCorruptedMnt(err) {
+			return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", req.GetVolumePath(), err)
+		}
+	}
+	// Raw block volumes have no filesystem to report usage of
+	if info != nil && info.Mode()&os.ModeDevice != 0 {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"},
+		}, nil
+	}
+
+	// Lstat doesn't go through the mount so look inside it for stale file handles. They're only reported, the pod has
+	// to be restarted for the volume to be published again, remounting here wouldn't reach the pod's mount
+	if _, err := os.Stat(req.GetVolumePath()); mount.IsCorruptedMnt(err) {
+		klog.ErrorS(err, "volume mount is corrupted", "volumeID", req.GetVolumeId(), "volumePath", req.GetVolumePath())
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume mount is corrupted: %v", err)},
+		}, nil
 	}
 
 	volumeMetrics, err := volume.NewMetricsStatFS(req.GetVolumePath()).GetMetrics()
@@ -105,6 +136,7 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 				Used:      inodesUsed,
 			},
 		},
+		VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"},
 	}, nil
 }
 
@@ -121,11 +153,24 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
 	}
 
+	if !d.volumeLocks.tryAcquire(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer d.volumeLocks.release(req.GetVolumeId())
+
+	if req.GetVolumeContext()[EphemeralVolumeContextKey] == "true" {
+		return d.ephemeralNodePublishVolume(ctx, req)
+	}
+
 	switch {
 	case strings.HasPrefix(req.GetVolumeId(), NFSVolumePrefix):
 		return d.nfsNodePublishVolume(ctx, req)
 	case strings.HasPrefix(req.GetVolumeId(), ISCSIVolumePrefix):
 		return d.iscsiNodePublishVolume(ctx, req)
+	case strings.HasPrefix(req.GetVolumeId(), SMBVolumePrefix):
+		return d.smbNodePublishVolume(ctx, req)
+	case strings.HasPrefix(req.GetVolumeId(), NVMeVolumePrefix):
+		return d.nvmeNodePublishVolume(ctx, req)
 	}
 
 	return nil, status.Errorf(codes.Unimplemented, "Volume type: %s not supported", req.GetVolumeId())
@@ -140,11 +185,29 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	if !d.volumeLocks.tryAcquire(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer d.volumeLocks.release(req.GetVolumeId())
+
+	// Inline volumes only have kubelet's ID, the volume they were created as is on disk
+	state, err := d.loadEphemeralState(req.GetVolumeId())
+	if err == nil {
+		return d.ephemeralNodeUnpublishVolume(ctx, req, state)
+	}
+	if !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "failed to load inline volume state: %v", err)
+	}
+
 	switch {
 	case strings.HasPrefix(req.GetVolumeId(), NFSVolumePrefix):
 		return d.nfsNodeUnpublishVolume(ctx, req)
 	case strings.HasPrefix(req.GetVolumeId(), ISCSIVolumePrefix):
 		return d.iscsiNodeUnpublishVolume(ctx, req)
+	case strings.HasPrefix(req.GetVolumeId(), SMBVolumePrefix):
+		return d.smbNodeUnpublishVolume(ctx, req)
+	case strings.HasPrefix(req.GetVolumeId(), NVMeVolumePrefix):
+		return d.nvmeNodeUnpublishVolume(ctx, req)
 	}
 
 	return nil, status.Errorf(codes.Unimplemented, "Volume type: %s not supported", req.GetVolumeId())
@@ -0,0 +1,454 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+const (
+	NVMeVolumePrefix               = "nvme-"
+	NVMeVolumeContextNQN           = "nqn"
+	NVMeVolumeContextNSID          = "nsid"
+	NVMeVolumeContextTransportAddr = "transportAddr"
+	NVMeVolumeContextTransportPort = "transportPort"
+
+	// NVMeParamPort picks the NVMe-oF port volumes are exposed on, by ID or listen address, instead of --nvme-port.
+	NVMeParamPort = "nvmePort"
+)
+
+// minNVMeTrueNASVersion is the first TrueNAS release able to export zvols over NVMe-oF.
+var minNVMeTrueNASVersion = trueNASVersion{major: 25, minor: 10}
+
+var NVMeVolumeCapabilites = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+}
+
+func nvmeHasCapability(capability csi.VolumeCapability_AccessMode_Mode) bool {
+	for _, cs := range NVMeVolumeCapabilites {
+		if cs == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func nvmeCheckCaps(caps []*csi.VolumeCapability) error {
+	violations := sets.NewString()
+	for _, currentCap := range caps {
+		capMode := currentCap.GetAccessMode().GetMode()
+		if !nvmeHasCapability(capMode) {
+			violations.Insert(fmt.Sprintf("unsupported access mode %s", capMode.String()))
+		}
+
+		accessType := currentCap.GetAccessType()
+		switch accessType.(type) {
+		case *csi.VolumeCapability_Mount:
+			if fsType := currentCap.GetMount().GetFsType(); fsType != "" {
+				if _, err := iscsiResolveFsType(fsType, nil); err != nil {
+					violations.Insert(err.Error())
+				}
+			}
+		case *csi.VolumeCapability_Block:
+		default:
+			violations.Insert(fmt.Sprintf("unsupported access type %v", accessType))
+		}
+	}
+	if violations.Len() > 0 {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("volume capabilities cannot be satisified: %s", strings.Join(violations.List(), "; ")))
+	}
+	return nil
+}
+
+type nvmetSubsys struct {
+	ID     int32  `json:"id"`
+	Name   string `json:"name"`
+	Subnqn string `json:"subnqn"`
+}
+
+type nvmetNamespace struct {
+	ID         int32  `json:"id"`
+	NSID       int32  `json:"nsid"`
+	DevicePath string `json:"device_path"`
+	SubsysID   int32  `json:"subsys_id"`
+}
+
+type nvmetPort struct {
+	ID          int32  `json:"id"`
+	AddrTrtype  string `json:"addr_trtype"`
+	AddrTraddr  string `json:"addr_traddr"`
+	AddrTrsvcid int32  `json:"addr_trsvcid"`
+}
+
+type nvmetPortSubsys struct {
+	ID       int32 `json:"id"`
+	PortID   int32 `json:"port_id"`
+	SubsysID int32 `json:"subsys_id"`
+}
+
+// nvmeResolvePort finds the TCP port to expose volumes on by ID or listen address, the first TCP port if no selector
+// is given.
+func (d *Driver) nvmeResolvePort(ctx context.Context, selector string) (nvmetPort, error) {
+	ports, err := d.storage.listNVMePorts(ctx)
+	if err != nil {
+		return nvmetPort{}, status.Errorf(codes.Internal, "failed to list NVMe-oF ports: %v", err)
+	}
+
+	for _, port := range ports {
+		if port.AddrTrtype != "TCP" {
+			continue
+		}
+		if selector == "" || selector == strconv.Itoa(int(port.ID)) || selector == port.AddrTraddr {
+			return port, nil
+		}
+	}
+	if selector == "" {
+		return nvmetPort{}, status.Error(codes.FailedPrecondition, "TrueNAS has no NVMe-oF TCP port")
+	}
+	return nvmetPort{}, status.Errorf(codes.InvalidArgument, "NVMe-oF TCP port %q does not exist, it must be a port ID or listen address", selector)
+}
+
+func (d *Driver) nvmeFindSubsys(ctx context.Context, name string) (*nvmetSubsys, error) {
+	subsys, err := d.storage.findNVMeSubsys(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NVMe-oF subsystems: %w", err)
+	}
+	return subsys, nil
+}
+
+func (d *Driver) nvmeFindNamespaces(ctx context.Context, subsysID int32) ([]nvmetNamespace, error) {
+	namespaces, err := d.storage.findNVMeNamespaces(ctx, subsysID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NVMe-oF namespaces: %w", err)
+	}
+	return namespaces, nil
+}
+
+func (d *Driver) nvmeFindPortSubsystems(ctx context.Context, subsysID int32) ([]nvmetPortSubsys, error) {
+	mappings, err := d.storage.findNVMePortSubsystems(ctx, subsysID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NVMe-oF port mappings: %w", err)
+	}
+	return mappings, nil
+}
+
+func (d *Driver) nvmeCreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if !d.version.atLeast(minNVMeTrueNASVersion) {
+		return nil, status.Errorf(codes.FailedPrecondition, "NVMe-oF needs TrueNAS %d.%02d or newer, this is %s", minNVMeTrueNASVersion.major, minNVMeTrueNASVersion.minor, d.version.raw)
+	}
+
+	if err := nvmeCheckCaps(req.GetVolumeCapabilities()); err != nil {
+		klog.ErrorS(err, "invalid volume capabilities")
+		return nil, err
+	}
+
+	// Same filesystem options as iSCSI, the node formats the volume with them on first use
+	capFsType := ""
+	for _, currentCap := range req.GetVolumeCapabilities() {
+		if fsType := currentCap.GetMount().GetFsType(); fsType != "" {
+			capFsType = fsType
+			break
+		}
+	}
+	fsType, err := iscsiResolveFsType(capFsType, req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err = iscsiMkfsArgs(fsType, req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	portSelector := d.nvmePort
+	if selector := req.GetParameters()[NVMeParamPort]; selector != "" {
+		portSelector = selector
+	}
+	port, err := d.nvmeResolvePort(ctx, portSelector)
+	if err != nil {
+		klog.ErrorS(err, "failed to resolve NVMe-oF port", "port", portSelector)
+		return nil, err
+	}
+
+	volumeID := NVMeVolumePrefix + req.GetName()
+	size, err := extractStorage(req.GetCapacityRange())
+	if err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
+	}
+
+	// Undo whatever this call created if a later step fails, in reverse
+	var rollback []func()
+	fail := func(err error, msg string) (*csi.CreateVolumeResponse, error) {
+		klog.ErrorS(err, msg, "volumeID", volumeID)
+		for i := len(rollback) - 1; i >= 0; i-- {
+			rollback[i]()
+		}
+		return nil, status.Errorf(codes.Internal, "%s: %v", msg, err)
+	}
+
+	datasetName := strings.Join([]string{d.nvmeStoragePath, volumeID}, "/")
+	dataset, datasetExists, err := FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+		return dataset.GetName() == datasetName
+	}, FilterEqual("name", datasetName))
+	if err != nil {
+		return fail(err, "failed to look for existing datasets")
+	}
+	if !datasetExists {
+		created, err2 := d.storage.createDataset(ctx, tnclient.CreateDatasetParams{
+			Name:         datasetName,
+			Type:         tnclient.PtrString("VOLUME"),
+			Volblocksize: tnclient.PtrString("16K"),
+			Volsize:      tnclient.PtrInt64(size),
+		})
+		if err2 != nil {
+			return fail(err2, "failed to create zvol")
+		}
+		dataset = created
+		rollback = append(rollback, func() {
+			if err3 := d.storage.deleteDataset(ctx, dataset.GetId()); err3 != nil {
+				klog.ErrorS(err3, "failed to roll back zvol", "datasetName", datasetName)
+			}
+		})
+	}
+
+	subsys, err := d.nvmeFindSubsys(ctx, volumeID)
+	if err != nil {
+		return fail(err, "failed to look for existing NVMe-oF subsystem")
+	}
+	if subsys == nil {
+		basenqn, err2 := d.storage.nvmeBaseNQN(ctx)
+		if err2 != nil {
+			return fail(err2, "failed to get NVMe-oF global config")
+		}
+		// The NQN is set rather than generated so the node can find the subsystem from the volume ID alone
+		created, err2 := d.storage.createNVMeSubsys(ctx, volumeID, basenqn+":"+volumeID)
+		if err2 != nil {
+			return fail(err2, "failed to create NVMe-oF subsystem")
+		}
+		subsys = &created
+		subsysID := subsys.ID
+		rollback = append(rollback, func() {
+			if err3 := d.storage.deleteNVMeSubsys(ctx, subsysID); err3 != nil {
+				klog.ErrorS(err3, "failed to roll back NVMe-oF subsystem", "subsysID", subsysID)
+			}
+		})
+	}
+
+	namespaces, err := d.nvmeFindNamespaces(ctx, subsys.ID)
+	if err != nil {
+		return fail(err, "failed to look for existing NVMe-oF namespace")
+	}
+	var namespace nvmetNamespace
+	if len(namespaces) > 0 {
+		namespace = namespaces[0]
+	} else {
+		if namespace, err = d.storage.createNVMeNamespace(ctx, "zvol/"+datasetName, subsys.ID); err != nil {
+			return fail(err, "failed to create NVMe-oF namespace")
+		}
+		namespaceID := namespace.ID
+		rollback = append(rollback, func() {
+			if err3 := d.storage.deleteNVMeNamespace(ctx, namespaceID); err3 != nil {
+				klog.ErrorS(err3, "failed to roll back NVMe-oF namespace", "namespaceID", namespaceID)
+			}
+		})
+	}
+
+	mappings, err := d.nvmeFindPortSubsystems(ctx, subsys.ID)
+	if err != nil {
+		return fail(err, "failed to look for existing NVMe-oF port mapping")
+	}
+	mapped := false
+	for _, mapping := range mappings {
+		mapped = mapped || mapping.PortID == port.ID
+	}
+	if !mapped {
+		if err = d.storage.createNVMePortSubsys(ctx, port.ID, subsys.ID); err != nil {
+			return fail(err, "failed to map NVMe-oF subsystem to port")
+		}
+	}
+
+	volumeContext := map[string]string{
+		NVMeVolumeContextNQN:           subsys.Subnqn,
+		NVMeVolumeContextNSID:          strconv.Itoa(int(namespace.NSID)),
+		NVMeVolumeContextTransportAddr: port.AddrTraddr,
+		NVMeVolumeContextTransportPort: strconv.Itoa(int(port.AddrTrsvcid)),
+		ISCSIParamDefaultFsType:        fsType,
+	}
+	for _, key := range iscsiMkfsParams {
+		if value, ok := req.GetParameters()[key]; ok {
+			volumeContext[key] = value
+		}
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: size,
+			VolumeContext: volumeContext,
+		},
+	}, nil
+}
+
+func (d *Driver) nvmeDeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) error {
+	volumeID := req.GetVolumeId()
+	if !strings.HasPrefix(volumeID, NVMeVolumePrefix) {
+		return status.Errorf(codes.NotFound, "Volume ID %s not found", volumeID)
+	}
+
+	// Port mappings, namespaces then the subsystem, else the zvol is busy
+	subsys, err := d.nvmeFindSubsys(ctx, volumeID)
+	if err != nil {
+		klog.ErrorS(err, "failed to look for existing NVMe-oF subsystem", "volumeID", volumeID)
+		return err
+	}
+	if subsys != nil {
+		mappings, err2 := d.nvmeFindPortSubsystems(ctx, subsys.ID)
+		if err2 != nil {
+			return err2
+		}
+		for _, mapping := range mappings {
+			if err2 = d.storage.deleteNVMePortSubsys(ctx, mapping.ID); err2 != nil {
+				klog.ErrorS(err2, "failed to delete NVMe-oF port mapping", "mappingID", mapping.ID)
+				return err2
+			}
+		}
+
+		namespaces, err2 := d.nvmeFindNamespaces(ctx, subsys.ID)
+		if err2 != nil {
+			return err2
+		}
+		for _, namespace := range namespaces {
+			if err2 = d.storage.deleteNVMeNamespace(ctx, namespace.ID); err2 != nil {
+				klog.ErrorS(err2, "failed to delete NVMe-oF namespace", "namespaceID", namespace.ID)
+				return err2
+			}
+		}
+
+		if err2 = d.storage.deleteNVMeSubsys(ctx, subsys.ID); err2 != nil {
+			klog.ErrorS(err2, "failed to delete NVMe-oF subsystem", "subsysID", subsys.ID)
+			return err2
+		}
+	}
+
+	datasetName := strings.Join([]string{d.nvmeStoragePath, volumeID}, "/")
+	dataset, datasetExists, err := FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+		return dataset.GetName() == datasetName
+	}, FilterEqual("name", datasetName))
+	if err != nil {
+		klog.ErrorS(err, "failed to look for existing datasets")
+		return err
+	}
+	if datasetExists {
+		if err = d.storage.deleteDataset(ctx, dataset.GetId()); err != nil {
+			klog.ErrorS(err, "failed to delete zvol", "datasetID", dataset.GetId())
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) nvmeValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	volumeID := req.GetVolumeId()
+	if !strings.HasPrefix(volumeID, NVMeVolumePrefix) {
+		return nil, status.Errorf(codes.NotFound, "ValidateVolumeCapabilities Volume ID %s not found", volumeID)
+	}
+
+	if err := nvmeCheckCaps(req.GetVolumeCapabilities()); err != nil {
+		klog.ErrorS(err, "invalid volume capabilities")
+		return nil, err
+	}
+
+	for _, key := range []string{NVMeVolumeContextNQN, NVMeVolumeContextNSID, NVMeVolumeContextTransportAddr, NVMeVolumeContextTransportPort} {
+		if req.GetVolumeContext()[key] == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s key missing from volume context", key)
+		}
+	}
+
+	datasetName := strings.Join([]string{d.nvmeStoragePath, volumeID}, "/")
+	_, datasetExists, err := FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+		return dataset.GetName() == datasetName
+	}, FilterEqual("name", datasetName))
+	if err != nil {
+		klog.ErrorS(err, "failed to look for existing datasets")
+		return nil, status.Errorf(codes.Internal, "failed to look for existing datasets: %v", err)
+	}
+	if !datasetExists {
+		return nil, status.Errorf(codes.NotFound, "ValidateVolumeCapabilities Volume ID %s not found", volumeID)
+	}
+
+	caps := make([]*csi.VolumeCapability, 0)
+	for _, currentCap := range NVMeVolumeCapabilites {
+		caps = append(caps, &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: currentCap},
+		})
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: caps,
+		},
+	}, nil
+}
+
+func (d *Driver) nvmeGetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) { //nolint:unparam
+	resp, err := d.storage.getDataset(ctx, d.nvmeStoragePath)
+	if err != nil {
+		klog.ErrorS(err, "failed to get dataset", "datasetID", d.nvmeStoragePath)
+		return nil, status.Errorf(codes.Internal, "Failed to get NVMe dataset: %s", err.Error())
+	}
+
+	available, err := strconv.ParseInt(resp.Available.GetRawvalue(), 10, 64)
+	if err != nil {
+		klog.ErrorS(err, "failed parse available disk space to int64", "available", resp.Available)
+		return nil, status.Errorf(codes.Internal, "Failed to parse available bytes: %s", err.Error())
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: nil,
+		MinimumVolumeSize: wrapperspb.Int64(minimumVolumeSizeInBytes),
+	}, nil
+}
+
+func (d *Driver) nvmeListVolumes(ctx context.Context) ([]*csi.ListVolumesResponse_Entry, error) {
+	nvmeStoragePrefix := d.nvmeStoragePath + "/"
+	datasets, err := FindAllDatasets(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+		return dataset.GetType() == "VOLUME" && strings.HasPrefix(dataset.GetName(), nvmeStoragePrefix+NVMeVolumePrefix)
+	}, FilterPrefix("name", nvmeStoragePrefix+NVMeVolumePrefix))
+	if err != nil {
+		klog.ErrorS(err, "failed to get list of datasets")
+		return nil, err
+	}
+
+	result := make([]*csi.ListVolumesResponse_Entry, 0)
+	for _, dataset := range datasets {
+		volsizeComp := dataset.GetVolsize()
+		size, err := strconv.ParseInt(volsizeComp.GetRawvalue(), 10, 64)
+		if err != nil {
+			klog.ErrorS(err, "Failed parse volume size to int64", "volumeSizeComposite", volsizeComp)
+			return nil, err
+		}
+
+		result = append(result, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      strings.TrimPrefix(dataset.GetName(), nvmeStoragePrefix),
+				CapacityBytes: size,
+			},
+		})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,251 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/exec"
+	"k8s.io/utils/mount"
+)
+
+const (
+	nvmeSubsystemSysfs = "/sys/class/nvme-subsystem"
+
+	// nvmeNamespaceTimeout is how long to wait for the namespace's block device after connecting
+	nvmeNamespaceTimeout = 30 * time.Second
+)
+
+// nvmeFindSubsystem returns the sysfs directory of the connected subsystem whose NQN matches, empty if there is none.
+func nvmeFindSubsystem(match func(nqn string) bool) (string, string, error) {
+	subsystems, err := filepath.Glob(filepath.Join(nvmeSubsystemSysfs, "nvme-subsys*"))
+	if err != nil {
+		return "", "", err
+	}
+	for _, subsysDir := range subsystems {
+		nqn, err := os.ReadFile(filepath.Join(subsysDir, "subsysnqn"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", "", err
+		}
+		if match(strings.TrimSpace(string(nqn))) {
+			return subsysDir, strings.TrimSpace(string(nqn)), nil
+		}
+	}
+	return "", "", nil
+}
+
+// nvmeFindNamespaceDevice returns the block device of the namespace with the given NSID in a subsystem, empty if the
+// kernel hasn't created it yet.
+func nvmeFindNamespaceDevice(subsysDir, nsid string) (string, error) {
+	namespaces, err := filepath.Glob(filepath.Join(subsysDir, "nvme*n*"))
+	if err != nil {
+		return "", err
+	}
+	for _, namespaceDir := range namespaces {
+		value, err := os.ReadFile(filepath.Join(namespaceDir, "nsid"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		if strings.TrimSpace(string(value)) == nsid {
+			return "/dev/" + filepath.Base(namespaceDir), nil
+		}
+	}
+	return "", nil
+}
+
+// nvmeConnect connects to the subsystem over TCP unless already connected, then waits for the namespace to show up.
+func nvmeConnect(ctx context.Context, executor exec.Interface, nqn, addr, port, nsid string) (string, error) {
+	matchNQN := func(value string) bool { return value == nqn }
+	subsysDir, _, err := nvmeFindSubsystem(matchNQN)
+	if err != nil {
+		return "", fmt.Errorf("failed to look for connected NVMe subsystems: %w", err)
+	}
+	if subsysDir == "" {
+		klog.InfoS("connecting to NVMe subsystem", "nqn", nqn, "address", addr, "port", port)
+		output, err := executor.CommandContext(ctx, "nvme", "connect", "-t", "tcp", "-a", addr, "-s", port, "-n", nqn).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("nvme connect to %s failed: %w, output: %s", nqn, err, string(output))
+		}
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(nvmeNamespaceTimeout)
+	for {
+		if subsysDir == "" {
+			if subsysDir, _, err = nvmeFindSubsystem(matchNQN); err != nil {
+				return "", fmt.Errorf("failed to look for connected NVMe subsystems: %w", err)
+			}
+		}
+		if subsysDir != "" {
+			devicePath, err := nvmeFindNamespaceDevice(subsysDir, nsid)
+			if err != nil {
+				return "", fmt.Errorf("failed to look for NVMe namespace %s: %w", nsid, err)
+			}
+			if devicePath != "" {
+				return devicePath, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-timeout:
+			return "", fmt.Errorf("namespace %s of NVMe subsystem %s did not appear within %s", nsid, nqn, nvmeNamespaceTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Driver) nvmeNodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeContext := req.GetVolumeContext()
+	for _, key := range []string{NVMeVolumeContextNQN, NVMeVolumeContextNSID, NVMeVolumeContextTransportAddr, NVMeVolumeContextTransportPort} {
+		if volumeContext[key] == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s key missing from volume context", key)
+		}
+	}
+
+	targetPath := req.GetTargetPath()
+	mounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()}
+
+	notMnt, err := mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "heuristic determination of mount point failed: %v", err)
+	}
+	if err == nil && !notMnt {
+		klog.InfoS("NVMe volume already published", "targetPath", targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	devicePath, err := nvmeConnect(ctx, mounter.Exec, volumeContext[NVMeVolumeContextNQN], volumeContext[NVMeVolumeContextTransportAddr], volumeContext[NVMeVolumeContextTransportPort], volumeContext[NVMeVolumeContextNSID])
+	if err != nil {
+		klog.ErrorS(err, "failed to connect NVMe volume", "volumeID", req.GetVolumeId())
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	options := []string{"rw"}
+	if req.GetReadonly() {
+		options = []string{"ro"}
+	}
+
+	if req.GetVolumeCapability().GetBlock() != nil {
+		// Raw block volumes are the device bind mounted over a file kubelet hands to the pod
+		if err = os.MkdirAll(filepath.Dir(targetPath), 0o750); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create directory for %s: %v", targetPath, err)
+		}
+		file, err := os.OpenFile(targetPath, os.O_CREATE, 0o660)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create target file %s: %v", targetPath, err)
+		}
+		_ = file.Close()
+
+		if err = mounter.Mount(devicePath, targetPath, "", append(options, "bind")); err != nil {
+			klog.ErrorS(err, "failed to bind mount NVMe device", "devicePath", devicePath, "targetPath", targetPath)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	fsType, err := iscsiResolveFsType(req.GetVolumeCapability().GetMount().GetFsType(), volumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mkfsArgs, err := iscsiMkfsArgs(fsType, volumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err = os.MkdirAll(targetPath, 0o750); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create target path %s: %v", targetPath, err)
+	}
+	if !req.GetReadonly() {
+		if err = formatDisk(mounter, devicePath, fsType, mkfsArgs); err != nil {
+			klog.ErrorS(err, "failed to format NVMe volume", "devicePath", devicePath, "fsType", fsType)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	options = append(options, req.GetVolumeCapability().GetMount().GetMountFlags()...)
+	if err = mounter.FormatAndMount(devicePath, targetPath, fsType, options); err != nil {
+		klog.ErrorS(err, "failed to mount NVMe volume", "devicePath", devicePath, "fsType", fsType)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (d *Driver) nvmeNodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	mounter := mount.New("")
+
+	if err := mount.CleanupMountPoint(req.GetTargetPath(), mounter, true); err != nil {
+		klog.ErrorS(err, "failed to unmount NVMe volume", "targetPath", req.GetTargetPath())
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// The NQN isn't in the request, but it always ends with the volume ID
+	subsysDir, nqn, err := nvmeFindSubsystem(func(value string) bool {
+		return strings.HasSuffix(value, ":"+volumeID)
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look for connected NVMe subsystems: %v", err)
+	}
+	if subsysDir == "" {
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	// Keep the connection while other pods on this node still use the volume
+	inUse, err := nvmeVolumeInUse(mounter, subsysDir, volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check if NVMe volume is in use: %v", err)
+	}
+	if inUse {
+		klog.InfoS("NVMe volume still mounted elsewhere, keeping connection", "volumeID", volumeID)
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	klog.InfoS("disconnecting NVMe subsystem", "nqn", nqn)
+	if output, err := exec.New().CommandContext(ctx, "nvme", "disconnect", "-n", nqn).CombinedOutput(); err != nil {
+		klog.ErrorS(err, "nvme disconnect failed", "nqn", nqn, "output", string(output))
+		return nil, status.Errorf(codes.Internal, "nvme disconnect from %s failed: %v", nqn, err)
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// nvmeVolumeInUse checks for mounts of the subsystem's namespaces, or bind mounts of them under paths naming the volume.
+func nvmeVolumeInUse(mounter mount.Interface, subsysDir, volumeID string) (bool, error) {
+	namespaces, err := filepath.Glob(filepath.Join(subsysDir, "nvme*n*"))
+	if err != nil {
+		return false, err
+	}
+	devices := make(map[string]bool, len(namespaces))
+	for _, namespaceDir := range namespaces {
+		devices["/dev/"+filepath.Base(namespaceDir)] = true
+	}
+
+	mountPoints, err := mounter.List()
+	if err != nil {
+		return false, err
+	}
+	// Target paths contain the PV name, which the volume ID is made from
+	pvName := strings.TrimPrefix(volumeID, NVMeVolumePrefix)
+	for _, mountPoint := range mountPoints {
+		if devices[mountPoint.Device] || strings.Contains(mountPoint.Path, "/"+pvName+"/") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
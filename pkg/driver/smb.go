@@ -0,0 +1,381 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	mountutils "k8s.io/mount-utils"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+const (
+	SMBVolumePrefix                = "smb-"
+	SMBVolumeContextParamHost      = "host"
+	SMBVolumeContextParamShareName = "shareName"
+)
+
+// Node publish secrets holding the credentials shares are mounted with.
+const (
+	SMBSecretUsername = "username"
+	SMBSecretPassword = "password"
+	SMBSecretDomain   = "domain"
+)
+
+var SMBVolumeCapabilites = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+}
+
+func smbHasCapability(capability csi.VolumeCapability_AccessMode_Mode) bool {
+	for _, cs := range SMBVolumeCapabilites {
+		if cs == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func smbCheckCaps(caps []*csi.VolumeCapability) error {
+	violations := sets.NewString()
+	for _, currentCap := range caps {
+		capMode := currentCap.GetAccessMode().GetMode()
+		if !smbHasCapability(capMode) {
+			violations.Insert(fmt.Sprintf("unsupported access mode %s", capMode.String()))
+		}
+
+		accessType := currentCap.GetAccessType()
+		switch accessType.(type) {
+		case *csi.VolumeCapability_Mount:
+		default:
+			violations.Insert(fmt.Sprintf("unsupported access type %v", accessType))
+		}
+	}
+	if violations.Len() > 0 {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("volume capabilities cannot be satisified: %s", strings.Join(violations.List(), "; ")))
+	}
+	return nil
+}
+
+func (d *Driver) smbCreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if err := smbCheckCaps(req.GetVolumeCapabilities()); err != nil {
+		klog.ErrorS(err, "invalid volume capabilities")
+		return nil, err
+	}
+
+	volumeID := SMBVolumePrefix + req.GetName()
+
+	size, err := extractStorage(req.GetCapacityRange())
+	if err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
+	}
+
+	datasetName := strings.Join([]string{d.smbStoragePath, volumeID}, "/")
+	datasetMountpoint := ""
+
+	existingDataset, datasetExists, err := FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+		return dataset.GetName() == datasetName
+	}, FilterEqual("name", datasetName))
+	if err != nil {
+		klog.ErrorS(err, "failed to look for existing datasets")
+		return nil, status.Errorf(codes.Internal, "failed to look for existing datasets: %v", err)
+	}
+
+	if datasetExists {
+		datasetMountpoint = existingDataset.GetMountpoint()
+		klog.V(5).Info("[Debug] Dataset exists, skipping")
+	} else {
+		klog.V(5).Info("[Debug] Dataset does not exist, creating")
+
+		datasetResponse, err2 := d.storage.createDataset(ctx, tnclient.CreateDatasetParams{
+			Name:              datasetName,
+			Copies:            tnclient.PtrInt32(1),
+			InheritEncryption: tnclient.PtrBool(true),
+			// Sets case insensitivity and NFSv4 ACLs as SMB clients expect
+			ShareType: tnclient.PtrString("SMB"),
+			Refquota:  tnclient.PtrInt64(size),
+		})
+		if err2 != nil {
+			klog.ErrorS(err2, "failed to create dataset", "datasetName", datasetName)
+			return nil, err2
+		}
+		datasetMountpoint = datasetResponse.GetMountpoint()
+	}
+
+	_, shareExists, err := FindSMBShare(ctx, d.storage, func(share tnclient.ShareSMB) bool {
+		return share.GetPath() == datasetMountpoint
+	}, FilterEqual("path", datasetMountpoint))
+	if err != nil {
+		klog.ErrorS(err, "failed to look for existing SMB shares")
+		return nil, status.Errorf(codes.Internal, "failed to look for existing SMB shares: %v", err)
+	}
+
+	if !shareExists {
+		err = d.storage.createSMBShare(ctx, tnclient.CreateShareSMBParams{
+			Path:      datasetMountpoint,
+			Name:      tnclient.PtrString(volumeID),
+			Comment:   tnclient.PtrString(fmt.Sprintf("Share for Kubernetes PV %s", req.GetName())),
+			Browsable: tnclient.PtrBool(false),
+			Enabled:   tnclient.PtrBool(true),
+		})
+		if err != nil {
+			klog.ErrorS(err, "failed to create SMB share", "datasetName", datasetName, "mountpoint", datasetMountpoint)
+			return nil, err
+		}
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: size,
+			VolumeContext: map[string]string{
+				SMBVolumeContextParamHost:      d.smbServer,
+				SMBVolumeContextParamShareName: volumeID,
+			},
+		},
+	}, nil
+}
+
+func (d *Driver) smbDeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) error {
+	volumeID := req.GetVolumeId()
+	if !strings.HasPrefix(volumeID, SMBVolumePrefix) {
+		return status.Errorf(codes.NotFound, "Volume ID %s not found", volumeID)
+	}
+
+	datasetName := strings.Join([]string{d.smbStoragePath, volumeID}, "/")
+
+	existingDataset, datasetExists, err := FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+		return dataset.GetName() == datasetName
+	}, FilterEqual("name", datasetName))
+	if err != nil {
+		klog.ErrorS(err, "failed to look for existing datasets")
+		return err
+	}
+	if !datasetExists {
+		return nil
+	}
+
+	// Remove the share first so clients aren't left with a share of a missing path
+	share, shareExists, err := FindSMBShare(ctx, d.storage, func(share tnclient.ShareSMB) bool {
+		return share.GetPath() == existingDataset.GetMountpoint()
+	}, FilterEqual("path", existingDataset.GetMountpoint()))
+	if err != nil {
+		klog.ErrorS(err, "failed to look for existing SMB shares")
+		return err
+	}
+	if shareExists {
+		if err = d.storage.deleteSMBShare(ctx, share.GetId()); err != nil {
+			klog.ErrorS(err, "failed to delete SMB share", "shareID", share.GetId())
+			return err
+		}
+	}
+
+	if err = d.storage.deleteDataset(ctx, existingDataset.GetId()); err != nil {
+		klog.ErrorS(err, "failed to delete Dataset", "datasetID", existingDataset.GetId())
+		return err
+	}
+
+	return nil
+}
+
+func (d *Driver) smbValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	volumeID := req.GetVolumeId()
+	if !strings.HasPrefix(volumeID, SMBVolumePrefix) {
+		return nil, status.Errorf(codes.NotFound, "ValidateVolumeCapabilities Volume ID %s not found", volumeID)
+	}
+
+	if err := smbCheckCaps(req.GetVolumeCapabilities()); err != nil {
+		klog.ErrorS(err, "invalid volume caps")
+		return nil, err
+	}
+
+	if req.GetVolumeContext()[SMBVolumeContextParamHost] == "" || req.GetVolumeContext()[SMBVolumeContextParamShareName] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s, %s keys missing from volume context", SMBVolumeContextParamHost, SMBVolumeContextParamShareName)
+	}
+
+	datasetName := strings.Join([]string{d.smbStoragePath, volumeID}, "/")
+	_, datasetExists, err := FindDataset(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+		return dataset.GetName() == datasetName
+	}, FilterEqual("name", datasetName))
+	if err != nil {
+		klog.ErrorS(err, "failed to look for existing datasets")
+		return nil, status.Errorf(codes.Internal, "failed to look for existing datasets: %v", err)
+	}
+	if !datasetExists {
+		return nil, status.Errorf(codes.NotFound, "ValidateVolumeCapabilities Volume ID %s not found", volumeID)
+	}
+
+	caps := make([]*csi.VolumeCapability, 0)
+	for _, currentCap := range SMBVolumeCapabilites {
+		caps = append(caps, &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: currentCap},
+		})
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: caps,
+		},
+	}, nil
+}
+
+func (d *Driver) smbGetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) { //nolint:unparam
+	resp, err := d.storage.getDataset(ctx, d.smbStoragePath)
+	if err != nil {
+		klog.ErrorS(err, "failed to get dataset", "datasetID", d.smbStoragePath)
+		return nil, status.Errorf(codes.Internal, "Failed to get SMB dataset: %s", err.Error())
+	}
+
+	available, err := strconv.ParseInt(resp.Available.GetRawvalue(), 10, 64)
+	if err != nil {
+		klog.ErrorS(err, "failed parse available to int64", "available", resp.Available)
+		return nil, status.Errorf(codes.Internal, "Failed to parse available bytes: %s", err.Error())
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: nil,
+		MinimumVolumeSize: wrapperspb.Int64(minimumVolumeSizeInBytes),
+	}, nil
+}
+
+func (d *Driver) smbListVolumes(ctx context.Context) ([]*csi.ListVolumesResponse_Entry, error) {
+	smbStoragePrefix := d.smbStoragePath + "/"
+	datasets, err := FindAllDatasets(ctx, d.storage, func(dataset tnclient.Dataset) bool {
+		return strings.HasPrefix(dataset.GetName(), smbStoragePrefix)
+	}, FilterPrefix("name", smbStoragePrefix))
+	if err != nil {
+		klog.ErrorS(err, "failed to get list of datasets")
+		return nil, err
+	}
+
+	mountpointDataset := make(map[string]tnclient.Dataset)
+	for _, dataset := range datasets {
+		mountpointDataset[dataset.GetMountpoint()] = dataset
+	}
+
+	shares, err := FindAllSMBShares(ctx, d.storage, func(share tnclient.ShareSMB) bool {
+		_, exists := mountpointDataset[share.GetPath()]
+		return exists
+	})
+	if err != nil {
+		klog.ErrorS(err, "failed to get list of SMB shares")
+		return nil, err
+	}
+
+	result := make([]*csi.ListVolumesResponse_Entry, 0)
+	for _, share := range shares {
+		dataset := mountpointDataset[share.GetPath()]
+
+		quotaComp := dataset.GetRefquota()
+		quota, err := strconv.ParseInt(quotaComp.GetRawvalue(), 10, 64)
+		if err != nil {
+			klog.ErrorS(err, "failed parse quota to int64", "datasetQuotaComposite", quotaComp)
+			return nil, err
+		}
+
+		result = append(result, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      strings.TrimPrefix(dataset.GetName(), smbStoragePrefix),
+				CapacityBytes: quota,
+			},
+		})
+	}
+
+	return result, nil
+}
+
+func (d *Driver) smbNodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) { //nolint:unparam
+	volCap := req.GetVolumeCapability()
+	volumeID := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+
+	server := req.GetVolumeContext()[SMBVolumeContextParamHost]
+	shareName := req.GetVolumeContext()[SMBVolumeContextParamShareName]
+	if server == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", SMBVolumeContextParamHost))
+	}
+	if shareName == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", SMBVolumeContextParamShareName))
+	}
+
+	secrets := req.GetSecrets()
+	if secrets[SMBSecretUsername] == "" || secrets[SMBSecretPassword] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "node publish secrets must contain %s and %s", SMBSecretUsername, SMBSecretPassword)
+	}
+
+	mountOptions := volCap.GetMount().GetMountFlags()
+	if req.GetReadonly() {
+		mountOptions = append(mountOptions, "ro")
+	}
+	// cifs has no ownership of its own so the mount group is given as the group of everything
+	if group := volCap.GetMount().GetVolumeMountGroup(); group != "" {
+		if _, err := strconv.Atoi(group); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume mount group must be a GID: %q", group)
+		}
+		mountOptions = append(mountOptions, "gid="+group, "forcegid", "dir_mode=0775", "file_mode=0664")
+	}
+	sensitiveOptions := []string{"username=" + secrets[SMBSecretUsername], "password=" + secrets[SMBSecretPassword]}
+	if domain := secrets[SMBSecretDomain]; domain != "" {
+		sensitiveOptions = append(sensitiveOptions, "domain="+domain)
+	}
+
+	source := fmt.Sprintf("//%s/%s", getServerFromSource(server), shareName)
+
+	notMnt, err := d.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err = os.MkdirAll(targetPath, os.FileMode(0o777)); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		} else {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	klog.V(5).InfoS("[Debug] mounting options", "volumeID", volumeID, "smbSource", source, "targetPath", targetPath, "mountOptions", mountOptions)
+	if err = d.mounter.MountSensitive(source, targetPath, "cifs", mountOptions, sensitiveOptions); err != nil {
+		if os.IsPermission(err) {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		if strings.Contains(err.Error(), "invalid argument") {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	klog.InfoS("mounting SMB volume success", "volumeID", volumeID, "smbSource", source, "targetPath", targetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (d *Driver) smbNodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) { //nolint:unparam
+	volumeID := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	klog.V(5).InfoS("[Debug] unmounting volume", "volumeID", volumeID, "targetPath", targetPath)
+	if err := mountutils.CleanupMountPoint(targetPath, d.mounter, true); err != nil {
+		klog.ErrorS(err, "failed unmounting volume", "volumeID", volumeID, "targetPath", targetPath)
+		return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
+	}
+	klog.InfoS("unmounting SMB volume success", "volumeID", volumeID)
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
@@ -0,0 +1,31 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+// ValidateSMBServer checks the server is a hostname or IP without a port.
+func ValidateSMBServer(server string) error {
+	if !isHostAddress(server) {
+		return fmt.Errorf("SMB server %q is not a hostname or IP address", server)
+	}
+	return nil
+}
+
+type SMBShareMatcher func(share tnclient.ShareSMB) bool
+
+func FindSMBShare(ctx context.Context, storage smbShareStorage, fn SMBShareMatcher, filters ...QueryFilter) (tnclient.ShareSMB, bool, error) {
+	shares, err := storage.querySMBShares(ctx, fn, true, filters)
+	if err != nil || len(shares) == 0 {
+		return tnclient.ShareSMB{}, false, err
+	}
+
+	return shares[0], true, nil
+}
+
+func FindAllSMBShares(ctx context.Context, storage smbShareStorage, fn SMBShareMatcher, filters ...QueryFilter) ([]tnclient.ShareSMB, error) {
+	return storage.querySMBShares(ctx, fn, false, filters)
+}
@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"context"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+// storageBackend is everything the driver needs from TrueNAS. It's split by area so one part at a time can be faked or
+// mocked, apiStorage implements it over the TrueNAS API.
+//
+// The query methods return what the matcher accepts, only the first match if first is set. Filters are a hint at what
+// the matcher accepts so less has to be fetched, an implementation is free to ignore them.
+type storageBackend interface {
+	datasetStorage
+	snapshotStorage
+	nfsShareStorage
+	smbShareStorage
+	iscsiStorage
+	nvmeStorage
+	filesystemStorage
+	systemStorage
+	close() error
+}
+
+type datasetStorage interface {
+	queryDatasets(ctx context.Context, fn DatasetMatcher, first bool, filters []QueryFilter) ([]tnclient.Dataset, error)
+	getDataset(ctx context.Context, id string) (tnclient.Dataset, error)
+	createDataset(ctx context.Context, params tnclient.CreateDatasetParams) (tnclient.Dataset, error)
+	updateDataset(ctx context.Context, id string, params tnclient.UpdateDatasetParams) error
+	deleteDataset(ctx context.Context, id string) error
+}
+
+// zfsSnapshot is a snapshot of a dataset or zvol, which the SDK has no model of.
+type zfsSnapshot struct {
+	ID           string `json:"id"` // dataset@name
+	Dataset      string `json:"dataset"`
+	SnapshotName string `json:"snapshot_name"`
+}
+
+type SnapshotMatcher func(snapshot zfsSnapshot) bool
+
+type snapshotStorage interface {
+	querySnapshots(ctx context.Context, fn SnapshotMatcher, first bool, filters []QueryFilter) ([]zfsSnapshot, error)
+	createSnapshot(ctx context.Context, dataset, name string) (zfsSnapshot, error)
+	// deleteSnapshot fails if the snapshot has clones.
+	deleteSnapshot(ctx context.Context, id string) error
+}
+
+type nfsShareStorage interface {
+	queryNFSShares(ctx context.Context, fn NFSShareMatcher, first bool, filters []QueryFilter) ([]tnclient.ShareNFS, error)
+	createNFSShare(ctx context.Context, params tnclient.CreateShareNFSParams) error
+	updateNFSShare(ctx context.Context, id int32, params tnclient.CreateShareNFSParams) error
+}
+
+type smbShareStorage interface {
+	querySMBShares(ctx context.Context, fn SMBShareMatcher, first bool, filters []QueryFilter) ([]tnclient.ShareSMB, error)
+	createSMBShare(ctx context.Context, params tnclient.CreateShareSMBParams) error
+	deleteSMBShare(ctx context.Context, id int32) error
+}
+
+type iscsiStorage interface {
+	iscsiGlobalConfig(ctx context.Context) (tnclient.ISCSIGlobalConfiguration, error)
+	listISCSIPortals(ctx context.Context) ([]tnclient.ISCSIPortal, error)
+
+	queryISCSIExtents(ctx context.Context, fn ISCSIExtentMatcher, first bool, filters []QueryFilter) ([]tnclient.ISCSIExtent, error)
+	// createISCSIExtent creates an extent with the NAA given, TrueNAS generates one if it's empty.
+	createISCSIExtent(ctx context.Context, params tnclient.CreateISCSIExtentParams, naa string) (tnclient.ISCSIExtent, error)
+	// iscsiExtentNAA returns the NAA of an extent, which the SDK's model leaves out.
+	iscsiExtentNAA(ctx context.Context, id int32) (string, error)
+	// deleteISCSIExtent removes the extent even if it's in use.
+	deleteISCSIExtent(ctx context.Context, id int32) error
+
+	queryISCSIInitiators(ctx context.Context, fn ISCSIInitiatorMatcher, first bool, filters []QueryFilter) ([]tnclient.ISCSIInitiator, error)
+	createISCSIInitiator(ctx context.Context, params tnclient.CreateISCSIInitiatorParams) (tnclient.ISCSIInitiator, error)
+	deleteISCSIInitiator(ctx context.Context, id int32) error
+
+	queryISCSITargets(ctx context.Context, fn ISCSITargetMatcher, first bool, filters []QueryFilter) ([]tnclient.ISCSITarget, error)
+	createISCSITarget(ctx context.Context, params tnclient.CreateISCSITargetParams) (tnclient.ISCSITarget, error)
+	// deleteISCSITarget removes the target even if it has sessions.
+	deleteISCSITarget(ctx context.Context, id int32) error
+
+	queryISCSITargetExtents(ctx context.Context, fn ISCSITargetExtentMatcher, first bool, filters []QueryFilter) ([]tnclient.ISCSITargetExtent, error)
+	createISCSITargetExtent(ctx context.Context, params tnclient.CreateISCSITargetExtentParams) (tnclient.ISCSITargetExtent, error)
+	deleteISCSITargetExtent(ctx context.Context, id int32) error
+}
+
+type nvmeStorage interface {
+	nvmeBaseNQN(ctx context.Context) (string, error)
+	listNVMePorts(ctx context.Context) ([]nvmetPort, error)
+
+	// findNVMeSubsys returns the subsystem with the name, nil if there is none.
+	findNVMeSubsys(ctx context.Context, name string) (*nvmetSubsys, error)
+	createNVMeSubsys(ctx context.Context, name, subnqn string) (nvmetSubsys, error)
+	deleteNVMeSubsys(ctx context.Context, id int32) error
+
+	findNVMeNamespaces(ctx context.Context, subsysID int32) ([]nvmetNamespace, error)
+	createNVMeNamespace(ctx context.Context, devicePath string, subsysID int32) (nvmetNamespace, error)
+	deleteNVMeNamespace(ctx context.Context, id int32) error
+
+	findNVMePortSubsystems(ctx context.Context, subsysID int32) ([]nvmetPortSubsys, error)
+	createNVMePortSubsys(ctx context.Context, portID, subsysID int32) error
+	deleteNVMePortSubsys(ctx context.Context, id int32) error
+}
+
+// filesystemEntry is a file or directory on TrueNAS.
+type filesystemEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // FILE, DIRECTORY or SYMLINK
+}
+
+type filesystemStorage interface {
+	// listDir lists a directory on TrueNAS, only the entries named name if it's not empty.
+	listDir(ctx context.Context, dirPath, name string) ([]filesystemEntry, error)
+	mkdir(ctx context.Context, dirPath string) error
+	// setPermissions runs filesystem.setperm with the options given, waiting for it to finish.
+	setPermissions(ctx context.Context, options map[string]interface{}) error
+}
+
+type systemStorage interface {
+	// systemVersion is the TrueNAS version, e.g. TrueNAS-SCALE-24.04.2.
+	systemVersion(ctx context.Context) (string, error)
+	listUsers(ctx context.Context) ([]tnclient.User, error)
+	listGroups(ctx context.Context) ([]tnclient.Group, error)
+}
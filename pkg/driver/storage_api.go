@@ -0,0 +1,286 @@
+package driver
+
+import (
+	"context"
+	"strconv"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+// apiStorage is the storageBackend of a real TrueNAS, talking to it over the REST or WebSocket API with the SDK's
+// models.
+type apiStorage struct {
+	api apiBackend
+}
+
+// datasetQueryOptions limit dataset queries to what the driver reads. ZFS properties are the bulk of a dataset and
+// pool.dataset reads every one of them otherwise.
+var datasetQueryOptions = queryOptions{
+	selected: []string{"id", "name", "pool", "type", "mountpoint", "refquota", "volsize", "user_properties"},
+	extra:    map[string]interface{}{"properties": []string{"mountpoint", "refquota", "volsize"}},
+}
+
+// smbShareQueryOptions limit SMB share queries to what the driver reads. NFS shares aren't limited as their path field
+// depends on the TrueNAS version.
+var smbShareQueryOptions = queryOptions{selected: []string{"id", "path"}}
+
+func newAPIStorage(api apiBackend) *apiStorage {
+	return &apiStorage{api: api}
+}
+
+func (s *apiStorage) close() error {
+	return s.api.close()
+}
+
+func (s *apiStorage) queryDatasets(ctx context.Context, fn DatasetMatcher, first bool, filters []QueryFilter) ([]tnclient.Dataset, error) {
+	return queryAll[tnclient.Dataset](ctx, s.api, "pool.dataset", fn, first, filters, datasetQueryOptions)
+}
+
+func (s *apiStorage) getDataset(ctx context.Context, id string) (tnclient.Dataset, error) {
+	var dataset tnclient.Dataset
+	err := s.api.get(ctx, "pool.dataset", id, &dataset)
+	return dataset, err
+}
+
+func (s *apiStorage) createDataset(ctx context.Context, params tnclient.CreateDatasetParams) (tnclient.Dataset, error) {
+	var dataset tnclient.Dataset
+	err := s.api.create(ctx, "pool.dataset", params, &dataset)
+	return dataset, err
+}
+
+func (s *apiStorage) updateDataset(ctx context.Context, id string, params tnclient.UpdateDatasetParams) error {
+	return s.api.update(ctx, "pool.dataset", id, params, nil)
+}
+
+func (s *apiStorage) deleteDataset(ctx context.Context, id string) error {
+	return s.api.delete(ctx, "pool.dataset", id)
+}
+
+func (s *apiStorage) querySnapshots(ctx context.Context, fn SnapshotMatcher, first bool, filters []QueryFilter) ([]zfsSnapshot, error) {
+	return queryAll[zfsSnapshot](ctx, s.api, "zfs.snapshot", fn, first, filters, queryOptions{})
+}
+
+func (s *apiStorage) createSnapshot(ctx context.Context, dataset, name string) (zfsSnapshot, error) {
+	var snapshot zfsSnapshot
+	err := s.api.create(ctx, "zfs.snapshot", map[string]interface{}{
+		"dataset": dataset,
+		"name":    name,
+	}, &snapshot)
+	return snapshot, err
+}
+
+func (s *apiStorage) deleteSnapshot(ctx context.Context, id string) error {
+	return s.api.delete(ctx, "zfs.snapshot", id)
+}
+
+func (s *apiStorage) queryNFSShares(ctx context.Context, fn NFSShareMatcher, first bool, filters []QueryFilter) ([]tnclient.ShareNFS, error) {
+	return queryAll[tnclient.ShareNFS](ctx, s.api, "sharing.nfs", fn, first, filters, queryOptions{})
+}
+
+func (s *apiStorage) createNFSShare(ctx context.Context, params tnclient.CreateShareNFSParams) error {
+	return s.api.create(ctx, "sharing.nfs", params, nil)
+}
+
+func (s *apiStorage) updateNFSShare(ctx context.Context, id int32, params tnclient.CreateShareNFSParams) error {
+	return s.api.update(ctx, "sharing.nfs", id, params, nil)
+}
+
+func (s *apiStorage) querySMBShares(ctx context.Context, fn SMBShareMatcher, first bool, filters []QueryFilter) ([]tnclient.ShareSMB, error) {
+	return queryAll[tnclient.ShareSMB](ctx, s.api, "sharing.smb", fn, first, filters, smbShareQueryOptions)
+}
+
+func (s *apiStorage) createSMBShare(ctx context.Context, params tnclient.CreateShareSMBParams) error {
+	return s.api.create(ctx, "sharing.smb", params, nil)
+}
+
+func (s *apiStorage) deleteSMBShare(ctx context.Context, id int32) error {
+	return s.api.delete(ctx, "sharing.smb", id)
+}
+
+func (s *apiStorage) iscsiGlobalConfig(ctx context.Context) (tnclient.ISCSIGlobalConfiguration, error) {
+	var config tnclient.ISCSIGlobalConfiguration
+	err := s.api.config(ctx, "iscsi.global", &config)
+	return config, err
+}
+
+func (s *apiStorage) listISCSIPortals(ctx context.Context) ([]tnclient.ISCSIPortal, error) {
+	return queryAll(ctx, s.api, "iscsi.portal", func(tnclient.ISCSIPortal) bool { return true }, false, nil, queryOptions{})
+}
+
+func (s *apiStorage) queryISCSIExtents(ctx context.Context, fn ISCSIExtentMatcher, first bool, filters []QueryFilter) ([]tnclient.ISCSIExtent, error) {
+	return queryAll[tnclient.ISCSIExtent](ctx, s.api, "iscsi.extent", fn, first, filters, queryOptions{})
+}
+
+func (s *apiStorage) createISCSIExtent(ctx context.Context, params tnclient.CreateISCSIExtentParams, naa string) (tnclient.ISCSIExtent, error) {
+	var extent tnclient.ISCSIExtent
+	data, err := params.ToMap()
+	if err != nil {
+		return extent, err
+	}
+	if naa != "" {
+		data["naa"] = naa
+	}
+	err = s.api.create(ctx, "iscsi.extent", data, &extent)
+	return extent, err
+}
+
+func (s *apiStorage) iscsiExtentNAA(ctx context.Context, id int32) (string, error) {
+	var extent struct {
+		Naa string `json:"naa"`
+	}
+	err := s.api.get(ctx, "iscsi.extent", id, &extent)
+	return extent.Naa, err
+}
+
+func (s *apiStorage) deleteISCSIExtent(ctx context.Context, id int32) error {
+	return s.api.delete(ctx, "iscsi.extent", id, arg("remove", true), arg("force", true))
+}
+
+func (s *apiStorage) queryISCSIInitiators(ctx context.Context, fn ISCSIInitiatorMatcher, first bool, filters []QueryFilter) ([]tnclient.ISCSIInitiator, error) {
+	return queryAll[tnclient.ISCSIInitiator](ctx, s.api, "iscsi.initiator", fn, first, filters, queryOptions{})
+}
+
+func (s *apiStorage) createISCSIInitiator(ctx context.Context, params tnclient.CreateISCSIInitiatorParams) (tnclient.ISCSIInitiator, error) {
+	var initiator tnclient.ISCSIInitiator
+	err := s.api.create(ctx, "iscsi.initiator", params, &initiator)
+	return initiator, err
+}
+
+func (s *apiStorage) deleteISCSIInitiator(ctx context.Context, id int32) error {
+	return s.api.delete(ctx, "iscsi.initiator", id)
+}
+
+func (s *apiStorage) queryISCSITargets(ctx context.Context, fn ISCSITargetMatcher, first bool, filters []QueryFilter) ([]tnclient.ISCSITarget, error) {
+	return queryAll[tnclient.ISCSITarget](ctx, s.api, "iscsi.target", fn, first, filters, queryOptions{})
+}
+
+func (s *apiStorage) createISCSITarget(ctx context.Context, params tnclient.CreateISCSITargetParams) (tnclient.ISCSITarget, error) {
+	var target tnclient.ISCSITarget
+	err := s.api.create(ctx, "iscsi.target", params, &target)
+	return target, err
+}
+
+func (s *apiStorage) deleteISCSITarget(ctx context.Context, id int32) error {
+	return s.api.delete(ctx, "iscsi.target", id, arg("force", true))
+}
+
+func (s *apiStorage) queryISCSITargetExtents(ctx context.Context, fn ISCSITargetExtentMatcher, first bool, filters []QueryFilter) ([]tnclient.ISCSITargetExtent, error) {
+	return queryAll[tnclient.ISCSITargetExtent](ctx, s.api, "iscsi.targetextent", fn, first, filters, queryOptions{})
+}
+
+func (s *apiStorage) createISCSITargetExtent(ctx context.Context, params tnclient.CreateISCSITargetExtentParams) (tnclient.ISCSITargetExtent, error) {
+	var targetExtent tnclient.ISCSITargetExtent
+	err := s.api.create(ctx, "iscsi.targetextent", params, &targetExtent)
+	return targetExtent, err
+}
+
+func (s *apiStorage) deleteISCSITargetExtent(ctx context.Context, id int32) error {
+	return s.api.delete(ctx, "iscsi.targetextent", id)
+}
+
+func (s *apiStorage) nvmeBaseNQN(ctx context.Context) (string, error) {
+	var global struct {
+		Basenqn string `json:"basenqn"`
+	}
+	err := s.api.config(ctx, "nvmet.global", &global)
+	return global.Basenqn, err
+}
+
+func (s *apiStorage) listNVMePorts(ctx context.Context) ([]nvmetPort, error) {
+	return queryAll(ctx, s.api, "nvmet.port", func(nvmetPort) bool { return true }, false, nil, queryOptions{})
+}
+
+func (s *apiStorage) findNVMeSubsys(ctx context.Context, name string) (*nvmetSubsys, error) {
+	subsystems, err := queryAll(ctx, s.api, "nvmet.subsys", func(subsys nvmetSubsys) bool {
+		return subsys.Name == name
+	}, true, []QueryFilter{FilterEqual("name", name)}, queryOptions{})
+	if err != nil || len(subsystems) == 0 {
+		return nil, err
+	}
+	return &subsystems[0], nil
+}
+
+func (s *apiStorage) createNVMeSubsys(ctx context.Context, name, subnqn string) (nvmetSubsys, error) {
+	var subsys nvmetSubsys
+	err := s.api.create(ctx, "nvmet.subsys", map[string]interface{}{
+		"name":           name,
+		"subnqn":         subnqn,
+		"allow_any_host": true,
+	}, &subsys)
+	return subsys, err
+}
+
+func (s *apiStorage) deleteNVMeSubsys(ctx context.Context, id int32) error {
+	return s.api.delete(ctx, "nvmet.subsys", id)
+}
+
+func (s *apiStorage) findNVMeNamespaces(ctx context.Context, subsysID int32) ([]nvmetNamespace, error) {
+	return queryAll(ctx, s.api, "nvmet.namespace", func(namespace nvmetNamespace) bool {
+		return namespace.SubsysID == subsysID
+	}, false, []QueryFilter{FilterEqual("subsys_id", strconv.Itoa(int(subsysID)))}, queryOptions{})
+}
+
+func (s *apiStorage) createNVMeNamespace(ctx context.Context, devicePath string, subsysID int32) (nvmetNamespace, error) {
+	var namespace nvmetNamespace
+	err := s.api.create(ctx, "nvmet.namespace", map[string]interface{}{
+		"device_type": "ZVOL",
+		"device_path": devicePath,
+		"subsys_id":   subsysID,
+	}, &namespace)
+	return namespace, err
+}
+
+func (s *apiStorage) deleteNVMeNamespace(ctx context.Context, id int32) error {
+	return s.api.delete(ctx, "nvmet.namespace", id)
+}
+
+func (s *apiStorage) findNVMePortSubsystems(ctx context.Context, subsysID int32) ([]nvmetPortSubsys, error) {
+	return queryAll(ctx, s.api, "nvmet.port_subsys", func(mapping nvmetPortSubsys) bool {
+		return mapping.SubsysID == subsysID
+	}, false, []QueryFilter{FilterEqual("subsys_id", strconv.Itoa(int(subsysID)))}, queryOptions{})
+}
+
+func (s *apiStorage) createNVMePortSubsys(ctx context.Context, portID, subsysID int32) error {
+	return s.api.create(ctx, "nvmet.port_subsys", map[string]interface{}{
+		"port_id":   portID,
+		"subsys_id": subsysID,
+	}, nil)
+}
+
+func (s *apiStorage) deleteNVMePortSubsys(ctx context.Context, id int32) error {
+	return s.api.delete(ctx, "nvmet.port_subsys", id)
+}
+
+func (s *apiStorage) listDir(ctx context.Context, dirPath, name string) ([]filesystemEntry, error) {
+	filters := [][]interface{}{}
+	if name != "" {
+		filters = append(filters, []interface{}{"name", "=", name})
+	}
+	var entries []filesystemEntry
+	err := s.api.call(ctx, "filesystem.listdir", &entries, arg("path", dirPath), arg("query-filters", filters))
+	return entries, err
+}
+
+func (s *apiStorage) mkdir(ctx context.Context, dirPath string) error {
+	return s.api.call(ctx, "filesystem.mkdir", nil, arg("path", dirPath))
+}
+
+func (s *apiStorage) setPermissions(ctx context.Context, options map[string]interface{}) error {
+	return s.api.job(ctx, "filesystem.setperm", nil, arg("data", options))
+}
+
+func (s *apiStorage) systemVersion(ctx context.Context) (string, error) {
+	var info struct {
+		Version string `json:"version"`
+	}
+	err := s.api.call(ctx, "system.info", &info)
+	return info.Version, err
+}
+
+func (s *apiStorage) listUsers(ctx context.Context) ([]tnclient.User, error) {
+	return queryAll(ctx, s.api, "user", func(tnclient.User) bool { return true }, false, nil, queryOptions{})
+}
+
+func (s *apiStorage) listGroups(ctx context.Context) ([]tnclient.Group, error) {
+	return queryAll(ctx, s.api, "group", func(tnclient.Group) bool { return true }, false, nil, queryOptions{})
+}
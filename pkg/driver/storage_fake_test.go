@@ -0,0 +1,673 @@
+package driver
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+// fakeStorage is an in-memory storageBackend standing in for TrueNAS. Like TrueNAS, deleting a dataset takes its
+// children, snapshots and shares with it. Filters are ignored, the matchers alone pick what's returned.
+type fakeStorage struct {
+	mu     sync.Mutex
+	nextID int32
+
+	datasets      map[string]tnclient.Dataset
+	snapshots     map[string]zfsSnapshot
+	nfsShares     map[int32]tnclient.ShareNFS
+	smbShares     map[int32]tnclient.ShareSMB
+	extents       map[int32]tnclient.ISCSIExtent
+	extentNAAs    map[int32]string
+	initiators    map[int32]tnclient.ISCSIInitiator
+	targets       map[int32]tnclient.ISCSITarget
+	targetExtents map[int32]tnclient.ISCSITargetExtent
+	portals       []tnclient.ISCSIPortal
+	dirs          map[string]bool
+	version       string
+
+	// failures makes the named methods return the error instead of doing anything
+	failures map[string]error
+	// failOnce is like failures for the next call of the named methods only
+	failOnce map[string]error
+	// extentNAAError is returned when an extent is created with an NAA, as by versions which don't take one
+	extentNAAError error
+	// calls counts the calls made to each method
+	calls map[string]int
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{
+		nextID:        1,
+		datasets:      make(map[string]tnclient.Dataset),
+		snapshots:     make(map[string]zfsSnapshot),
+		nfsShares:     make(map[int32]tnclient.ShareNFS),
+		smbShares:     make(map[int32]tnclient.ShareSMB),
+		extents:       make(map[int32]tnclient.ISCSIExtent),
+		extentNAAs:    make(map[int32]string),
+		initiators:    make(map[int32]tnclient.ISCSIInitiator),
+		targets:       make(map[int32]tnclient.ISCSITarget),
+		targetExtents: make(map[int32]tnclient.ISCSITargetExtent),
+		portals: []tnclient.ISCSIPortal{{
+			Id:     1,
+			Tag:    1,
+			Listen: []tnclient.ISCSIPortalListenInner{{Ip: "10.0.0.1", Port: 3260}},
+		}},
+		dirs:     make(map[string]bool),
+		version:  "TrueNAS-SCALE-24.04.2",
+		failures: make(map[string]error),
+		failOnce: make(map[string]error),
+		calls:    make(map[string]int),
+	}
+}
+
+// call records a call to the method, returning the failure set for it if any. The lock must be held.
+func (s *fakeStorage) call(method string) error {
+	s.calls[method]++
+	if err, ok := s.failOnce[method]; ok {
+		delete(s.failOnce, method)
+		return err
+	}
+	return s.failures[method]
+}
+
+func (s *fakeStorage) id() int32 {
+	id := s.nextID
+	s.nextID++
+	return id
+}
+
+// fakeQuery returns the items the matcher accepts in ID order, like TrueNAS sorted by id.
+func fakeQuery[K cmp.Ordered, T any](items map[K]T, fn func(T) bool, first bool) []T {
+	keys := make([]K, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	result := make([]T, 0)
+	for _, key := range keys {
+		if fn(items[key]) {
+			result = append(result, items[key])
+			if first {
+				break
+			}
+		}
+	}
+	return result
+}
+
+// addDataset adds a filesystem dataset, such as the storage path volumes are created in.
+func (s *fakeStorage) addDataset(name string, available int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.datasets[name] = tnclient.Dataset{
+		Id:         name,
+		Name:       name,
+		Type:       "FILESYSTEM",
+		Mountpoint: tnclient.PtrString("/mnt/" + name),
+		Available:  &tnclient.CompositeValue{Rawvalue: strconv.FormatInt(available, 10)},
+	}
+}
+
+func (s *fakeStorage) close() error {
+	return nil
+}
+
+func (s *fakeStorage) queryDatasets(_ context.Context, fn DatasetMatcher, first bool, _ []QueryFilter) ([]tnclient.Dataset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("queryDatasets"); err != nil {
+		return nil, err
+	}
+	return fakeQuery(s.datasets, fn, first), nil
+}
+
+func (s *fakeStorage) getDataset(_ context.Context, id string) (tnclient.Dataset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("getDataset"); err != nil {
+		return tnclient.Dataset{}, err
+	}
+	dataset, ok := s.datasets[id]
+	if !ok {
+		return tnclient.Dataset{}, fmt.Errorf("dataset %s does not exist", id)
+	}
+	return dataset, nil
+}
+
+func (s *fakeStorage) createDataset(_ context.Context, params tnclient.CreateDatasetParams) (tnclient.Dataset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("createDataset"); err != nil {
+		return tnclient.Dataset{}, err
+	}
+	if _, exists := s.datasets[params.Name]; exists {
+		return tnclient.Dataset{}, fmt.Errorf("dataset %s already exists", params.Name)
+	}
+
+	dataset := tnclient.Dataset{
+		Id:                   params.Name,
+		Name:                 params.Name,
+		Type:                 params.GetType(),
+		AdditionalProperties: make(map[string]interface{}),
+	}
+	if dataset.Type == "" {
+		dataset.Type = "FILESYSTEM"
+	}
+	if dataset.Type == "VOLUME" {
+		dataset.Volsize = &tnclient.CompositeValue{Rawvalue: strconv.FormatInt(params.GetVolsize(), 10)}
+	} else {
+		dataset.Mountpoint = tnclient.PtrString("/mnt/" + params.Name)
+	}
+	if properties, ok := params.AdditionalProperties["user_properties"].([]map[string]interface{}); ok {
+		fakeSetUserProperties(&dataset, properties)
+	}
+	s.datasets[dataset.Id] = dataset
+	return dataset, nil
+}
+
+func (s *fakeStorage) updateDataset(_ context.Context, id string, params tnclient.UpdateDatasetParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("updateDataset"); err != nil {
+		return err
+	}
+	dataset, ok := s.datasets[id]
+	if !ok {
+		return fmt.Errorf("dataset %s does not exist", id)
+	}
+	if properties, ok := params.AdditionalProperties["user_properties_update"].([]map[string]interface{}); ok {
+		fakeSetUserProperties(&dataset, properties)
+	}
+	s.datasets[id] = dataset
+	return nil
+}
+
+// fakeSetUserProperties applies user properties given as the create and update calls take them, in the shape
+// GetDatasetUserProperty reads them back.
+func fakeSetUserProperties(dataset *tnclient.Dataset, properties []map[string]interface{}) {
+	if dataset.AdditionalProperties == nil {
+		dataset.AdditionalProperties = make(map[string]interface{})
+	}
+	userProperties, _ := dataset.AdditionalProperties["user_properties"].(map[string]interface{})
+	if userProperties == nil {
+		userProperties = make(map[string]interface{})
+	}
+	for _, property := range properties {
+		key, _ := property["key"].(string)
+		if remove, _ := property["remove"].(bool); remove {
+			delete(userProperties, key)
+			continue
+		}
+		userProperties[key] = map[string]interface{}{"value": property["value"]}
+	}
+	dataset.AdditionalProperties["user_properties"] = userProperties
+}
+
+func (s *fakeStorage) deleteDataset(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("deleteDataset"); err != nil {
+		return err
+	}
+	dataset, ok := s.datasets[id]
+	if !ok {
+		return fmt.Errorf("dataset %s does not exist", id)
+	}
+
+	for name := range s.datasets {
+		if name == id || strings.HasPrefix(name, id+"/") {
+			delete(s.datasets, name)
+		}
+	}
+	for snapshotID, snapshot := range s.snapshots {
+		if snapshot.Dataset == id || strings.HasPrefix(snapshot.Dataset, id+"/") {
+			delete(s.snapshots, snapshotID)
+		}
+	}
+	if mountpoint := dataset.GetMountpoint(); mountpoint != "" {
+		for shareID, share := range s.nfsShares {
+			if (nfsSharePathSchema{}).path(share) == mountpoint {
+				delete(s.nfsShares, shareID)
+			}
+		}
+		for shareID, share := range s.smbShares {
+			if share.GetPath() == mountpoint {
+				delete(s.smbShares, shareID)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *fakeStorage) querySnapshots(_ context.Context, fn SnapshotMatcher, first bool, _ []QueryFilter) ([]zfsSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("querySnapshots"); err != nil {
+		return nil, err
+	}
+	return fakeQuery(s.snapshots, fn, first), nil
+}
+
+func (s *fakeStorage) createSnapshot(_ context.Context, dataset, name string) (zfsSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("createSnapshot"); err != nil {
+		return zfsSnapshot{}, err
+	}
+	if _, ok := s.datasets[dataset]; !ok {
+		return zfsSnapshot{}, fmt.Errorf("dataset %s does not exist", dataset)
+	}
+	snapshot := zfsSnapshot{ID: dataset + "@" + name, Dataset: dataset, SnapshotName: name}
+	if _, exists := s.snapshots[snapshot.ID]; exists {
+		return zfsSnapshot{}, fmt.Errorf("snapshot %s already exists", snapshot.ID)
+	}
+	s.snapshots[snapshot.ID] = snapshot
+	return snapshot, nil
+}
+
+func (s *fakeStorage) deleteSnapshot(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("deleteSnapshot"); err != nil {
+		return err
+	}
+	if _, ok := s.snapshots[id]; !ok {
+		return fmt.Errorf("snapshot %s does not exist", id)
+	}
+	delete(s.snapshots, id)
+	return nil
+}
+
+func (s *fakeStorage) queryNFSShares(_ context.Context, fn NFSShareMatcher, first bool, _ []QueryFilter) ([]tnclient.ShareNFS, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("queryNFSShares"); err != nil {
+		return nil, err
+	}
+	return fakeQuery(s.nfsShares, fn, first), nil
+}
+
+func fakeNFSShare(id int32, params tnclient.CreateShareNFSParams) tnclient.ShareNFS {
+	return tnclient.ShareNFS{
+		Id:           id,
+		Comment:      params.Comment,
+		Hosts:        params.Hosts,
+		Networks:     params.Networks,
+		Ro:           params.Ro,
+		MaprootUser:  params.MaprootUser,
+		MaprootGroup: params.MaprootGroup,
+		MapallUser:   params.MapallUser,
+		MapallGroup:  params.MapallGroup,
+		Security:     params.Security,
+		Enabled:      params.Enabled,
+		Paths:        params.Paths,
+		Path:         params.Path,
+	}
+}
+
+func (s *fakeStorage) createNFSShare(_ context.Context, params tnclient.CreateShareNFSParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("createNFSShare"); err != nil {
+		return err
+	}
+	id := s.id()
+	s.nfsShares[id] = fakeNFSShare(id, params)
+	return nil
+}
+
+func (s *fakeStorage) updateNFSShare(_ context.Context, id int32, params tnclient.CreateShareNFSParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("updateNFSShare"); err != nil {
+		return err
+	}
+	if _, ok := s.nfsShares[id]; !ok {
+		return fmt.Errorf("NFS share %d does not exist", id)
+	}
+	s.nfsShares[id] = fakeNFSShare(id, params)
+	return nil
+}
+
+func (s *fakeStorage) querySMBShares(_ context.Context, fn SMBShareMatcher, first bool, _ []QueryFilter) ([]tnclient.ShareSMB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("querySMBShares"); err != nil {
+		return nil, err
+	}
+	return fakeQuery(s.smbShares, fn, first), nil
+}
+
+func (s *fakeStorage) createSMBShare(_ context.Context, params tnclient.CreateShareSMBParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("createSMBShare"); err != nil {
+		return err
+	}
+	id := s.id()
+	s.smbShares[id] = tnclient.ShareSMB{
+		Id:        id,
+		Path:      params.Path,
+		Name:      params.Name,
+		Comment:   params.Comment,
+		Browsable: params.Browsable,
+		Enabled:   params.Enabled,
+	}
+	return nil
+}
+
+func (s *fakeStorage) deleteSMBShare(_ context.Context, id int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("deleteSMBShare"); err != nil {
+		return err
+	}
+	if _, ok := s.smbShares[id]; !ok {
+		return fmt.Errorf("SMB share %d does not exist", id)
+	}
+	delete(s.smbShares, id)
+	return nil
+}
+
+func (s *fakeStorage) iscsiGlobalConfig(_ context.Context) (tnclient.ISCSIGlobalConfiguration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("iscsiGlobalConfig"); err != nil {
+		return tnclient.ISCSIGlobalConfiguration{}, err
+	}
+	return tnclient.ISCSIGlobalConfiguration{Id: 1, Basename: "iqn.2005-10.org.freenas.ctl"}, nil
+}
+
+func (s *fakeStorage) listISCSIPortals(_ context.Context) ([]tnclient.ISCSIPortal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("listISCSIPortals"); err != nil {
+		return nil, err
+	}
+	return slices.Clone(s.portals), nil
+}
+
+func (s *fakeStorage) queryISCSIExtents(_ context.Context, fn ISCSIExtentMatcher, first bool, _ []QueryFilter) ([]tnclient.ISCSIExtent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("queryISCSIExtents"); err != nil {
+		return nil, err
+	}
+	return fakeQuery(s.extents, fn, first), nil
+}
+
+func (s *fakeStorage) createISCSIExtent(_ context.Context, params tnclient.CreateISCSIExtentParams, naa string) (tnclient.ISCSIExtent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("createISCSIExtent"); err != nil {
+		return tnclient.ISCSIExtent{}, err
+	}
+	if naa != "" && s.extentNAAError != nil {
+		return tnclient.ISCSIExtent{}, s.extentNAAError
+	}
+	// TrueNAS gives DISK extents the path of their zvol
+	extent := tnclient.ISCSIExtent{
+		Id:     s.id(),
+		Name:   params.Name,
+		Type:   params.Type,
+		Disk:   params.Disk,
+		Serial: params.Serial,
+		Path:   params.Disk,
+	}
+	if naa == "" {
+		naa = fmt.Sprintf("0x6589cfc000000%019x", extent.Id)
+	}
+	s.extents[extent.Id] = extent
+	s.extentNAAs[extent.Id] = naa
+	return extent, nil
+}
+
+func (s *fakeStorage) iscsiExtentNAA(_ context.Context, id int32) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("iscsiExtentNAA"); err != nil {
+		return "", err
+	}
+	if _, ok := s.extents[id]; !ok {
+		return "", fmt.Errorf("iSCSI extent %d does not exist", id)
+	}
+	return s.extentNAAs[id], nil
+}
+
+func (s *fakeStorage) deleteISCSIExtent(_ context.Context, id int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("deleteISCSIExtent"); err != nil {
+		return err
+	}
+	if _, ok := s.extents[id]; !ok {
+		return fmt.Errorf("iSCSI extent %d does not exist", id)
+	}
+	delete(s.extents, id)
+	delete(s.extentNAAs, id)
+	return nil
+}
+
+func (s *fakeStorage) queryISCSIInitiators(_ context.Context, fn ISCSIInitiatorMatcher, first bool, _ []QueryFilter) ([]tnclient.ISCSIInitiator, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("queryISCSIInitiators"); err != nil {
+		return nil, err
+	}
+	return fakeQuery(s.initiators, fn, first), nil
+}
+
+func (s *fakeStorage) createISCSIInitiator(_ context.Context, params tnclient.CreateISCSIInitiatorParams) (tnclient.ISCSIInitiator, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("createISCSIInitiator"); err != nil {
+		return tnclient.ISCSIInitiator{}, err
+	}
+	initiator := tnclient.ISCSIInitiator{Id: s.id(), Comment: params.Comment}
+	s.initiators[initiator.Id] = initiator
+	return initiator, nil
+}
+
+func (s *fakeStorage) deleteISCSIInitiator(_ context.Context, id int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("deleteISCSIInitiator"); err != nil {
+		return err
+	}
+	if _, ok := s.initiators[id]; !ok {
+		return fmt.Errorf("iSCSI initiator %d does not exist", id)
+	}
+	delete(s.initiators, id)
+	return nil
+}
+
+func (s *fakeStorage) queryISCSITargets(_ context.Context, fn ISCSITargetMatcher, first bool, _ []QueryFilter) ([]tnclient.ISCSITarget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("queryISCSITargets"); err != nil {
+		return nil, err
+	}
+	return fakeQuery(s.targets, fn, first), nil
+}
+
+func (s *fakeStorage) createISCSITarget(_ context.Context, params tnclient.CreateISCSITargetParams) (tnclient.ISCSITarget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("createISCSITarget"); err != nil {
+		return tnclient.ISCSITarget{}, err
+	}
+	target := tnclient.ISCSITarget{Id: s.id(), Name: params.Name, Alias: params.Alias, Mode: params.GetMode()}
+	for _, group := range params.Groups {
+		target.Groups = append(target.Groups, tnclient.ISCSITargetGroupsInner{
+			Portal:     group.Portal,
+			Initiator:  group.Initiator,
+			Authmethod: group.Authmethod,
+		})
+	}
+	s.targets[target.Id] = target
+	return target, nil
+}
+
+func (s *fakeStorage) deleteISCSITarget(_ context.Context, id int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("deleteISCSITarget"); err != nil {
+		return err
+	}
+	if _, ok := s.targets[id]; !ok {
+		return fmt.Errorf("iSCSI target %d does not exist", id)
+	}
+	delete(s.targets, id)
+	return nil
+}
+
+func (s *fakeStorage) queryISCSITargetExtents(_ context.Context, fn ISCSITargetExtentMatcher, first bool, _ []QueryFilter) ([]tnclient.ISCSITargetExtent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("queryISCSITargetExtents"); err != nil {
+		return nil, err
+	}
+	return fakeQuery(s.targetExtents, fn, first), nil
+}
+
+func (s *fakeStorage) createISCSITargetExtent(_ context.Context, params tnclient.CreateISCSITargetExtentParams) (tnclient.ISCSITargetExtent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("createISCSITargetExtent"); err != nil {
+		return tnclient.ISCSITargetExtent{}, err
+	}
+	if _, ok := s.targets[params.Target]; !ok {
+		return tnclient.ISCSITargetExtent{}, fmt.Errorf("iSCSI target %d does not exist", params.Target)
+	}
+	if _, ok := s.extents[params.Extent]; !ok {
+		return tnclient.ISCSITargetExtent{}, fmt.Errorf("iSCSI extent %d does not exist", params.Extent)
+	}
+	lun := params.GetLunid()
+	for _, targetExtent := range s.targetExtents {
+		if targetExtent.Target == params.Target && targetExtent.GetLunid() == lun {
+			return tnclient.ISCSITargetExtent{}, fmt.Errorf("LUN %d of iSCSI target %d is already in use", lun, params.Target)
+		}
+	}
+	targetExtent := tnclient.ISCSITargetExtent{Id: s.id(), Target: params.Target, Extent: params.Extent, Lunid: tnclient.PtrInt32(lun)}
+	s.targetExtents[targetExtent.Id] = targetExtent
+	return targetExtent, nil
+}
+
+func (s *fakeStorage) deleteISCSITargetExtent(_ context.Context, id int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("deleteISCSITargetExtent"); err != nil {
+		return err
+	}
+	if _, ok := s.targetExtents[id]; !ok {
+		return fmt.Errorf("iSCSI target extent %d does not exist", id)
+	}
+	delete(s.targetExtents, id)
+	return nil
+}
+
+func (s *fakeStorage) nvmeBaseNQN(_ context.Context) (string, error) {
+	return "", fmt.Errorf("NVMe-oF is not faked")
+}
+
+func (s *fakeStorage) listNVMePorts(_ context.Context) ([]nvmetPort, error) {
+	return nil, fmt.Errorf("NVMe-oF is not faked")
+}
+
+func (s *fakeStorage) findNVMeSubsys(_ context.Context, _ string) (*nvmetSubsys, error) {
+	return nil, fmt.Errorf("NVMe-oF is not faked")
+}
+
+func (s *fakeStorage) createNVMeSubsys(_ context.Context, _, _ string) (nvmetSubsys, error) {
+	return nvmetSubsys{}, fmt.Errorf("NVMe-oF is not faked")
+}
+
+func (s *fakeStorage) deleteNVMeSubsys(_ context.Context, _ int32) error {
+	return fmt.Errorf("NVMe-oF is not faked")
+}
+
+func (s *fakeStorage) findNVMeNamespaces(_ context.Context, _ int32) ([]nvmetNamespace, error) {
+	return nil, fmt.Errorf("NVMe-oF is not faked")
+}
+
+func (s *fakeStorage) createNVMeNamespace(_ context.Context, _ string, _ int32) (nvmetNamespace, error) {
+	return nvmetNamespace{}, fmt.Errorf("NVMe-oF is not faked")
+}
+
+func (s *fakeStorage) deleteNVMeNamespace(_ context.Context, _ int32) error {
+	return fmt.Errorf("NVMe-oF is not faked")
+}
+
+func (s *fakeStorage) findNVMePortSubsystems(_ context.Context, _ int32) ([]nvmetPortSubsys, error) {
+	return nil, fmt.Errorf("NVMe-oF is not faked")
+}
+
+func (s *fakeStorage) createNVMePortSubsys(_ context.Context, _, _ int32) error {
+	return fmt.Errorf("NVMe-oF is not faked")
+}
+
+func (s *fakeStorage) deleteNVMePortSubsys(_ context.Context, _ int32) error {
+	return fmt.Errorf("NVMe-oF is not faked")
+}
+
+func (s *fakeStorage) listDir(_ context.Context, dirPath, name string) ([]filesystemEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("listDir"); err != nil {
+		return nil, err
+	}
+	entries := make([]filesystemEntry, 0)
+	for dir := range s.dirs {
+		parent, base := dir[:strings.LastIndex(dir, "/")], dir[strings.LastIndex(dir, "/")+1:]
+		if parent == dirPath && (name == "" || base == name) {
+			entries = append(entries, filesystemEntry{Name: base, Type: "DIRECTORY"})
+		}
+	}
+	return entries, nil
+}
+
+func (s *fakeStorage) mkdir(_ context.Context, dirPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("mkdir"); err != nil {
+		return err
+	}
+	s.dirs[dirPath] = true
+	return nil
+}
+
+func (s *fakeStorage) setPermissions(_ context.Context, _ map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.call("setPermissions")
+}
+
+func (s *fakeStorage) systemVersion(_ context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("systemVersion"); err != nil {
+		return "", err
+	}
+	return s.version, nil
+}
+
+func (s *fakeStorage) listUsers(_ context.Context) ([]tnclient.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return nil, s.call("listUsers")
+}
+
+func (s *fakeStorage) listGroups(_ context.Context) ([]tnclient.Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return nil, s.call("listGroups")
+}
+
+var _ storageBackend = (*fakeStorage)(nil)
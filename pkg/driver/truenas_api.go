@@ -0,0 +1,93 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Ways of talking to TrueNAS, given with --api.
+const (
+	APIREST      = "rest"
+	APIWebSocket = "websocket"
+)
+
+// apiBackend is how the driver talks to the TrueNAS middleware. Its API is a set of methods, mostly the query, create,
+// update and delete methods of services like pool.dataset, which the REST and WebSocket APIs only send differently.
+type apiBackend interface {
+	// query lists a page of the objects of a service matching the filters, ordered by ID.
+	query(ctx context.Context, service string, filters []QueryFilter, options queryOptions, limit, offset int32, result interface{}) error
+	// get fetches an object of a service by its ID.
+	get(ctx context.Context, service string, id, result interface{}) error
+	// config fetches the configuration of a config service like iscsi.global.
+	config(ctx context.Context, service string, result interface{}) error
+	create(ctx context.Context, service string, data, result interface{}) error
+	update(ctx context.Context, service string, id, data, result interface{}) error
+	// delete removes an object of a service, args are the further arguments of its delete method.
+	delete(ctx context.Context, service string, id interface{}, args ...apiArg) error
+	// call runs any other method, decoding its result into result if it's not nil.
+	call(ctx context.Context, method string, result interface{}, args ...apiArg) error
+	// job runs a method which starts a job, waiting for the job to finish and decoding its result.
+	job(ctx context.Context, method string, result interface{}, args ...apiArg) error
+	close() error
+}
+
+// apiArg is an argument of a middleware method, the REST API takes them by name and the WebSocket API by position.
+type apiArg struct {
+	name  string
+	value interface{}
+}
+
+func arg(name string, value interface{}) apiArg {
+	return apiArg{name: name, value: value}
+}
+
+// newAPIBackend validates the URL for the kind of API and returns a backend for it. Neither connects until first used.
+func newAPIBackend(kind, baseURL, accessToken string, debugLogging, ignoreTLS bool) (apiBackend, *url.URL, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse address: %w", err)
+	}
+
+	switch kind {
+	case APIREST:
+		if !strings.HasSuffix(u.Path, "api/v2.0") {
+			return nil, nil, fmt.Errorf("base URL should end with \"api/v2.0\": %s", u.Path)
+		}
+		return newRESTBackend(baseURL, accessToken, debugLogging, ignoreTLS), u, nil
+	case APIWebSocket:
+		if u.Scheme != "ws" && u.Scheme != "wss" {
+			return nil, nil, fmt.Errorf("WebSocket URL should be ws:// or wss://, e.g. wss://truenas/api/current: %s", baseURL)
+		}
+		return newWebSocketBackend(baseURL, accessToken, ignoreTLS), u, nil
+	}
+	return nil, nil, fmt.Errorf("unknown API %q, must be %s or %s", kind, APIREST, APIWebSocket)
+}
+
+// apiInvalidFields returns the fields TrueNAS named when refusing a request as invalid, and whether it was refused as
+// invalid at all. Failed authentication, missing objects and server errors aren't invalid requests.
+func apiInvalidFields(err error) ([]string, bool) {
+	var statusErr *restStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.invalidFields()
+	}
+	var callErr *webSocketCallError
+	if errors.As(err, &callErr) {
+		return callErr.invalidFields()
+	}
+	return nil, false
+}
+
+// apiFieldRejected reports whether TrueNAS refused a request over the given field, which validation errors name
+// prefixed by the method's schema, e.g. iscsi_extent_create.naa.
+func apiFieldRejected(err error, field string) bool {
+	fields, _ := apiInvalidFields(err)
+	for _, invalid := range fields {
+		if invalid == field || strings.HasSuffix(invalid, "."+field) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAPIFieldRejected(t *testing.T) {
+	validation := func(field string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`[[%q, "Field was not expected", 22]]`, field))
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "REST field", err: &restStatusError{statusCode: 422, body: `{"iscsi_extent_create.naa": [{"message": "Field was not expected", "errno": 22}]}`}, want: true},
+		{name: "REST other field", err: &restStatusError{statusCode: 422, body: `{"iscsi_extent_create.disk": [{"message": "Disk is in use", "errno": 22}]}`}},
+		{name: "REST unauthorised", err: &restStatusError{statusCode: 401, body: `{"iscsi_extent_create.naa": []}`}},
+		{name: "REST server error", err: &restStatusError{statusCode: 500, body: "naa"}},
+		{name: "REST not JSON", err: &restStatusError{statusCode: 422, body: "naa"}},
+		{name: "WebSocket field", err: &webSocketCallError{errname: "EINVAL", extra: validation("iscsi_extent_create.naa")}, want: true},
+		{name: "WebSocket invalid params", err: &webSocketCallError{code: webSocketInvalidParams, extra: validation("iscsi_extent_create.naa")}, want: true},
+		{name: "WebSocket other field", err: &webSocketCallError{errname: "EINVAL", extra: validation("iscsi_extent_create.disk")}},
+		{name: "WebSocket other error", err: &webSocketCallError{errname: "ENOENT", extra: validation("iscsi_extent_create.naa")}},
+		{name: "wrapped", err: fmt.Errorf("failed: %w", &restStatusError{statusCode: 422, body: `{"naa": []}`}), want: true},
+		{name: "not from TrueNAS", err: errors.New("naa")},
+		{name: "nil", err: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := apiFieldRejected(tt.err, "naa"); got != tt.want {
+				t.Errorf("apiFieldRejected(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package driver
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// queryPageSize is how many objects are asked for at once, so large collections aren't fetched in one response.
+const queryPageSize = 250
+
+// queryNarrowingRetry is how long a service which rejected a narrowed query is queried in full before trying again.
+const queryNarrowingRetry = 10 * time.Minute
+
+// queryNarrowingRejected holds when services last rejected a narrowed query, they're then filtered client side only.
+var queryNarrowingRejected sync.Map
+
+// queryOptions narrow down the fields a query returns. Only the WebSocket API takes them, the REST API always returns
+// every field.
+type queryOptions struct {
+	// selected are the fields returned, all of them if empty.
+	selected []string
+	// extra are the options of the service, like which ZFS properties pool.dataset reads.
+	extra map[string]interface{}
+}
+
+// rpc is the options as the WebSocket API takes them.
+func (o queryOptions) rpc(limit, offset int32) map[string]interface{} {
+	options := map[string]interface{}{
+		"limit":    limit,
+		"offset":   offset,
+		"order_by": []string{"id"},
+	}
+	if len(o.selected) > 0 {
+		options["select"] = o.selected
+	}
+	if len(o.extra) > 0 {
+		options["extra"] = o.extra
+	}
+	return options
+}
+
+// QueryFilter narrows down what the Find helpers ask TrueNAS for. The matcher is still applied to the results, so a
+// filter only needs to let through everything the matcher accepts.
+type QueryFilter struct {
+	field string
+	op    string
+	value string
+}
+
+// FilterEqual matches objects whose field is the value.
+func FilterEqual(field, value string) QueryFilter {
+	return QueryFilter{field: field, value: value}
+}
+
+// FilterPrefix matches objects whose field starts with the prefix.
+func FilterPrefix(field, prefix string) QueryFilter {
+	return QueryFilter{field: field, op: "regex", value: "^" + regexp.QuoteMeta(prefix)}
+}
+
+// rpc is the filter as the WebSocket API takes it, where numbers have to be given as numbers.
+func (f QueryFilter) rpc() []interface{} {
+	op := "="
+	if f.op == "regex" {
+		op = "~"
+	}
+	var value interface{} = f.value
+	if n, err := strconv.ParseInt(f.value, 10, 64); err == nil && f.op == "" {
+		value = n
+	}
+	return []interface{}{f.field, op, value}
+}
+
+func queryValues(filters []QueryFilter, limit, offset int32) url.Values {
+	values := url.Values{}
+	for _, filter := range filters {
+		key := filter.field
+		if filter.op != "" {
+			key += "__" + filter.op
+		}
+		values.Add(key, filter.value)
+	}
+	values.Set("limit", strconv.Itoa(int(limit)))
+	values.Set("offset", strconv.Itoa(int(offset)))
+	values.Set("sort", "id")
+	return values
+}
+
+// queryAll pages through the objects of a TrueNAS service returning what the matcher accepts, only the first match if
+// first is set. The filters and options are sent along, if TrueNAS refuses them as invalid every object is fetched
+// instead for a while.
+func queryAll[T any](ctx context.Context, api apiBackend, service string, fn func(T) bool, first bool, filters []QueryFilter, options queryOptions) ([]T, error) {
+	narrowed := len(filters) > 0 || len(options.selected) > 0 || len(options.extra) > 0
+	if rejected, ok := queryNarrowingRejected.Load(service); ok && narrowed {
+		if time.Since(rejected.(time.Time)) < queryNarrowingRetry {
+			filters, options, narrowed = nil, queryOptions{}, false
+		} else {
+			queryNarrowingRejected.Delete(service)
+		}
+	}
+
+	result := make([]T, 0)
+	for offset := int32(0); ; offset += queryPageSize {
+		var items []T
+		if err := api.query(ctx, service, filters, options, queryPageSize, offset, &items); err != nil {
+			if _, invalid := apiInvalidFields(err); narrowed && invalid {
+				klog.V(4).InfoS("narrowed query rejected, filtering client side", "service", service, "err", err)
+				queryNarrowingRejected.Store(service, time.Now())
+				return queryAll(ctx, api, service, fn, first, nil, queryOptions{})
+			}
+			return nil, err
+		}
+
+		for _, item := range items {
+			if fn(item) {
+				result = append(result, item)
+				if first {
+					return result, nil
+				}
+			}
+		}
+
+		if len(items) < queryPageSize {
+			return result, nil
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeQueryBackend answers queries for the IDs 1 to items, recording what it was asked. Narrowed queries fail with
+// rejection when it's set.
+type fakeQueryBackend struct {
+	apiBackend
+	items     int
+	rejection error
+	queries   []recordedQuery
+}
+
+type recordedQuery struct {
+	filters []QueryFilter
+	options queryOptions
+	offset  int32
+}
+
+type fakeQueryItem struct {
+	ID int `json:"id"`
+}
+
+func (b *fakeQueryBackend) query(_ context.Context, _ string, filters []QueryFilter, options queryOptions, limit, offset int32, result interface{}) error {
+	b.queries = append(b.queries, recordedQuery{filters: filters, options: options, offset: offset})
+	if b.rejection != nil && (len(filters) > 0 || len(options.selected) > 0) {
+		return b.rejection
+	}
+
+	items := make([]fakeQueryItem, 0)
+	for id := int(offset) + 1; id <= b.items && len(items) < int(limit); id++ {
+		items = append(items, fakeQueryItem{ID: id})
+	}
+	data, _ := json.Marshal(items)
+	return json.Unmarshal(data, result)
+}
+
+// queryIDs runs queryAll for every item with an ID divisible by 100, filtered on a made up field.
+func queryIDs(t *testing.T, api apiBackend, service string, options queryOptions) ([]int, error) {
+	t.Helper()
+	t.Cleanup(func() { queryNarrowingRejected.Delete(service) })
+
+	items, err := queryAll(context.Background(), api, service, func(item fakeQueryItem) bool {
+		return item.ID%100 == 0
+	}, false, []QueryFilter{FilterEqual("hundreds", "true")}, options)
+	ids := make([]int, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids, err
+}
+
+func TestQueryAllPages(t *testing.T) {
+	api := &fakeQueryBackend{items: 2*queryPageSize + 1}
+	options := queryOptions{selected: []string{"id"}}
+
+	ids, err := queryIDs(t, api, "test.pages", options)
+	if err != nil {
+		t.Fatalf("queryAll failed: %v", err)
+	}
+	if want := []int{100, 200, 300, 400, 500}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+	if len(api.queries) != 3 {
+		t.Fatalf("made %d queries, want 3", len(api.queries))
+	}
+	for i, query := range api.queries {
+		if query.offset != int32(i)*queryPageSize || len(query.filters) != 1 || !reflect.DeepEqual(query.options, options) {
+			t.Errorf("query %d was %+v, want offset %d with the filter and options", i, query, int32(i)*queryPageSize)
+		}
+	}
+}
+
+func TestQueryAllFallsBackOnInvalidQueries(t *testing.T) {
+	tests := []struct {
+		name      string
+		rejection error
+	}{
+		{name: "REST", rejection: &restStatusError{statusCode: 422, body: `{"query-filters": []}`}},
+		{name: "WebSocket", rejection: &webSocketCallError{code: webSocketInvalidParams}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := "test.fallback." + tt.name
+			api := &fakeQueryBackend{items: 300, rejection: tt.rejection}
+
+			for i := 0; i < 2; i++ {
+				ids, err := queryIDs(t, api, service, queryOptions{selected: []string{"id"}})
+				if err != nil {
+					t.Fatalf("queryAll failed: %v", err)
+				}
+				if want := []int{100, 200, 300}; !reflect.DeepEqual(ids, want) {
+					t.Errorf("got %v, want %v", ids, want)
+				}
+			}
+			// The first query is narrowed and rejected, the rest fetch everything without trying again
+			if len(api.queries) != 5 {
+				t.Fatalf("made %d queries, want 5", len(api.queries))
+			}
+			for i, query := range api.queries[1:] {
+				if query.filters != nil || !reflect.DeepEqual(query.options, queryOptions{}) {
+					t.Errorf("query %d was narrowed, %+v", i+1, query)
+				}
+			}
+
+			// Narrowing is tried again after a while
+			queryNarrowingRejected.Store(service, time.Now().Add(-queryNarrowingRetry))
+			api.rejection, api.queries = nil, nil
+			if _, err := queryIDs(t, api, service, queryOptions{}); err != nil {
+				t.Fatalf("queryAll failed: %v", err)
+			}
+			if len(api.queries) != 2 || len(api.queries[0].filters) != 1 {
+				t.Errorf("queries weren't filtered again, %+v", api.queries)
+			}
+		})
+	}
+}
+
+func TestQueryAllReturnsOtherErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		rejection error
+	}{
+		{name: "unauthorised", rejection: &restStatusError{statusCode: 401, body: `{"query-filters": []}`}},
+		{name: "server error", rejection: &restStatusError{statusCode: 500}},
+		{name: "WebSocket error", rejection: &webSocketCallError{errname: "EFAULT"}},
+		{name: "unreachable", rejection: &url.Error{Op: "Get", URL: "https://truenas/api/v2.0", Err: errors.New("connection refused")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := "test.errors." + tt.name
+			api := &fakeQueryBackend{items: 300, rejection: tt.rejection}
+
+			if _, err := queryIDs(t, api, service, queryOptions{}); !errors.Is(err, tt.rejection) {
+				t.Errorf("queryAll returned %v, want %v", err, tt.rejection)
+			}
+			if len(api.queries) != 1 {
+				t.Errorf("made %d queries, want 1", len(api.queries))
+			}
+			if _, rejected := queryNarrowingRejected.Load(service); rejected {
+				t.Error("service was queried in full after the error")
+			}
+		})
+	}
+}
+
+func TestQueryOptionsRPC(t *testing.T) {
+	if got := (queryOptions{}).rpc(10, 20); !reflect.DeepEqual(got, map[string]interface{}{"limit": int32(10), "offset": int32(20), "order_by": []string{"id"}}) {
+		t.Errorf("empty options = %v, want only paging", got)
+	}
+
+	got := datasetQueryOptions.rpc(10, 20)
+	if !reflect.DeepEqual(got["select"], datasetQueryOptions.selected) || !reflect.DeepEqual(got["extra"], datasetQueryOptions.extra) {
+		t.Errorf("dataset options = %v, want the selected fields and extra", got)
+	}
+}
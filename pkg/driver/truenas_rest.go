@@ -0,0 +1,256 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+	"golang.org/x/oauth2"
+)
+
+// jobPollInterval is how often a TrueNAS job is checked on while waiting for it to finish.
+const jobPollInterval = 500 * time.Millisecond
+
+// restStatusError is returned by restRequest when TrueNAS answers with an error status.
+type restStatusError struct {
+	method     string
+	endpoint   string
+	status     string
+	statusCode int
+	body       string
+}
+
+func (e *restStatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s: %s", e.method, e.endpoint, e.status, e.body)
+}
+
+// invalidFields returns the fields named by a validation error, and whether the request was refused as invalid at
+// all. Validation errors are sent as 422 with the errors keyed by field, like {"sharing_nfs_create.path": [...]}.
+func (e *restStatusError) invalidFields() ([]string, bool) {
+	if e.statusCode != http.StatusBadRequest && e.statusCode != http.StatusUnprocessableEntity {
+		return nil, false
+	}
+	var errs map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(e.body), &errs); err != nil {
+		return nil, true
+	}
+	fields := make([]string, 0, len(errs))
+	for field := range errs {
+		fields = append(fields, field)
+	}
+	return fields, true
+}
+
+// restBackend sends middleware methods to the REST API, api/v2.0, through the SDK's authenticated HTTP client.
+type restBackend struct {
+	client *tnclient.APIClient
+}
+
+func newRESTBackend(baseURL, accessToken string, debugLogging, ignoreTLS bool) *restBackend {
+	apiCtx := context.Background()
+	tr := &http.Transport{
+		// This defaults to false
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: ignoreTLS}, //nolint:gosec
+	}
+	tlsClient := &http.Client{Transport: tr}
+	apiCtx = context.WithValue(apiCtx, oauth2.HTTPClient, tlsClient)
+
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken})
+	tc := oauth2.NewClient(apiCtx, ts)
+	config := tnclient.NewConfiguration()
+	config.Servers = tnclient.ServerConfigurations{tnclient.ServerConfiguration{URL: baseURL}}
+	config.Debug = debugLogging
+	config.HTTPClient = tc
+	return &restBackend{client: tnclient.NewAPIClient(config)}
+}
+
+// restPath is the endpoint of a service or method, pool.dataset is served at pool/dataset.
+func restPath(name string) string {
+	return strings.ReplaceAll(name, ".", "/")
+}
+
+func restInstancePath(service string, id interface{}) string {
+	return restPath(service) + "/id/" + url.PathEscape(fmt.Sprint(id))
+}
+
+// restBody is what the arguments of a method are sent as, a lone argument as itself and several by name.
+func restBody(args []apiArg) interface{} {
+	switch len(args) {
+	case 0:
+		return nil
+	case 1:
+		return args[0].value
+	}
+	body := make(map[string]interface{}, len(args))
+	for _, a := range args {
+		body[a.name] = a.value
+	}
+	return body
+}
+
+// query ignores the options, the REST API only takes filters, limit, offset and sort as query parameters.
+func (b *restBackend) query(ctx context.Context, service string, filters []QueryFilter, _ queryOptions, limit, offset int32, result interface{}) error {
+	return restRequest(ctx, b.client, http.MethodGet, restPath(service)+"?"+queryValues(filters, limit, offset).Encode(), nil, result)
+}
+
+func (b *restBackend) get(ctx context.Context, service string, id, result interface{}) error {
+	return restRequest(ctx, b.client, http.MethodGet, restInstancePath(service, id), nil, result)
+}
+
+func (b *restBackend) config(ctx context.Context, service string, result interface{}) error {
+	return restRequest(ctx, b.client, http.MethodGet, restPath(service), nil, result)
+}
+
+func (b *restBackend) create(ctx context.Context, service string, data, result interface{}) error {
+	return restRequest(ctx, b.client, http.MethodPost, restPath(service), data, result)
+}
+
+func (b *restBackend) update(ctx context.Context, service string, id, data, result interface{}) error {
+	return restRequest(ctx, b.client, http.MethodPut, restInstancePath(service, id), data, result)
+}
+
+func (b *restBackend) delete(ctx context.Context, service string, id interface{}, args ...apiArg) error {
+	return restRequest(ctx, b.client, http.MethodDelete, restInstancePath(service, id), restBody(args), nil)
+}
+
+// call sends methods without arguments as GETs, like system/info, and the rest as POSTs.
+func (b *restBackend) call(ctx context.Context, method string, result interface{}, args ...apiArg) error {
+	if len(args) == 0 {
+		return restRequest(ctx, b.client, http.MethodGet, restPath(method), nil, result)
+	}
+	return restRequest(ctx, b.client, http.MethodPost, restPath(method), restBody(args), result)
+}
+
+func (b *restBackend) job(ctx context.Context, method string, result interface{}, args ...apiArg) error {
+	var jobID int64
+	if err := b.call(ctx, method, &jobID, args...); err != nil {
+		return err
+	}
+
+	job, err := b.waitForJob(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	return job.decodeResult(result)
+}
+
+func (b *restBackend) close() error {
+	return nil
+}
+
+// restRequest makes a request to the TrueNAS API the client is configured for, with the client's authentication.
+func restRequest(ctx context.Context, client *tnclient.APIClient, method, endpoint string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(client.GetConfig().Servers[0].URL, "/")+"/"+strings.TrimPrefix(endpoint, "/"), reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.GetConfig().HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return &restStatusError{method: method, endpoint: endpoint, status: resp.Status, statusCode: resp.StatusCode, body: strings.TrimSpace(string(data))}
+	}
+
+	if result != nil {
+		if err = json.Unmarshal(data, result); err != nil {
+			return fmt.Errorf("failed to parse response of %s %s: %w", method, endpoint, err)
+		}
+	}
+	return nil
+}
+
+type trueNASJob struct {
+	ID       int64           `json:"id"`
+	State    string          `json:"state"`
+	Error    string          `json:"error"`
+	Result   json.RawMessage `json:"result"`
+	Progress struct {
+		Percent     float64 `json:"percent"`
+		Description string  `json:"description"`
+	} `json:"progress"`
+}
+
+// finished reports whether the job has stopped, returning its error if it failed.
+func (j *trueNASJob) finished() (bool, error) {
+	switch j.State {
+	case "SUCCESS":
+		return true, nil
+	case "FAILED", "ABORTED":
+		return true, fmt.Errorf("job %d %s: %s", j.ID, strings.ToLower(j.State), j.Error)
+	}
+	return false, nil
+}
+
+func (j *trueNASJob) decodeResult(result interface{}) error {
+	if result == nil || len(j.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(j.Result, result); err != nil {
+		return fmt.Errorf("failed to parse result of job %d: %w", j.ID, err)
+	}
+	return nil
+}
+
+// getJob fetches a TrueNAS job by its ID.
+func getJob(ctx context.Context, api apiBackend, jobID int64) (*trueNASJob, error) {
+	var jobs []trueNASJob
+	if err := api.query(ctx, "core.get_jobs", []QueryFilter{FilterEqual("id", strconv.FormatInt(jobID, 10))}, queryOptions{}, 1, 0, &jobs); err != nil {
+		return nil, fmt.Errorf("failed to get job %d: %w", jobID, err)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("job %d not found", jobID)
+	}
+	return &jobs[0], nil
+}
+
+// waitForJob polls a TrueNAS job until it has finished, returning its error if it failed.
+func (b *restBackend) waitForJob(ctx context.Context, jobID int64) (*trueNASJob, error) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := getJob(ctx, b, jobID)
+		if err != nil {
+			return nil, err
+		}
+		if done, err := job.finished(); done {
+			return job, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
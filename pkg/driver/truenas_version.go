@@ -0,0 +1,137 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"k8s.io/klog/v2"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+// minTrueNASVersion is the oldest TrueNAS SCALE release the driver works with.
+var minTrueNASVersion = trueNASVersion{major: 22, minor: 2}
+
+// trueNASVersionPattern picks the year and month out of versions like TrueNAS-SCALE-22.12.4 or
+// TrueNAS-SCALE-Dragonfish-24.04.2.
+var trueNASVersionPattern = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+type trueNASVersion struct {
+	major int
+	minor int
+	raw   string
+}
+
+func (v trueNASVersion) atLeast(other trueNASVersion) bool {
+	return v.major > other.major || (v.major == other.major && v.minor >= other.minor)
+}
+
+func parseTrueNASVersion(raw string) (trueNASVersion, error) {
+	match := trueNASVersionPattern.FindStringSubmatch(raw)
+	if match == nil {
+		return trueNASVersion{}, fmt.Errorf("unrecognised TrueNAS version %q", raw)
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	return trueNASVersion{major: major, minor: minor, raw: raw}, nil
+}
+
+// detectTrueNASVersion gets the version of TrueNAS from its system info, failing if it isn't supported.
+func (d *Driver) detectTrueNASVersion(ctx context.Context) (trueNASVersion, error) {
+	rawVersion, err := d.storage.systemVersion(ctx)
+	if err != nil {
+		return trueNASVersion{}, fmt.Errorf("failed to get TrueNAS system info: %w", err)
+	}
+
+	version, err := parseTrueNASVersion(rawVersion)
+	if err != nil {
+		return trueNASVersion{}, err
+	}
+	// CORE versions (13.0 and the like) come out below the first SCALE release too
+	if !version.atLeast(minTrueNASVersion) {
+		return trueNASVersion{}, fmt.Errorf("TrueNAS %s is not supported, TrueNAS SCALE %d.%02d or newer is required", rawVersion, minTrueNASVersion.major, minTrueNASVersion.minor)
+	}
+	return version, nil
+}
+
+// loadTrueNASVersion detects the version of TrueNAS and picks the NFS share schema for it, unless already done.
+func (d *Driver) loadTrueNASVersion(ctx context.Context) error {
+	d.apiStateMu.Lock()
+	defer d.apiStateMu.Unlock()
+	if d.versionLoaded {
+		return nil
+	}
+
+	version, err := d.detectTrueNASVersion(ctx)
+	if err != nil {
+		return err
+	}
+	d.version = version
+	d.nfsShares = nfsShareSchemaFor(version)
+	d.versionLoaded = true
+	klog.InfoS("detected TrueNAS version", "version", version.raw)
+	return nil
+}
+
+// nfsShareSchema hides how the shared path is given on NFS shares, which changed without an API version bump.
+type nfsShareSchema interface {
+	// setPath sets the path to share on share creation parameters.
+	setPath(params *tnclient.CreateShareNFSParams, path string)
+	// path returns the path a share shares, empty if none.
+	path(share tnclient.ShareNFS) string
+	// pathFilters returns the query filters which find the shares of a path, the matcher still checks the path.
+	pathFilters(path string) []QueryFilter
+}
+
+// nfsSharePathsSchema is used before 24.04, where shares took a list of paths.
+type nfsSharePathsSchema struct{}
+
+func (nfsSharePathsSchema) setPath(params *tnclient.CreateShareNFSParams, path string) {
+	params.Path = nil
+	params.Paths = []string{path}
+}
+
+func (nfsSharePathsSchema) path(share tnclient.ShareNFS) string {
+	if paths := share.GetPaths(); len(paths) > 0 {
+		return paths[0]
+	}
+	return share.GetPath()
+}
+
+// pathFilters returns no filters, a path in a list can't be filtered on the same way over both APIs.
+func (nfsSharePathsSchema) pathFilters(string) []QueryFilter {
+	return nil
+}
+
+// nfsSharePathSchema is used from 24.04, where shares have a single path.
+type nfsSharePathSchema struct{}
+
+func (nfsSharePathSchema) setPath(params *tnclient.CreateShareNFSParams, path string) {
+	params.Paths = nil
+	params.Path = tnclient.PtrString(path)
+}
+
+func (nfsSharePathSchema) path(share tnclient.ShareNFS) string {
+	if path := share.GetPath(); path != "" {
+		return path
+	}
+	if paths := share.GetPaths(); len(paths) > 0 {
+		return paths[0]
+	}
+	return ""
+}
+
+func (nfsSharePathSchema) pathFilters(path string) []QueryFilter {
+	return []QueryFilter{FilterEqual("path", path)}
+}
+
+// nfsShareSchemaFor picks the schema of a version. Shares are read either way, so shares made before an upgrade are
+// still found.
+func nfsShareSchemaFor(version trueNASVersion) nfsShareSchema {
+	if version.atLeast(trueNASVersion{major: 24, minor: 4}) {
+		return nfsSharePathSchema{}
+	}
+	return nfsSharePathsSchema{}
+}
@@ -0,0 +1,128 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	tnclient "github.com/terricain/truenas-go-sdk/pkg/truenas"
+)
+
+func TestDetectTrueNASVersion(t *testing.T) {
+	tests := []struct {
+		raw        string
+		want       trueNASVersion
+		wantErr    bool
+		wantSchema nfsShareSchema
+	}{
+		{raw: "TrueNAS-SCALE-22.12.4", want: trueNASVersion{major: 22, minor: 12}, wantSchema: nfsSharePathsSchema{}},
+		{raw: "TrueNAS-SCALE-23.10.2", want: trueNASVersion{major: 23, minor: 10}, wantSchema: nfsSharePathsSchema{}},
+		{raw: "TrueNAS-SCALE-Dragonfish-24.04.2", want: trueNASVersion{major: 24, minor: 4}, wantSchema: nfsSharePathSchema{}},
+		{raw: "TrueNAS-SCALE-24.10.0", want: trueNASVersion{major: 24, minor: 10}, wantSchema: nfsSharePathSchema{}},
+		{raw: "TrueNAS-25.04.1", want: trueNASVersion{major: 25, minor: 4}, wantSchema: nfsSharePathSchema{}},
+		{raw: "TrueNAS-13.0-U6.1", wantErr: true},
+		{raw: "TrueNAS-SCALE-22.02.0", want: trueNASVersion{major: 22, minor: 2}, wantSchema: nfsSharePathsSchema{}},
+		{raw: "TrueNAS-SCALE-21.08", wantErr: true},
+		{raw: "TrueNAS-SCALE-MASTER", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			d, storage := newTestDriver(t, TypeNFS)
+			storage.version = tt.raw
+
+			got, err := d.detectTrueNASVersion(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("detectTrueNASVersion() returned %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			tt.want.raw = tt.raw
+			if got != tt.want {
+				t.Errorf("detectTrueNASVersion() = %+v, want %+v", got, tt.want)
+			}
+			if schema := nfsShareSchemaFor(got); schema != tt.wantSchema {
+				t.Errorf("nfsShareSchemaFor(%s) = %T, want %T", tt.raw, schema, tt.wantSchema)
+			}
+		})
+	}
+}
+
+func TestNFSShareSchemas(t *testing.T) {
+	var pathParams, pathsParams tnclient.CreateShareNFSParams
+	nfsSharePathSchema{}.setPath(&pathParams, "/mnt/tank/a")
+	nfsSharePathsSchema{}.setPath(&pathsParams, "/mnt/tank/a")
+	if pathParams.GetPath() != "/mnt/tank/a" || pathParams.Paths != nil {
+		t.Errorf("path schema set path %q and paths %v", pathParams.GetPath(), pathParams.Paths)
+	}
+	if pathsParams.Path != nil || !reflect.DeepEqual(pathsParams.Paths, []string{"/mnt/tank/a"}) {
+		t.Errorf("paths schema set path %v and paths %v", pathsParams.Path, pathsParams.Paths)
+	}
+
+	// Shares made under either schema are read by both, as they outlive upgrades
+	for _, share := range []tnclient.ShareNFS{
+		{Path: tnclient.PtrString("/mnt/tank/a")},
+		{Paths: []string{"/mnt/tank/a"}},
+	} {
+		for _, schema := range []nfsShareSchema{nfsSharePathSchema{}, nfsSharePathsSchema{}} {
+			if got := schema.path(share); got != "/mnt/tank/a" {
+				t.Errorf("%T read %q from share with path %v and paths %v", schema, got, share.Path, share.Paths)
+			}
+		}
+	}
+
+	// Only the single path can be filtered on server side
+	if got, want := (nfsSharePathSchema{}).pathFilters("/mnt/tank/a"), []QueryFilter{FilterEqual("path", "/mnt/tank/a")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("path schema filters = %v, want %v", got, want)
+	}
+	if got := (nfsSharePathsSchema{}).pathFilters("/mnt/tank/a"); got != nil {
+		t.Errorf("paths schema filters = %v, want none", got)
+	}
+}
+
+func TestNFSCreateVolumeUsesVersionSchema(t *testing.T) {
+	for _, schema := range []nfsShareSchema{nfsSharePathSchema{}, nfsSharePathsSchema{}} {
+		d, storage := newTestDriver(t, TypeNFS)
+		d.nfsShares = schema
+
+		volume := createTwice(t, d, createVolumeRequest("pvc-1", nil))
+		if len(storage.nfsShares) != 1 {
+			t.Fatalf("got %d shares, want 1", len(storage.nfsShares))
+		}
+		for _, share := range storage.nfsShares {
+			_, isPath := schema.(nfsSharePathSchema)
+			if (share.Path != nil) != isPath || (share.Paths != nil) == isPath {
+				t.Errorf("%T created share with path %v and paths %v", schema, share.Path, share.Paths)
+			}
+			if got := schema.path(share); got != volume.GetVolumeContext()[NFSVolumeContextParamMountPoint] {
+				t.Errorf("share path = %q, want the mount point", got)
+			}
+		}
+	}
+}
+
+func TestNFSCreateVolumeDoesNotRetryRejectedShare(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "validation", err: &restStatusError{statusCode: 422, body: `{"sharing_nfs_create.hosts": [{"message": "Invalid host", "errno": 22}]}`}},
+		{name: "unauthorised", err: &restStatusError{statusCode: 401, body: "Unauthorized"}},
+		{name: "server error", err: &webSocketCallError{code: -32001, errname: "EFAULT"}},
+		{name: "unreachable", err: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, storage := newTestDriver(t, TypeNFS)
+			storage.failures["createNFSShare"] = tt.err
+
+			if _, err := d.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil)); !errors.Is(err, tt.err) {
+				t.Errorf("CreateVolume returned %v, want %v", err, tt.err)
+			}
+			if got := storage.calls["createNFSShare"]; got != 1 {
+				t.Errorf("share was created %d times, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,445 @@
+package driver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// webSocketPingInterval is how often an idle connection is checked, so a dead one is replaced before it's needed.
+	webSocketPingInterval = 30 * time.Second
+	// webSocketJobPollInterval is how often a job is checked on besides its events, which are lost if the connection
+	// drops while waiting.
+	webSocketJobPollInterval = 5 * time.Second
+)
+
+// errWebSocketClosed is returned by calls in flight on a backend being closed.
+var errWebSocketClosed = errors.New("TrueNAS WebSocket backend closed")
+
+// webSocketInvalidParams is the JSON-RPC error code of a call whose arguments don't fit the method.
+const webSocketInvalidParams = -32602
+
+// webSocketCallError is a method call TrueNAS answered with an error.
+type webSocketCallError struct {
+	method  string
+	code    int
+	message string
+	reason  string
+	errname string // errno name, EINVAL for validation errors
+	// extra holds the validation errors as [field, message, errno] lists
+	extra json.RawMessage
+}
+
+func (e *webSocketCallError) Error() string {
+	if e.reason != "" {
+		return fmt.Sprintf("%s: %s", e.method, e.reason)
+	}
+	return fmt.Sprintf("%s: %s (%d)", e.method, e.message, e.code)
+}
+
+// invalidFields returns the fields named by a validation error, and whether the call was refused as invalid at all.
+func (e *webSocketCallError) invalidFields() ([]string, bool) {
+	if e.code != webSocketInvalidParams && e.errname != "EINVAL" {
+		return nil, false
+	}
+	var extra [][]interface{}
+	if err := json.Unmarshal(e.extra, &extra); err != nil {
+		return nil, true
+	}
+	fields := make([]string, 0, len(extra))
+	for _, item := range extra {
+		if len(item) > 0 {
+			if field, ok := item[0].(string); ok {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields, true
+}
+
+type webSocketRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int64         `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+// webSocketMessage is a response to a call, with an ID, or a notification like a collection update, without.
+type webSocketMessage struct {
+	ID     *int64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Data    struct {
+			Reason  string          `json:"reason"`
+			Errname string          `json:"errname"`
+			Extra   json.RawMessage `json:"extra"`
+		} `json:"data"`
+	} `json:"error"`
+}
+
+type webSocketCollectionUpdate struct {
+	Collection string          `json:"collection"`
+	ID         int64           `json:"id"`
+	Fields     json.RawMessage `json:"fields"`
+}
+
+// webSocketConn is an authenticated connection and the calls waiting on an answer over it.
+type webSocketConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex // serialises writes to ws
+
+	mu      sync.Mutex // protects pending and err
+	pending map[int64]chan webSocketMessage
+	err     error // why the connection closed, set once it has
+	done    chan struct{}
+}
+
+// webSocketBackend sends middleware methods over the WebSocket JSON-RPC API, api/current, on one persistent connection.
+// It connects on first use and again whenever the connection drops.
+type webSocketBackend struct {
+	url         string
+	origin      string
+	accessToken string
+	tlsConfig   *tls.Config
+	lastID      atomic.Int64
+
+	connectMu sync.Mutex // serialises connecting
+	mu        sync.Mutex // protects conn, jobWatchers and closed
+	conn      *webSocketConn
+	// jobWatchers get the updates of jobs being waited for from core.get_jobs events
+	jobWatchers map[int64]chan trueNASJob
+	closed      bool
+}
+
+func newWebSocketBackend(baseURL, accessToken string, ignoreTLS bool) *webSocketBackend {
+	origin := "http" + strings.TrimPrefix(baseURL, "ws")
+	return &webSocketBackend{
+		url:         baseURL,
+		origin:      origin,
+		accessToken: accessToken,
+		// This defaults to false
+		tlsConfig:   &tls.Config{InsecureSkipVerify: ignoreTLS}, //nolint:gosec
+		jobWatchers: make(map[int64]chan trueNASJob),
+	}
+}
+
+// connection returns the current connection, connecting, logging in and subscribing to job updates if there is none.
+func (b *webSocketBackend) connection(ctx context.Context) (*webSocketConn, error) {
+	b.connectMu.Lock()
+	defer b.connectMu.Unlock()
+
+	b.mu.Lock()
+	conn, closed := b.conn, b.closed
+	b.mu.Unlock()
+	if closed {
+		return nil, errWebSocketClosed
+	}
+	if conn != nil {
+		return conn, nil
+	}
+
+	config, err := websocket.NewConfig(b.url, b.origin)
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = b.tlsConfig
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", b.url, err)
+	}
+	conn = &webSocketConn{ws: ws, pending: make(map[int64]chan webSocketMessage), done: make(chan struct{})}
+	go b.readLoop(conn)
+
+	var loggedIn bool
+	if err = b.send(ctx, conn, "auth.login_with_api_key", []interface{}{b.accessToken}, &loggedIn); err == nil && !loggedIn {
+		err = errors.New("access token was refused")
+	}
+	if err == nil {
+		err = b.send(ctx, conn, "core.subscribe", []interface{}{"core.get_jobs"}, nil)
+	}
+	if err != nil {
+		conn.close(err)
+		return nil, fmt.Errorf("failed to log in to %s: %w", b.url, err)
+	}
+	klog.V(4).InfoS("connected to TrueNAS WebSocket API", "url", b.url)
+
+	b.mu.Lock()
+	b.conn = conn
+	b.mu.Unlock()
+	go b.keepAlive(conn)
+	return conn, nil
+}
+
+// send calls a method over a connection, decoding its result into result if it's not nil.
+func (b *webSocketBackend) send(ctx context.Context, conn *webSocketConn, method string, params []interface{}, result interface{}) error {
+	id := b.lastID.Add(1)
+	answer := make(chan webSocketMessage, 1)
+
+	conn.mu.Lock()
+	if conn.err != nil {
+		conn.mu.Unlock()
+		return conn.err
+	}
+	conn.pending[id] = answer
+	conn.mu.Unlock()
+	defer func() {
+		conn.mu.Lock()
+		delete(conn.pending, id)
+		conn.mu.Unlock()
+	}()
+
+	if params == nil {
+		params = []interface{}{}
+	}
+	klog.V(5).InfoS("[Debug] calling TrueNAS method", "method", method, "id", id)
+	conn.writeMu.Lock()
+	err := websocket.JSON.Send(conn.ws, webSocketRequest{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	conn.writeMu.Unlock()
+	if err != nil {
+		conn.close(err)
+		return fmt.Errorf("failed to call %s: %w", method, err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-conn.done:
+		return fmt.Errorf("failed to call %s: %w", method, conn.err)
+	case msg := <-answer:
+		if msg.Error != nil {
+			return &webSocketCallError{
+				method:  method,
+				code:    msg.Error.Code,
+				message: msg.Error.Message,
+				reason:  msg.Error.Data.Reason,
+				errname: msg.Error.Data.Errname,
+				extra:   msg.Error.Data.Extra,
+			}
+		}
+		if result != nil && len(msg.Result) > 0 {
+			if err = json.Unmarshal(msg.Result, result); err != nil {
+				return fmt.Errorf("failed to parse result of %s: %w", method, err)
+			}
+		}
+		return nil
+	}
+}
+
+// readLoop hands answers to the calls waiting on them and job updates to their watchers until the connection closes.
+func (b *webSocketBackend) readLoop(conn *webSocketConn) {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn.ws, &data); err != nil {
+			b.dropConnection(conn, err)
+			return
+		}
+
+		var msg webSocketMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			klog.ErrorS(err, "failed to parse TrueNAS WebSocket message")
+			continue
+		}
+
+		if msg.ID != nil {
+			conn.mu.Lock()
+			answer, ok := conn.pending[*msg.ID]
+			conn.mu.Unlock()
+			if ok {
+				answer <- msg
+			}
+			continue
+		}
+		if msg.Method == "collection_update" {
+			b.handleCollectionUpdate(msg.Params)
+		}
+	}
+}
+
+func (b *webSocketBackend) handleCollectionUpdate(params json.RawMessage) {
+	var update webSocketCollectionUpdate
+	if err := json.Unmarshal(params, &update); err != nil || update.Collection != "core.get_jobs" || len(update.Fields) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	watcher, ok := b.jobWatchers[update.ID]
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	var job trueNASJob
+	if err := json.Unmarshal(update.Fields, &job); err != nil {
+		klog.ErrorS(err, "failed to parse TrueNAS job update", "jobID", update.ID)
+		return
+	}
+	job.ID = update.ID
+	// Only the latest state matters, a watcher which hasn't caught up gets this one instead
+	select {
+	case <-watcher:
+	default:
+	}
+	watcher <- job
+}
+
+// keepAlive pings the connection while it's idle so a dead one is noticed and replaced.
+func (b *webSocketBackend) keepAlive(conn *webSocketConn) {
+	ticker := time.NewTicker(webSocketPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), webSocketPingInterval)
+			err := b.send(ctx, conn, "core.ping", nil, nil)
+			cancel()
+			if err != nil {
+				b.dropConnection(conn, err)
+				return
+			}
+		}
+	}
+}
+
+// dropConnection closes a connection, the next call makes a new one.
+func (b *webSocketBackend) dropConnection(conn *webSocketConn, err error) {
+	b.mu.Lock()
+	if b.conn == conn {
+		b.conn = nil
+	}
+	closed := b.closed
+	b.mu.Unlock()
+
+	if conn.close(err) && !closed {
+		klog.ErrorS(err, "lost connection to TrueNAS WebSocket API", "url", b.url)
+	}
+}
+
+// close fails the calls waiting on the connection, reporting whether it was still open.
+func (c *webSocketConn) close(err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return false
+	}
+	c.err = err
+	close(c.done)
+	_ = c.ws.Close()
+	return true
+}
+
+func (b *webSocketBackend) call(ctx context.Context, method string, result interface{}, args ...apiArg) error {
+	conn, err := b.connection(ctx)
+	if err != nil {
+		return err
+	}
+	params := make([]interface{}, 0, len(args))
+	for _, a := range args {
+		params = append(params, a.value)
+	}
+	return b.send(ctx, conn, method, params, result)
+}
+
+func (b *webSocketBackend) query(ctx context.Context, service string, filters []QueryFilter, options queryOptions, limit, offset int32, result interface{}) error {
+	rpcFilters := make([]interface{}, 0, len(filters))
+	for _, filter := range filters {
+		rpcFilters = append(rpcFilters, filter.rpc())
+	}
+	return b.call(ctx, service+".query", result, arg("query-filters", rpcFilters), arg("query-options", options.rpc(limit, offset)))
+}
+
+func (b *webSocketBackend) get(ctx context.Context, service string, id, result interface{}) error {
+	return b.call(ctx, service+".get_instance", result, arg("id", id))
+}
+
+func (b *webSocketBackend) config(ctx context.Context, service string, result interface{}) error {
+	return b.call(ctx, service+".config", result)
+}
+
+func (b *webSocketBackend) create(ctx context.Context, service string, data, result interface{}) error {
+	return b.call(ctx, service+".create", result, arg("data", data))
+}
+
+func (b *webSocketBackend) update(ctx context.Context, service string, id, data, result interface{}) error {
+	return b.call(ctx, service+".update", result, arg("id", id), arg("data", data))
+}
+
+func (b *webSocketBackend) delete(ctx context.Context, service string, id interface{}, args ...apiArg) error {
+	return b.call(ctx, service+".delete", nil, append([]apiArg{arg("id", id)}, args...)...)
+}
+
+// job waits on the job's updates from core.get_jobs events, logging its progress, and checks on it now and then in case
+// they stop coming.
+func (b *webSocketBackend) job(ctx context.Context, method string, result interface{}, args ...apiArg) error {
+	var jobID int64
+	if err := b.call(ctx, method, &jobID, args...); err != nil {
+		return err
+	}
+
+	watcher := make(chan trueNASJob, 1)
+	b.mu.Lock()
+	b.jobWatchers[jobID] = watcher
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.jobWatchers, jobID)
+		b.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(webSocketJobPollInterval)
+	defer ticker.Stop()
+
+	// The job may have finished before being watched
+	job, err := getJob(ctx, b, jobID)
+	for {
+		if err != nil {
+			return err
+		}
+		done, jobErr := job.finished()
+		if done {
+			if jobErr != nil {
+				return jobErr
+			}
+			return job.decodeResult(result)
+		}
+		klog.V(4).InfoS("waiting for TrueNAS job", "method", method, "jobID", jobID, "percent", job.Progress.Percent, "progress", job.Progress.Description)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case update := <-watcher:
+			job, err = &update, nil
+		case <-ticker.C:
+			job, err = getJob(ctx, b, jobID)
+		}
+	}
+}
+
+func (b *webSocketBackend) close() error {
+	b.mu.Lock()
+	conn := b.conn
+	b.conn = nil
+	b.closed = true
+	b.mu.Unlock()
+
+	if conn != nil {
+		conn.close(errWebSocketClosed)
+	}
+	return nil
+}
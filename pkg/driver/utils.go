@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	netutil "k8s.io/utils/net"
@@ -84,9 +85,64 @@ func formatBytes(inputBytes int64) string {
 	return result + unit
 }
 
+// capacityInRange reports whether the size of an existing volume satisfies a capacity range, telling a retried
+// CreateVolume apart from one asking for a different volume under the same name.
+func capacityInRange(capRange *csi.CapacityRange, size int64) bool {
+	if required := capRange.GetRequiredBytes(); required > 0 && size < required {
+		return false
+	}
+	if limit := capRange.GetLimitBytes(); limit > 0 && size > limit {
+		return false
+	}
+	return true
+}
+
+// getServerFromSource returns the server as used in a mount source, bracketing IPv6 addresses whether or not they
+// already were.
+// isHostAddress reports whether a server is a hostname or IP without a port, IPv6 addresses optionally in brackets.
+func isHostAddress(server string) bool {
+	host := strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
+	return host != "" && !strings.ContainsAny(host, " \t/[]") && (!strings.Contains(host, ":") || strings.Contains(host, "::") || strings.Count(host, ":") > 1)
+}
+
 func getServerFromSource(server string) string {
+	server = strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
 	if netutil.IsIPv6String(server) {
 		return fmt.Sprintf("[%s]", server)
 	}
 	return server
 }
+
+// volumeLocks makes sure only one operation runs on a volume at a time, for operations kubelet may retry while the
+// previous attempt is still going.
+type volumeLocks struct {
+	mu    sync.Mutex
+	inUse map[string]bool
+}
+
+// tryAcquire locks the volume, returning false if it's already locked.
+func (l *volumeLocks) tryAcquire(volumeID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inUse == nil {
+		l.inUse = make(map[string]bool)
+	}
+	if l.inUse[volumeID] {
+		return false
+	}
+	l.inUse[volumeID] = true
+	return true
+}
+
+func (l *volumeLocks) release(volumeID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.inUse, volumeID)
+}
+
+// busy reports whether any volume is locked.
+func (l *volumeLocks) busy() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.inUse) > 0
+}
@@ -0,0 +1,38 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServerValidation(t *testing.T) {
+	tests := []struct {
+		server string
+		valid  bool
+	}{
+		{server: "nas.local", valid: true},
+		{server: "10.0.0.1", valid: true},
+		{server: "fd00::1", valid: true},
+		{server: "[fd00::1]", valid: true},
+		{server: "", valid: false},
+		{server: "10.0.0.1:2049", valid: false},
+		{server: "nas.local/tank", valid: false},
+		{server: "nas local", valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			nfsErr := ValidateNFSServers([]string{tt.server})
+			smbErr := ValidateSMBServer(tt.server)
+			if (nfsErr == nil) != tt.valid || (smbErr == nil) != tt.valid {
+				t.Fatalf("validating %q returned %v and %v, want valid %t", tt.server, nfsErr, smbErr, tt.valid)
+			}
+			// Each names the protocol the address is for
+			if nfsErr != nil && !strings.HasPrefix(nfsErr.Error(), "NFS server") {
+				t.Errorf("NFS error %q doesn't say it's an NFS server", nfsErr)
+			}
+			if smbErr != nil && !strings.HasPrefix(smbErr.Error(), "SMB server") {
+				t.Errorf("SMB error %q doesn't say it's an SMB server", smbErr)
+			}
+		})
+	}
+}